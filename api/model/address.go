@@ -0,0 +1,89 @@
+package model
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var countryCodePattern = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// PostalAddress is a postal address as printed on a shipping label or invoice.
+type PostalAddress struct {
+	FullName   string `json:"full_name" sql:"type:varchar(100)"`
+	Line1      string `json:"line1" sql:"type:varchar(255)"`
+	Line2      string `json:"line2" sql:"type:varchar(255)"`
+	City       string `json:"city" sql:"type:varchar(100)"`
+	Region     string `json:"region" sql:"type:varchar(100)"` // state, province or county
+	PostalCode string `json:"postal_code" sql:"type:varchar(20)"`
+	Country    string `json:"country" sql:"type:varchar(2)"` // ISO 3166-1 alpha-2 code
+	Phone      string `json:"phone" sql:"type:varchar(20)"`
+}
+
+// Normalize trims surrounding whitespace from every field and upper-cases the country code.
+func (a *PostalAddress) Normalize() {
+	for _, f := range []*string{&a.FullName, &a.Line1, &a.Line2, &a.City, &a.Region, &a.PostalCode, &a.Country, &a.Phone} {
+		*f = strings.TrimSpace(*f)
+	}
+	a.Country = strings.ToUpper(a.Country)
+}
+
+// Validate checks that a has every field needed to deliver to it. Errors wrap ErrInvalidUserInput.
+func (a PostalAddress) Validate() error {
+	required := []struct {
+		name, value string
+		max         int
+	}{
+		{"full_name", a.FullName, 100},
+		{"line1", a.Line1, 255},
+		{"city", a.City, 100},
+		{"country", a.Country, 2},
+	}
+	for _, f := range required {
+		if f.value == "" {
+			return fmt.Errorf("%s is required: %w", f.name, ErrInvalidUserInput)
+		}
+		if utf8.RuneCountInString(f.value) > f.max {
+			return fmt.Errorf("%s is too long: %w", f.name, ErrInvalidUserInput)
+		}
+	}
+	optional := []struct {
+		name, value string
+		max         int
+	}{
+		{"line2", a.Line2, 255},
+		{"region", a.Region, 100},
+		{"postal_code", a.PostalCode, 20},
+		{"phone", a.Phone, 20},
+	}
+	for _, f := range optional {
+		if utf8.RuneCountInString(f.value) > f.max {
+			return fmt.Errorf("%s is too long: %w", f.name, ErrInvalidUserInput)
+		}
+	}
+	if !countryCodePattern.MatchString(a.Country) {
+		return fmt.Errorf("country must be an ISO 3166-1 alpha-2 code: %w", ErrInvalidUserInput)
+	}
+	return nil
+}
+
+// Address is an entry of a user's address book.
+// Each user has at most one default address, which orders ship and bill to unless told otherwise.
+type Address struct {
+	ID     uint   `json:"id" gorm:"primaryKey;autoIncrement"`
+	UserID uint   `json:"user_id" gorm:"not null;index"`
+	Label  string `json:"label" sql:"type:varchar(50)"` // e.g. "Home" or "Office"
+	PostalAddress
+	IsDefault bool      `json:"is_default" gorm:"not null;default:false"`
+	CreatedAt time.Time `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt time.Time `json:"updated_at" gorm:"autoUpdateTime"`
+}
+
+// AddressSelection picks the address book entries an order ships and bills to.
+// A zero shipping address selects the default address, and a zero billing address the shipping address.
+type AddressSelection struct {
+	ShippingAddressID uint `json:"shipping_address_id"`
+	BillingAddressID  uint `json:"billing_address_id"`
+}
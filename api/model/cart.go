@@ -0,0 +1,108 @@
+package model
+
+import "time"
+
+// Problems a cart line can have, reported by Cart.Summary.
+const (
+	CartProblemUnavailable       = "unavailable"        // the product or variant has been removed from the catalog
+	CartProblemOutOfStock        = "out_of_stock"       // the product has no stock left
+	CartProblemInsufficientStock = "insufficient_stock" // the product has less stock than the quantity in the cart
+)
+
+// CartOwner identifies a cart: the cart of a user, or an anonymous cart identified by the SHA-256 hash of its token.
+type CartOwner struct {
+	UserID    uint
+	TokenHash string
+}
+
+// Cart holds the products a customer intends to order.
+// A cart belongs either to a user or, before the customer logs in, to the holder of its token.
+// Carts do not reserve stock; prices and stock are checked live and again at checkout.
+type Cart struct {
+	ID        uint       `json:"id" gorm:"primaryKey;autoIncrement"`
+	UserID    *uint      `json:"user_id" gorm:"uniqueIndex"`
+	TokenHash *string    `json:"-" gorm:"uniqueIndex" sql:"type:varchar(64)"`
+	Items     []CartItem `json:"items" gorm:"foreignKey:CartID;constraint:OnDelete:CASCADE"`
+	CreatedAt time.Time  `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt time.Time  `json:"updated_at" gorm:"autoUpdateTime"`
+}
+
+// CartItem is a single product line of a cart.
+type CartItem struct {
+	ID        uint     `json:"id" gorm:"primaryKey;autoIncrement"`
+	CartID    uint     `json:"cart_id" gorm:"not null;uniqueIndex:idx_cart_product_variant"`
+	ProductID uint     `json:"product_id" gorm:"not null;uniqueIndex:idx_cart_product_variant"`
+	Product   *Product `json:"-"` // nil if the product has been deleted
+	// VariantID is zero for products without variants, rather than null, so that it can be part of the unique index.
+	VariantID uint            `json:"variant_id" gorm:"not null;default:0;uniqueIndex:idx_cart_product_variant"`
+	Variant   *ProductVariant `json:"-" gorm:"-"` // nil if the variant has been deleted
+	Quantity  int             `json:"quantity" gorm:"not null"`
+	CreatedAt time.Time       `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt time.Time       `json:"updated_at" gorm:"autoUpdateTime"`
+}
+
+// CartLine is a cart item priced at the product's current price.
+type CartLine struct {
+	ProductID uint    `json:"product_id"`
+	VariantID uint    `json:"variant_id,omitempty"`
+	SKU       string  `json:"sku,omitempty"`
+	Variant   string  `json:"variant,omitempty"` // label of the variant, e.g. "M / Red"
+	Name      string  `json:"name"`
+	UnitPrice float64 `json:"unit_price"`
+	Quantity  int     `json:"quantity"`
+	LineTotal float64 `json:"line_total"`
+	Available int     `json:"available"` // stock currently available
+	Problem   string  `json:"problem,omitempty"`
+}
+
+// CartSummary is the priced content of a cart.
+type CartSummary struct {
+	Items []CartLine `json:"items"`
+	// Total is the sum of the lines that can be ordered.
+	Total     float64 `json:"total"`
+	ItemCount int     `json:"item_count"`
+	// CheckoutReady is true if the cart is not empty and none of its lines has a problem.
+	CheckoutReady bool `json:"checkout_ready"`
+	// CartToken is only set in the response that creates an anonymous cart.
+	CartToken string `json:"cart_token,omitempty"`
+}
+
+// Summary prices the items of c, whose products and variants must be loaded, at the current prices and stock.
+func (c Cart) Summary() CartSummary {
+	summary := CartSummary{Items: make([]CartLine, 0, len(c.Items)), CheckoutReady: len(c.Items) > 0}
+	for _, item := range c.Items {
+		line := CartLine{ProductID: item.ProductID, VariantID: item.VariantID, Quantity: item.Quantity}
+		available := 0
+		if p := item.Product; p != nil {
+			line.Name = p.Name
+			line.UnitPrice = p.Price
+			available = p.Quantity
+		}
+		if v := item.Variant; v != nil && item.Product != nil {
+			line.SKU = v.SKU
+			line.Variant = v.Label()
+			line.UnitPrice = v.PriceOf(*item.Product)
+			available = v.Quantity
+		}
+		line.LineTotal = line.UnitPrice * float64(item.Quantity)
+		line.Available = max(available, 0)
+
+		switch {
+		case item.Product == nil, item.VariantID != 0 && item.Variant == nil:
+			line.Problem = CartProblemUnavailable
+		case available <= 0:
+			line.Problem = CartProblemOutOfStock
+		case available < item.Quantity:
+			line.Problem = CartProblemInsufficientStock
+		}
+
+		if line.Problem == "" {
+			summary.Total += line.LineTotal
+		} else {
+			summary.CheckoutReady = false
+		}
+		summary.ItemCount += item.Quantity
+		summary.Items = append(summary.Items, line)
+	}
+	return summary
+}
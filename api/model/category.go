@@ -0,0 +1,91 @@
+package model
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// Category is a node of the product category tree.
+// Categories without a parent are the roots of the tree; siblings are ordered by position, then name.
+type Category struct {
+	ID        uint      `json:"id" gorm:"primaryKey;autoIncrement"`
+	ParentID  *uint     `json:"parent_id" gorm:"index"`
+	Parent    *Category `json:"-" gorm:"constraint:OnDelete:RESTRICT"`
+	Name      string    `json:"name" gorm:"not null" sql:"type:varchar(100)"`
+	Slug      string    `json:"slug" gorm:"not null;uniqueIndex" sql:"type:varchar(100)"` // unique across the tree
+	Position  int       `json:"position" gorm:"not null;default:0"`
+	CreatedAt time.Time `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt time.Time `json:"updated_at" gorm:"autoUpdateTime"`
+
+	// Children and Breadcrumbs are only populated by the queries returning them.
+	Children    []Category    `json:"children,omitempty" gorm:"-"`
+	Breadcrumbs []CategoryRef `json:"breadcrumbs,omitempty" gorm:"-"` // from the root to the category itself
+}
+
+// Ref returns the reference to c used in breadcrumbs.
+func (c Category) Ref() CategoryRef {
+	return CategoryRef{ID: c.ID, Name: c.Name, Slug: c.Slug}
+}
+
+// Normalize trims the name and slug, deriving the slug from the name if it is empty.
+func (c *Category) Normalize() {
+	c.Name = strings.TrimSpace(c.Name)
+	c.Slug = strings.ToLower(strings.TrimSpace(c.Slug))
+	if c.Slug == "" {
+		c.Slug = Slugify(c.Name)
+	}
+}
+
+// Validate checks the name and slug of c. Errors wrap ErrInvalidUserInput.
+func (c Category) Validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("name is required: %w", ErrInvalidUserInput)
+	}
+	if utf8.RuneCountInString(c.Name) > 100 {
+		return fmt.Errorf("name is too long: %w", ErrInvalidUserInput)
+	}
+	if len(c.Slug) > 100 {
+		return fmt.Errorf("slug is too long: %w", ErrInvalidUserInput)
+	}
+	if !slugPattern.MatchString(c.Slug) {
+		return fmt.Errorf("slug must consist of lower case letters and digits separated by dashes: %w", ErrInvalidUserInput)
+	}
+	return nil
+}
+
+// Slugify derives a URL slug from a name, e.g. "Home & Garden" becomes "home-garden".
+// Characters other than ASCII letters and digits are dropped.
+func Slugify(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return b.String()
+}
+
+// CategoryRef identifies a category in breadcrumbs.
+type CategoryRef struct {
+	ID   uint   `json:"id"`
+	Name string `json:"name"`
+	Slug string `json:"slug"`
+}
+
+// CategoryMove moves a category, along with its subtree, under a new parent.
+type CategoryMove struct {
+	ParentID *uint `json:"parent_id"` // nil to make the category a root
+	Position int   `json:"position"`
+}
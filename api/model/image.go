@@ -0,0 +1,81 @@
+package model
+
+import "time"
+
+// MaxProductImages is the number of images the gallery of a product can hold.
+const MaxProductImages = 20
+
+// ImageSize is a size images are scaled down to for display, by the length of their longest side.
+type ImageSize struct {
+	Name   string
+	Pixels int
+}
+
+// ImageSizes are the thumbnail sizes generated for every product image.
+var ImageSizes = []ImageSize{
+	{Name: "small", Pixels: 160},
+	{Name: "medium", Pixels: 480},
+	{Name: "large", Pixels: 1200},
+}
+
+// imageExtensions maps the content types of uploaded images to the file extension of their blobs.
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// ProductImage is an image of the gallery of a product, shown in the order of Position.
+// The uploaded image and its thumbnails are stored as blobs under Key, e.g. "products/12/3f9c0a",
+// as "products/12/3f9c0a/original.jpg", "products/12/3f9c0a/small.jpg" and so on.
+type ProductImage struct {
+	ID          uint      `json:"id" gorm:"primaryKey;autoIncrement"`
+	ProductID   uint      `json:"product_id" gorm:"not null;index"`
+	Position    int       `json:"position" gorm:"not null;default:0"`
+	Key         string    `json:"-" gorm:"not null" sql:"type:varchar(255)"`
+	ContentType string    `json:"content_type" gorm:"not null" sql:"type:varchar(50)"`
+	Width       int       `json:"width" gorm:"not null"`
+	Height      int       `json:"height" gorm:"not null"`
+	Size        int64     `json:"size" gorm:"not null"` // of the uploaded image, in bytes
+	Alt         string    `json:"alt" sql:"type:varchar(255)"`
+	CreatedAt   time.Time `json:"created_at" gorm:"autoCreateTime"`
+
+	// URL and Thumbnails, keyed by the name of their ImageSize, are where the blobs are downloaded from.
+	// They depend on the blob store and are set by the API.
+	URL        string            `json:"url" gorm:"-"`
+	Thumbnails map[string]string `json:"thumbnails" gorm:"-"`
+}
+
+// OriginalKey returns the key of the blob of the uploaded image.
+func (i ProductImage) OriginalKey() string {
+	return i.Key + "/original" + imageExtensions[i.ContentType]
+}
+
+// ThumbnailKey returns the key of the blob of the thumbnail of i in size.
+// Images that fit in size are not scaled, and their thumbnail is the original.
+func (i ProductImage) ThumbnailKey(size ImageSize) string {
+	if i.Width <= size.Pixels && i.Height <= size.Pixels {
+		return i.OriginalKey()
+	}
+	return i.Key + "/" + size.Name + i.ThumbnailExt()
+}
+
+// ThumbnailExt returns the file extension of the thumbnails of i: JPEG photos keep their format,
+// other images are scaled to PNG, which preserves transparency.
+func (i ProductImage) ThumbnailExt() string {
+	if i.ContentType == "image/jpeg" {
+		return ".jpg"
+	}
+	return ".png"
+}
+
+// BlobKeys returns the keys of every blob stored for i.
+func (i ProductImage) BlobKeys() []string {
+	keys := []string{i.OriginalKey()}
+	for _, size := range ImageSizes {
+		if key := i.ThumbnailKey(size); key != keys[0] {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
@@ -1,14 +1,59 @@
 package model
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"gorm.io/gorm"
+	"strings"
 	"time"
 )
 
 // ErrInvalidUserInput is a wrapper for all errors generated as a result of invalid user input
 var ErrInvalidUserInput = errors.New("user input error")
 
+// ErrNotFound is a wrapper for errors generated when user input references a resource that does not exist.
+// It wraps ErrInvalidUserInput, so callers that only check for ErrInvalidUserInput keep working.
+var ErrNotFound = fmt.Errorf("not found: %w", ErrInvalidUserInput)
+
+// StockShortage describes a product that does not have enough stock to fulfil an order line.
+type StockShortage struct {
+	ProductID uint   `json:"product_id"`
+	VariantID uint   `json:"variant_id,omitempty"`
+	SKU       string `json:"sku,omitempty"`
+	Name      string `json:"name"`
+	Requested int    `json:"requested"`
+	Available int    `json:"available"`
+}
+
+// OutOfStockError is returned when an order cannot be placed because one or more products lack stock.
+// It wraps ErrInvalidUserInput.
+type OutOfStockError struct {
+	Shortages []StockShortage
+}
+
+func (e *OutOfStockError) Error() string {
+	names := make([]string, 0, len(e.Shortages))
+	for _, s := range e.Shortages {
+		name := s.Name
+		if s.SKU != "" {
+			name += " " + s.SKU
+		}
+		names = append(names, fmt.Sprintf("%s (id %d: requested %d, available %d)", name, s.ProductID, s.Requested, s.Available))
+	}
+	return "insufficient stock for " + strings.Join(names, ", ")
+}
+
+func (e *OutOfStockError) Unwrap() error {
+	return ErrInvalidUserInput
+}
+
+// Actor identifies the authenticated user on whose behalf a repository operation is performed.
+type Actor struct {
+	UserID      uint
+	Permissions []Permission
+}
+
 type OrderStatus int8
 
 const (
@@ -23,26 +68,339 @@ const (
 	OrderStatusFailed
 )
 
+var orderStatusNames = map[OrderStatus]string{
+	OrderStatusUnknown:   "Unknown",
+	OrderStatusPending:   "Pending",
+	OrderStatusConfirmed: "Confirmed",
+	OrderStatusShipped:   "Shipped",
+	OrderStatusDelivered: "Delivered",
+	OrderStatusCanceled:  "Canceled",
+	OrderStatusReturned:  "Returned",
+	OrderStatusRefunded:  "Refunded",
+	OrderStatusFailed:    "Failed",
+}
+
+// orderStatusTransitions lists, for every status, the statuses an order may move to next.
+// Statuses without an entry are terminal.
+var orderStatusTransitions = map[OrderStatus][]OrderStatus{
+	OrderStatusPending:   {OrderStatusConfirmed, OrderStatusCanceled, OrderStatusFailed},
+	OrderStatusConfirmed: {OrderStatusShipped, OrderStatusCanceled, OrderStatusFailed},
+	OrderStatusShipped:   {OrderStatusDelivered, OrderStatusReturned, OrderStatusFailed},
+	OrderStatusDelivered: {OrderStatusReturned},
+	OrderStatusReturned:  {OrderStatusRefunded},
+	OrderStatusCanceled:  {OrderStatusRefunded},
+}
+
+func (s OrderStatus) String() string {
+	if name, ok := orderStatusNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("OrderStatus(%d)", int8(s))
+}
+
+// NextStatuses returns the statuses an order in status s may transition to.
+func (s OrderStatus) NextStatuses() []OrderStatus {
+	return orderStatusTransitions[s]
+}
+
+// CanTransitionTo reports whether an order in status s may move to next.
+func (s OrderStatus) CanTransitionTo(next OrderStatus) bool {
+	for _, allowed := range orderStatusTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// InvalidStatusTransitionError is returned when an order status change is not permitted
+// by the order state machine. It wraps ErrInvalidUserInput.
+type InvalidStatusTransitionError struct {
+	From    OrderStatus
+	To      OrderStatus
+	Allowed []OrderStatus
+}
+
+func (e *InvalidStatusTransitionError) Error() string {
+	if len(e.Allowed) == 0 {
+		return fmt.Sprintf("cannot change order status from %s to %s: %s is a final status", e.From, e.To, e.From)
+	}
+	names := make([]string, 0, len(e.Allowed))
+	for _, s := range e.Allowed {
+		names = append(names, s.String())
+	}
+	return fmt.Sprintf("cannot change order status from %s to %s; allowed next statuses: %s",
+		e.From, e.To, strings.Join(names, ", "))
+}
+
+func (e *InvalidStatusTransitionError) Unwrap() error {
+	return ErrInvalidUserInput
+}
+
 // User represents a user in the e-commerce system.
 type User struct {
+	ID                uint           `json:"id" gorm:"primaryKey;autoIncrement"`
+	Email             string         `json:"email" gorm:"unique;not null" sql:"type:varchar(100)"`
+	Password          string         `json:"-" gorm:"not null" sql:"type:varchar(255)"`
+	Name              string         `json:"name" sql:"type:varchar(100)"`
+	Phone             string         `json:"phone" sql:"type:varchar(20)"`
+	Roles             []Role         `json:"roles" gorm:"many2many:user_roles;constraint:OnDelete:CASCADE"`
+	EmailVerifiedAt   *time.Time     `json:"email_verified_at"`
+	PendingEmail      string         `json:"pending_email,omitempty" sql:"type:varchar(100)"` // new email awaiting confirmation
+	MFASecret         string         `json:"-" sql:"type:varchar(64)"`                        // base32 TOTP secret, set once enrollment starts
+	MFAEnabledAt      *time.Time     `json:"mfa_enabled_at"`
+	MFALastStep       int64          `json:"-"`           // TOTP time step of the last accepted code, to reject replays
+	DisabledAt        *time.Time     `json:"disabled_at"` // disabled users can neither log in nor use existing tokens
+	PasswordChangedAt *time.Time     `json:"-"`           // MFA challenges issued earlier are no longer valid
+	CreatedAt         time.Time      `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt         time.Time      `json:"updated_at" gorm:"autoUpdateTime"`
+	DeletedAt         gorm.DeletedAt `json:"-" gorm:"deleted_at"`
+}
+
+// UserFilter selects users in admin listings. Zero fields do not filter.
+type UserFilter struct {
+	Email         string // case-insensitive substring of the email
+	Role          string
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	Disabled      *bool
+	Page          int // 1-based
+	PerPage       int
+}
+
+// Session represents a login session of a user.
+// A session is the family of refresh tokens issued from a single login;
+// revoking it invalidates every refresh and access token issued within it.
+type Session struct {
+	ID        string     `json:"id" gorm:"primaryKey" sql:"type:varchar(64)"`
+	UserID    uint       `json:"user_id" gorm:"not null;index"`
+	RevokedAt *time.Time `json:"revoked_at"`
+	CreatedAt time.Time  `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt time.Time  `json:"updated_at" gorm:"autoUpdateTime"`
+}
+
+// RefreshToken is a single-use token that can be exchanged for a new access token.
+// Only the SHA-256 hash of the token is stored.
+type RefreshToken struct {
+	ID        uint       `json:"id" gorm:"primaryKey;autoIncrement"`
+	SessionID string     `json:"session_id" gorm:"not null;index" sql:"type:varchar(64)"`
+	TokenHash string     `json:"-" gorm:"unique;not null" sql:"type:varchar(64)"`
+	ExpiresAt time.Time  `json:"expires_at" gorm:"not null"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at" gorm:"autoCreateTime"`
+}
+
+// ErrRefreshTokenReused is returned when an already rotated refresh token is presented again.
+// The session the token belongs to is revoked as a consequence. It wraps ErrInvalidUserInput.
+var ErrRefreshTokenReused = fmt.Errorf("refresh token reused: %w", ErrInvalidUserInput)
+
+// ErrEmailNotVerified is returned when an unverified account attempts to log in
+// while email verification is required. It wraps ErrInvalidUserInput.
+var ErrEmailNotVerified = fmt.Errorf("email address not verified: %w", ErrInvalidUserInput)
+
+// ErrInvalidPassword is returned when the current password given to confirm an account change is wrong.
+// It wraps ErrInvalidUserInput.
+var ErrInvalidPassword = fmt.Errorf("invalid password: %w", ErrInvalidUserInput)
+
+// ErrAccountDisabled is returned when a disabled account attempts to log in. It wraps ErrInvalidUserInput.
+var ErrAccountDisabled = fmt.Errorf("account disabled: %w", ErrInvalidUserInput)
+
+// ErrEmailInUse is returned when an email address is already registered to another user. It wraps ErrInvalidUserInput.
+var ErrEmailInUse = fmt.Errorf("email address already in use: %w", ErrInvalidUserInput)
+
+// TokenPurpose identifies what a UserToken can be used for.
+type TokenPurpose string
+
+const (
+	TokenPurposeVerifyEmail   TokenPurpose = "verify_email"
+	TokenPurposeResetPassword TokenPurpose = "reset_password"
+	TokenPurposeChangeEmail   TokenPurpose = "change_email"
+)
+
+// UserToken is a single-use, expiring token sent to a user by email.
+// Only the SHA-256 hash of the token is stored.
+type UserToken struct {
+	ID        uint         `json:"id" gorm:"primaryKey;autoIncrement"`
+	UserID    uint         `json:"user_id" gorm:"not null;index"`
+	Purpose   TokenPurpose `json:"purpose" gorm:"not null" sql:"type:varchar(32)"`
+	TokenHash string       `json:"-" gorm:"unique;not null" sql:"type:varchar(64)"`
+	ExpiresAt time.Time    `json:"expires_at" gorm:"not null"`
+	UsedAt    *time.Time   `json:"used_at"`
+	CreatedAt time.Time    `json:"created_at" gorm:"autoCreateTime"`
+}
+
+// RecoveryCode is a single-use code that can replace a TOTP code when the user's authenticator is unavailable.
+// Only the SHA-256 hash of the code is stored.
+type RecoveryCode struct {
+	ID        uint       `json:"id" gorm:"primaryKey;autoIncrement"`
+	UserID    uint       `json:"user_id" gorm:"not null;index"`
+	CodeHash  string     `json:"-" gorm:"unique;not null" sql:"type:varchar(64)"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at" gorm:"autoCreateTime"`
+}
+
+// ExternalIdentity links a user to their account at an external OpenID Connect provider.
+type ExternalIdentity struct {
 	ID        uint      `json:"id" gorm:"primaryKey;autoIncrement"`
-	Email     string    `json:"email" gorm:"unique;not null" sql:"type:varchar(100)"`
-	Password  string    `json:"-" gorm:"not null" sql:"type:varchar(255)"`
-	IsAdmin   bool      `json:"-" gorm:"default:false"`
+	UserID    uint      `json:"user_id" gorm:"not null;index"`
+	Provider  string    `json:"provider" gorm:"not null;uniqueIndex:idx_external_identity" sql:"type:varchar(50)"`
+	Subject   string    `json:"subject" gorm:"not null;uniqueIndex:idx_external_identity" sql:"type:varchar(255)"`
+	Email     string    `json:"email" sql:"type:varchar(100)"` // email asserted by the provider when the identity was linked
 	CreatedAt time.Time `json:"created_at" gorm:"autoCreateTime"`
-	UpdatedAt time.Time `json:"updated_at" gorm:"autoUpdateTime"`
+}
+
+// OIDCAuthRequest is a pending sign-in at an external OpenID Connect provider,
+// identified by the SHA-256 hash of the state parameter sent to the provider.
+type OIDCAuthRequest struct {
+	StateHash    string    `gorm:"primaryKey" sql:"type:varchar(64)"`
+	Provider     string    `gorm:"not null" sql:"type:varchar(50)"`
+	Nonce        string    `gorm:"not null" sql:"type:varchar(64)"`
+	CodeVerifier string    `gorm:"not null" sql:"type:varchar(128)"`
+	ExpiresAt    time.Time `gorm:"not null"`
+}
+
+// Impersonation is a time-limited grant for a staff user (the actor) to act as a customer, to debug what they see.
+// Requests made while impersonating are recorded as AuditLogEntry rows.
+type Impersonation struct {
+	ID        string     `json:"id" gorm:"primaryKey" sql:"type:varchar(32)"`
+	ActorID   uint       `json:"actor_id" gorm:"not null;index"`
+	UserID    uint       `json:"user_id" gorm:"not null;index"`
+	Reason    string     `json:"reason" gorm:"not null" sql:"type:varchar(255)"`
+	ReadOnly  bool       `json:"read_only" gorm:"not null"`
+	ExpiresAt time.Time  `json:"expires_at" gorm:"not null"`
+	EndedAt   *time.Time `json:"ended_at"`
+	CreatedAt time.Time  `json:"created_at" gorm:"autoCreateTime"`
+}
+
+// Active reports whether the impersonation can still be used at now.
+func (i Impersonation) Active(now time.Time) bool {
+	return i.EndedAt == nil && now.Before(i.ExpiresAt)
+}
+
+// AuditLogEntry records a single request made while impersonating a user.
+type AuditLogEntry struct {
+	ID              uint      `json:"id" gorm:"primaryKey;autoIncrement"`
+	ImpersonationID string    `json:"impersonation_id" gorm:"not null;index" sql:"type:varchar(32)"`
+	ActorID         uint      `json:"actor_id" gorm:"not null"`
+	UserID          uint      `json:"user_id" gorm:"not null"`
+	Method          string    `json:"method" gorm:"not null" sql:"type:varchar(10)"`
+	Path            string    `json:"path" gorm:"not null" sql:"type:varchar(255)"`
+	Status          int       `json:"status" gorm:"not null"`
+	CreatedAt       time.Time `json:"created_at" gorm:"autoCreateTime"`
+}
+
+// IdempotencyKey records a mutating request made with an Idempotency-Key header, and its response once complete,
+// so that retries of the request replay the response instead of repeating its effects.
+// Keys are unique within a scope, such as a user, since clients choose them.
+type IdempotencyKey struct {
+	ID                  uint   `gorm:"primaryKey;autoIncrement"`
+	Scope               string `gorm:"not null;uniqueIndex:idx_idempotency_key" sql:"type:varchar(100)"`
+	Key                 string `gorm:"not null;uniqueIndex:idx_idempotency_key" sql:"type:varchar(255)"`
+	Fingerprint         string `gorm:"not null" sql:"type:varchar(64)"` // SHA-256 of the method, path and body
+	ResponseStatus      int    // zero while the original request is in progress
+	ResponseContentType string `sql:"type:varchar(100)"`
+	ResponseBody        []byte
+	CreatedAt           time.Time `gorm:"autoCreateTime"`
+	StartedAt           time.Time `gorm:"not null;default:CURRENT_TIMESTAMP"` // when the request holding the key started
+	ExpiresAt           time.Time `gorm:"not null;index"`
+}
+
+// Completed reports whether the response of the original request has been recorded.
+func (k IdempotencyKey) Completed() bool {
+	return k.ResponseStatus != 0
+}
+
+// LoginThrottle tracks failed login attempts for a single key, such as an account email or a client IP.
+type LoginThrottle struct {
+	Key           string     `json:"key" gorm:"primaryKey" sql:"type:varchar(255)"`
+	Failures      int        `json:"failures" gorm:"not null"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until"`
+}
+
+// LoginThrottlePolicy decides when repeated login failures lock a key out, and for how long.
+type LoginThrottlePolicy struct {
+	// Threshold is the number of consecutive failures after which the key is locked.
+	Threshold int
+
+	// BaseLockout is the lockout applied when Threshold is reached.
+	// Every further failure doubles it, up to MaxLockout.
+	BaseLockout time.Duration
+	MaxLockout  time.Duration
+
+	// ResetAfter is the period without failures after which the failure count starts over.
+	ResetAfter time.Duration
+}
+
+// LockoutFor returns how long a key is locked after its failures-th consecutive failure.
+func (p LoginThrottlePolicy) LockoutFor(failures int) time.Duration {
+	if failures < p.Threshold {
+		return 0
+	}
+	lockout := p.BaseLockout
+	for i := p.Threshold; i < failures && lockout < p.MaxLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > p.MaxLockout {
+		return p.MaxLockout
+	}
+	return lockout
+}
+
+// APIKey authenticates another system, such as a warehouse or ERP integration, without a user login.
+// Only the SHA-256 hash of the key is stored; Prefix identifies the key in listings and lookups.
+type APIKey struct {
+	ID          uint          `json:"id" gorm:"primaryKey;autoIncrement"`
+	Name        string        `json:"name" gorm:"not null" sql:"type:varchar(100)"`
+	Prefix      string        `json:"prefix" gorm:"unique;not null" sql:"type:varchar(32)"`
+	KeyHash     string        `json:"-" gorm:"not null" sql:"type:varchar(64)"`
+	Scopes      []APIKeyScope `json:"scopes" gorm:"foreignKey:APIKeyID;constraint:OnDelete:CASCADE"`
+	CreatedByID uint          `json:"created_by_id" gorm:"not null"` // requests made with the key act on behalf of this user
+	ExpiresAt   *time.Time    `json:"expires_at"`
+	LastUsedAt  *time.Time    `json:"last_used_at"`
+	RevokedAt   *time.Time    `json:"revoked_at"`
+	CreatedAt   time.Time     `json:"created_at" gorm:"autoCreateTime"`
+}
+
+// APIKeyScope grants a single permission to an API key.
+type APIKeyScope struct {
+	APIKeyID   uint       `json:"-" gorm:"primaryKey"`
+	Permission Permission `json:"permission" gorm:"primaryKey" sql:"type:varchar(50)"`
+}
+
+// MarshalJSON encodes a scope as the bare permission name.
+func (s APIKeyScope) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Permission)
+}
+
+// Permissions returns the permissions granted to k.
+func (k APIKey) Permissions() []Permission {
+	perms := make([]Permission, 0, len(k.Scopes))
+	for _, s := range k.Scopes {
+		perms = append(perms, s.Permission)
+	}
+	return perms
 }
 
 // Product represents a product in the e-commerce system.
 type Product struct {
 	ID          uint           `json:"id" gorm:"primaryKey;autoIncrement"`
-	Name        string         `json:"name" gorm:"not null" sql:"type:varchar(100)"`
+	Name        string         `json:"name" gorm:"not null;index" sql:"type:varchar(100)"`
 	Description string         `json:"description" sql:"type:text"`
-	Price       float64        `json:"price" gorm:"not null"`
-	Quantity    int            `json:"quantity" gorm:"not null"`
-	CreatedAt   time.Time      `json:"created_at" gorm:"autoCreateTime"`
-	UpdatedAt   time.Time      `json:"updated_at" gorm:"autoUpdateTime"`
+	Price       float64        `json:"price" gorm:"not null;index"`
+	Quantity    int            `json:"quantity" gorm:"not null"` // the sum of the stock of its variants, if it has any
+	CreatedAt   time.Time      `json:"created_at" gorm:"autoCreateTime;index"`
+	UpdatedAt   time.Time      `json:"updated_at" gorm:"autoUpdateTime;index"`
 	DeletedAt   gorm.DeletedAt `json:"-" gorm:"deleted_at"`
+
+	Categories []Category `json:"-" gorm:"many2many:product_categories;constraint:OnDelete:CASCADE"`
+	// Options, Variants and Images are only populated by the queries returning them.
+	Options  []ProductOption  `json:"options,omitempty" gorm:"foreignKey:ProductID;constraint:OnDelete:CASCADE"`
+	Variants []ProductVariant `json:"variants,omitempty" gorm:"foreignKey:ProductID"`
+	Images   []ProductImage   `json:"images,omitempty" gorm:"foreignKey:ProductID;constraint:OnDelete:CASCADE"`
+	// Breadcrumbs holds the path from the root of the category tree to each category of the product.
+	// It is only populated by the queries returning it.
+	Breadcrumbs [][]CategoryRef `json:"breadcrumbs,omitempty" gorm:"-"`
 }
 
 // Order represents an order placed by a user.
@@ -51,19 +409,49 @@ type Order struct {
 	UserID    uint           `json:"user_id" gorm:"not null"`
 	Status    OrderStatus    `json:"status" gorm:"not null" sql:"type:int;default:1"`
 	Total     float64        `json:"total" gorm:"not null"`
+	Items     []OrderItem    `json:"items" gorm:"foreignKey:OrderID"`
 	CreatedAt time.Time      `json:"created_at" gorm:"autoCreateTime"`
 	UpdatedAt time.Time      `json:"updated_at" gorm:"autoUpdateTime"`
 	DeletedAt gorm.DeletedAt `json:"-" gorm:"deleted_at"`
+
+	// Addresses are copied from the address book when the order is placed,
+	// so that later edits to the address book do not change where the order ships.
+	ShippingAddress PostalAddress `json:"shipping_address" gorm:"embedded;embeddedPrefix:shipping_"`
+	BillingAddress  PostalAddress `json:"billing_address" gorm:"embedded;embeddedPrefix:billing_"`
 }
 
 // OrderItem represents the items within an order, linking products to orders.
 type OrderItem struct {
-	ID        uint           `json:"id" gorm:"primaryKey;autoIncrement"`
-	OrderID   uint           `json:"order_id" gorm:"not null"`
-	ProductID uint           `json:"product_id" gorm:"not null"`
-	Quantity  int            `json:"quantity" gorm:"not null"`
-	Price     float64        `json:"price" gorm:"not null"` // Price at the time of the order
-	CreatedAt time.Time      `json:"created_at" gorm:"autoCreateTime"`
-	UpdatedAt time.Time      `json:"updated_at" gorm:"autoUpdateTime"`
-	DeletedAt gorm.DeletedAt `json:"-" gorm:"deleted_at"`
+	ID        uint            `json:"id" gorm:"primaryKey;autoIncrement"`
+	OrderID   uint            `json:"order_id" gorm:"not null"`
+	ProductID uint            `json:"product_id" gorm:"not null"`
+	VariantID *uint           `json:"variant_id"`
+	Variant   *ProductVariant `json:"-" gorm:"constraint:OnDelete:RESTRICT"`
+	// SKU and VariantLabel describe the variant at the time of the order.
+	SKU          string         `json:"sku,omitempty" sql:"type:varchar(64)"`
+	VariantLabel string         `json:"variant,omitempty" sql:"type:varchar(255)"`
+	Quantity     int            `json:"quantity" gorm:"not null"`
+	Price        float64        `json:"price" gorm:"not null"` // Price at the time of the order
+	CreatedAt    time.Time      `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt    time.Time      `json:"updated_at" gorm:"autoUpdateTime"`
+	DeletedAt    gorm.DeletedAt `json:"-" gorm:"deleted_at"`
+}
+
+// OrderStatusChange records a single transition in an order's status timeline.
+type OrderStatusChange struct {
+	ID         uint        `json:"id" gorm:"primaryKey;autoIncrement"`
+	OrderID    uint        `json:"order_id" gorm:"not null;index"`
+	FromStatus OrderStatus `json:"from_status" gorm:"not null"`
+	ToStatus   OrderStatus `json:"to_status" gorm:"not null"`
+	ActorID    uint        `json:"actor_id" gorm:"not null"` // ID of the user who made the change
+	Note       string      `json:"note,omitempty" sql:"type:text"`
+	CreatedAt  time.Time   `json:"created_at" gorm:"autoCreateTime"`
+}
+
+// OrderItemInput is a single line of an order placement request.
+// Prices are never accepted from the client; they are snapshotted from the product at creation time.
+type OrderItemInput struct {
+	ProductID uint `json:"product_id"`
+	VariantID uint `json:"variant_id,omitempty"` // required for products with variants
+	Quantity  int  `json:"quantity"`
 }
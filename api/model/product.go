@@ -0,0 +1,170 @@
+package model
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ProductSortField is a field product listings can be sorted by.
+type ProductSortField string
+
+const (
+	ProductSortName      ProductSortField = "name"
+	ProductSortPrice     ProductSortField = "price"
+	ProductSortCreatedAt ProductSortField = "created_at"
+	ProductSortUpdatedAt ProductSortField = "updated_at"
+)
+
+// Valid reports whether listings can be sorted by f.
+func (f ProductSortField) Valid() bool {
+	switch f {
+	case ProductSortName, ProductSortPrice, ProductSortCreatedAt, ProductSortUpdatedAt:
+		return true
+	}
+	return false
+}
+
+// maxProductSortFields bounds the number of fields a listing can be sorted by.
+const maxProductSortFields = 4
+
+// ProductSort orders a product listing by one field.
+type ProductSort struct {
+	Field      ProductSortField
+	Descending bool
+}
+
+// String returns the sort in the form accepted by ParseProductSorts, e.g. "-price".
+func (s ProductSort) String() string {
+	if s.Descending {
+		return "-" + string(s.Field)
+	}
+	return string(s.Field)
+}
+
+// ParseProductSorts parses a comma separated list of sort fields, each prefixed with "-" to sort in descending order,
+// e.g. "-price,name".
+func ParseProductSorts(s string) ([]ProductSort, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var sorts []ProductSort
+	seen := make(map[ProductSortField]bool)
+	for _, part := range strings.Split(s, ",") {
+		sort := ProductSort{Field: ProductSortField(strings.TrimPrefix(part, "-")), Descending: strings.HasPrefix(part, "-")}
+		if !sort.Field.Valid() {
+			return nil, fmt.Errorf("unknown sort field %q: %w", sort.Field, ErrInvalidUserInput)
+		}
+		if seen[sort.Field] {
+			return nil, fmt.Errorf("duplicate sort field %q: %w", sort.Field, ErrInvalidUserInput)
+		}
+		seen[sort.Field] = true
+		sorts = append(sorts, sort)
+	}
+	if len(sorts) > maxProductSortFields {
+		return nil, fmt.Errorf("at most %d sort fields are allowed: %w", maxProductSortFields, ErrInvalidUserInput)
+	}
+	return sorts, nil
+}
+
+// ProductFilter selects products in listings. Zero fields do not filter.
+type ProductFilter struct {
+	NamePrefix    string // case-insensitive
+	Category      string // slug of a category; products in its descendants match too
+	MinPrice      *float64
+	MaxPrice      *float64
+	InStock       *bool
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	UpdatedAfter  *time.Time
+	UpdatedBefore *time.Time
+}
+
+// Validate checks that the ranges of the filter are not empty.
+func (f ProductFilter) Validate() error {
+	if f.MinPrice != nil && f.MaxPrice != nil && *f.MinPrice > *f.MaxPrice {
+		return fmt.Errorf("min_price is greater than max_price: %w", ErrInvalidUserInput)
+	}
+	if f.CreatedAfter != nil && f.CreatedBefore != nil && !f.CreatedAfter.Before(*f.CreatedBefore) {
+		return fmt.Errorf("created_after is not before created_before: %w", ErrInvalidUserInput)
+	}
+	if f.UpdatedAfter != nil && f.UpdatedBefore != nil && !f.UpdatedAfter.Before(*f.UpdatedBefore) {
+		return fmt.Errorf("updated_after is not before updated_before: %w", ErrInvalidUserInput)
+	}
+	return nil
+}
+
+// ProductCursor is the position of a product in a listing: the values of the fields the listing is sorted by.
+// Listings are always sorted by ID last, so that positions are unique.
+type ProductCursor struct {
+	ID        uint      `json:"id"`
+	Name      string    `json:"name"`
+	Price     float64   `json:"price"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// CursorOf returns the position of product in a listing.
+func CursorOf(product Product) ProductCursor {
+	return ProductCursor{
+		ID:        product.ID,
+		Name:      product.Name,
+		Price:     product.Price,
+		CreatedAt: product.CreatedAt,
+		UpdatedAt: product.UpdatedAt,
+	}
+}
+
+// ProductQuery selects a page of a product listing.
+type ProductQuery struct {
+	ProductFilter
+	Sort  []ProductSort
+	After *ProductCursor // the page starts after this position; nil for the first page
+	Limit int
+}
+
+// Validate checks the filter and sort of the query.
+func (q ProductQuery) Validate() error {
+	for _, sort := range q.Sort {
+		if !sort.Field.Valid() {
+			return fmt.Errorf("unknown sort field %q: %w", sort.Field, ErrInvalidUserInput)
+		}
+	}
+	return q.ProductFilter.Validate()
+}
+
+// ProductPage is a page of a product listing.
+type ProductPage struct {
+	Products []Product
+	Next     *ProductCursor // position of the last product, nil on the last page
+}
+
+// ProductSearch is a full-text search of the product catalog, narrowed by the filter.
+type ProductSearch struct {
+	ProductFilter
+	Query   string
+	Page    int // 1-based
+	PerPage int
+}
+
+// Validate checks the filter and that there is something to search for.
+func (s ProductSearch) Validate() error {
+	if strings.TrimSpace(s.Query) == "" {
+		return fmt.Errorf("empty search: %w", ErrInvalidUserInput)
+	}
+	return s.ProductFilter.Validate()
+}
+
+// ProductSearchResult is a product matching a search, with the name and description
+// highlighted where they match the search terms.
+type ProductSearchResult struct {
+	Product
+	Rank       float64          `json:"rank"`
+	Highlights ProductHighlight `json:"highlights" gorm:"embedded;embeddedPrefix:highlight_"`
+}
+
+// ProductHighlight holds HTML snippets of a product's text, with matching terms enclosed in <mark> elements.
+type ProductHighlight struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
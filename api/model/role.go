@@ -0,0 +1,120 @@
+package model
+
+import "encoding/json"
+
+// Permission names a single action a user may be allowed to perform.
+type Permission string
+
+const (
+	PermissionProductWrite      Permission = "product:write"
+	PermissionOrderReadAny      Permission = "order:read:any"
+	PermissionOrderCancelAny    Permission = "order:cancel:any"
+	PermissionOrderStatusUpdate Permission = "order:status:update"
+	PermissionRoleAssign        Permission = "role:assign"
+	PermissionUserManage        Permission = "user:manage"
+	PermissionAPIKeyManage      Permission = "api_key:manage"
+	PermissionUserImpersonate   Permission = "user:impersonate"
+)
+
+// Names of the built-in roles.
+const (
+	RoleAdmin          = "admin"
+	RoleCatalogManager = "catalog-manager"
+	RoleFulfillment    = "fulfillment"
+	RoleSupport        = "support"
+	RoleFinance        = "finance"
+)
+
+// AllPermissions lists every permission known to the system.
+var AllPermissions = []Permission{
+	PermissionProductWrite,
+	PermissionOrderReadAny,
+	PermissionOrderCancelAny,
+	PermissionOrderStatusUpdate,
+	PermissionRoleAssign,
+	PermissionUserManage,
+	PermissionAPIKeyManage,
+	PermissionUserImpersonate,
+}
+
+// BuiltinRoles maps the name of every built-in role to its permission set.
+// Built-in roles are synchronised to the database on startup.
+var BuiltinRoles = map[string][]Permission{
+	RoleAdmin:          AllPermissions,
+	RoleCatalogManager: {PermissionProductWrite},
+	RoleFulfillment:    {PermissionOrderReadAny, PermissionOrderStatusUpdate},
+	RoleSupport:        {PermissionOrderReadAny, PermissionOrderCancelAny, PermissionUserManage, PermissionUserImpersonate},
+	RoleFinance:        {PermissionOrderReadAny},
+}
+
+// Role is a named set of permissions that can be granted to users.
+type Role struct {
+	ID          uint             `json:"id" gorm:"primaryKey;autoIncrement"`
+	Name        string           `json:"name" gorm:"unique;not null" sql:"type:varchar(50)"`
+	Permissions []RolePermission `json:"permissions" gorm:"foreignKey:RoleID;constraint:OnDelete:CASCADE"`
+}
+
+// RolePermission grants a single permission to a role.
+type RolePermission struct {
+	RoleID     uint       `json:"-" gorm:"primaryKey"`
+	Permission Permission `json:"permission" gorm:"primaryKey" sql:"type:varchar(50)"`
+}
+
+// MarshalJSON encodes a role permission as the bare permission name.
+func (rp RolePermission) MarshalJSON() ([]byte, error) {
+	return json.Marshal(rp.Permission)
+}
+
+// RoleNames returns the names of the roles granted to u.
+func (u User) RoleNames() []string {
+	names := make([]string, 0, len(u.Roles))
+	for _, role := range u.Roles {
+		names = append(names, role.Name)
+	}
+	return names
+}
+
+// Permissions returns the union of the permissions granted to u by its roles.
+func (u User) Permissions() []Permission {
+	seen := make(map[Permission]bool)
+	perms := make([]Permission, 0)
+	for _, role := range u.Roles {
+		for _, rp := range role.Permissions {
+			if !seen[rp.Permission] {
+				seen[rp.Permission] = true
+				perms = append(perms, rp.Permission)
+			}
+		}
+	}
+	return perms
+}
+
+// IsPrivileged reports whether any of u's roles grants a permission, i.e. whether u is a staff member.
+func (u User) IsPrivileged() bool {
+	return len(u.Permissions()) > 0
+}
+
+// Can reports whether the actor has been granted permission.
+func (a Actor) Can(permission Permission) bool {
+	for _, p := range a.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// CanManage reports whether the actor may disable or reset the password of u. Staff accounts can only be managed
+// by actors who can assign roles or who hold every permission u holds, so that no one can take over an account
+// more privileged than their own.
+func (a Actor) CanManage(u User) bool {
+	if a.Can(PermissionRoleAssign) {
+		return true
+	}
+	for _, p := range u.Permissions() {
+		if !a.Can(p) {
+			return false
+		}
+	}
+	return true
+}
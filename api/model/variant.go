@@ -0,0 +1,131 @@
+package model
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+)
+
+// Limits on the variant matrix of a product.
+const (
+	MaxProductOptions  = 3
+	MaxProductVariants = 100
+)
+
+// ProductOption is a type of option a product is offered in, such as size or colour.
+type ProductOption struct {
+	ID        uint                 `json:"id" gorm:"primaryKey;autoIncrement"`
+	ProductID uint                 `json:"product_id" gorm:"not null;index"`
+	Name      string               `json:"name" gorm:"not null" sql:"type:varchar(50)"`
+	Position  int                  `json:"position" gorm:"not null;default:0"`
+	Values    []ProductOptionValue `json:"values" gorm:"foreignKey:OptionID;constraint:OnDelete:CASCADE"`
+}
+
+// ProductOptionValue is a value of a product option, such as M for size.
+type ProductOptionValue struct {
+	ID       uint   `json:"id" gorm:"primaryKey;autoIncrement"`
+	OptionID uint   `json:"option_id" gorm:"not null;index"`
+	Value    string `json:"value" gorm:"not null" sql:"type:varchar(50)"`
+	Position int    `json:"position" gorm:"not null;default:0"`
+}
+
+// ProductVariant is a purchasable combination of the option values of a product, with its own SKU and stock.
+// The stock of a product with variants is the sum of the stock of its variants.
+type ProductVariant struct {
+	ID        uint                 `json:"id" gorm:"primaryKey;autoIncrement"`
+	ProductID uint                 `json:"product_id" gorm:"not null;index"`
+	SKU       string               `json:"sku" gorm:"not null;uniqueIndex:idx_product_variants_sku,where:deleted_at IS NULL" sql:"type:varchar(64)"` // unique among variants not deleted
+	Price     *float64             `json:"price"`                                                                                                    // overrides the product price if set
+	Quantity  int                  `json:"quantity" gorm:"not null"`
+	Options   []ProductOptionValue `json:"options" gorm:"many2many:product_variant_option_values;constraint:OnDelete:CASCADE"`
+	CreatedAt time.Time            `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt time.Time            `json:"updated_at" gorm:"autoUpdateTime"`
+	DeletedAt gorm.DeletedAt       `json:"-" gorm:"deleted_at"`
+}
+
+// PriceOf returns the price of the variant of product.
+func (v ProductVariant) PriceOf(product Product) float64 {
+	if v.Price != nil {
+		return *v.Price
+	}
+	return product.Price
+}
+
+// Label describes the variant by its option values, e.g. "M / Red". Options must be loaded in option order.
+func (v ProductVariant) Label() string {
+	values := make([]string, len(v.Options))
+	for i, o := range v.Options {
+		values[i] = o.Value
+	}
+	return strings.Join(values, " / ")
+}
+
+// VariantMatrix describes the options of a product, from which one variant is generated per combination of values.
+type VariantMatrix struct {
+	// SKUPrefix starts the SKU of generated variants, followed by their option values, e.g. TSHIRT-M-RED.
+	SKUPrefix string                `json:"sku_prefix"`
+	Options   []VariantMatrixOption `json:"options"`
+}
+
+// VariantMatrixOption is an option of a VariantMatrix with its values, in display order.
+type VariantMatrixOption struct {
+	Name   string   `json:"name"`
+	Values []string `json:"values"`
+}
+
+// Normalize trims the SKU prefix, option names and values.
+func (m *VariantMatrix) Normalize() {
+	m.SKUPrefix = strings.ToUpper(strings.TrimSpace(m.SKUPrefix))
+	for i := range m.Options {
+		o := &m.Options[i]
+		o.Name = strings.TrimSpace(o.Name)
+		for j := range o.Values {
+			o.Values[j] = strings.TrimSpace(o.Values[j])
+		}
+	}
+}
+
+// Validate checks that option names and values are set and unique, and bounds the size of the matrix.
+// Errors wrap ErrInvalidUserInput.
+func (m VariantMatrix) Validate() error {
+	if len(m.Options) > MaxProductOptions {
+		return fmt.Errorf("at most %d options are allowed: %w", MaxProductOptions, ErrInvalidUserInput)
+	}
+	if utf8.RuneCountInString(m.SKUPrefix) > 32 {
+		return fmt.Errorf("sku_prefix is too long: %w", ErrInvalidUserInput)
+	}
+
+	combinations := 1
+	names := make(map[string]bool)
+	for _, o := range m.Options {
+		if o.Name == "" || utf8.RuneCountInString(o.Name) > 50 {
+			return fmt.Errorf("option names must have between 1 and 50 characters: %w", ErrInvalidUserInput)
+		}
+		if names[strings.ToLower(o.Name)] {
+			return fmt.Errorf("duplicate option %q: %w", o.Name, ErrInvalidUserInput)
+		}
+		names[strings.ToLower(o.Name)] = true
+
+		if len(o.Values) == 0 {
+			return fmt.Errorf("option %q has no values: %w", o.Name, ErrInvalidUserInput)
+		}
+		values := make(map[string]bool)
+		for _, v := range o.Values {
+			if v == "" || utf8.RuneCountInString(v) > 50 {
+				return fmt.Errorf("values of option %q must have between 1 and 50 characters: %w", o.Name, ErrInvalidUserInput)
+			}
+			if values[strings.ToLower(v)] {
+				return fmt.Errorf("duplicate value %q of option %q: %w", v, o.Name, ErrInvalidUserInput)
+			}
+			values[strings.ToLower(v)] = true
+		}
+		combinations *= len(o.Values)
+	}
+	if combinations > MaxProductVariants {
+		return fmt.Errorf("the options make %d variants, at most %d are allowed: %w", combinations, MaxProductVariants, ErrInvalidUserInput)
+	}
+	return nil
+}
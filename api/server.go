@@ -6,8 +6,8 @@ import (
 	"net/http"
 )
 
-func NewServer(repo v1.Repository) http.Handler {
+func NewServer(repo v1.Repository, cfg v1.Config) http.Handler {
 	mux := chi.NewRouter()
-	v1.AddRoutes(mux, repo)
+	v1.AddRoutes(mux, repo, cfg)
 	return mux
 }
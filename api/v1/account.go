@@ -0,0 +1,249 @@
+package v1
+
+import (
+	"encoding/json"
+	"errors"
+	"instashop/api/model"
+	"log"
+	"net/http"
+	netmail "net/mail"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const maxNameLength = 100
+
+var phonePattern = regexp.MustCompile(`^\+?[0-9][0-9 ()-]{3,18}$`)
+
+func getProfile(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value("user_id").(uint)
+
+		user, err := repo.FetchUserByID(userID)
+		if err != nil {
+			if errors.Is(err, model.ErrNotFound) {
+				http.Error(w, "User not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("Error fetching user: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, user)
+	}
+}
+
+// updateProfile changes the name and phone number of the authenticated user. Omitted fields are left unchanged.
+func updateProfile(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value("user_id").(uint)
+
+		var req struct {
+			Name  *string `json:"name"`
+			Phone *string `json:"phone"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if req.Name != nil {
+			*req.Name = strings.TrimSpace(*req.Name)
+			if utf8.RuneCountInString(*req.Name) > maxNameLength {
+				http.Error(w, "Name is too long", http.StatusBadRequest)
+				return
+			}
+		}
+		if req.Phone != nil {
+			*req.Phone = strings.TrimSpace(*req.Phone)
+			if *req.Phone != "" && !phonePattern.MatchString(*req.Phone) {
+				http.Error(w, "Invalid phone number", http.StatusBadRequest)
+				return
+			}
+		}
+
+		user, err := repo.UpdateProfile(userID, req.Name, req.Phone)
+		if err != nil {
+			if errors.Is(err, model.ErrNotFound) {
+				http.Error(w, "User not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("Error updating profile: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, user)
+	}
+}
+
+// changeEmail starts a change of the authenticated user's email, confirmed by their current password.
+// A confirmation link is sent to the new address; the current email stays in use until it is opened.
+func changeEmail(repo Repository, mailer accountMailer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value("user_id").(uint)
+
+		var req struct {
+			Email    string `json:"email"`
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if addr, err := netmail.ParseAddress(req.Email); err != nil || addr.Address != req.Email {
+			http.Error(w, "Invalid email address", http.StatusBadRequest)
+			return
+		}
+
+		user, err := repo.FetchUserByID(userID)
+		if err != nil {
+			log.Printf("Error fetching user: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		token, hash, err := generateOpaqueToken()
+		if err != nil {
+			log.Printf("Error generating email change token: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = repo.RequestEmailChange(userID, req.Password, req.Email, hash, time.Now().Add(changeEmailTokenTTL))
+		if err != nil {
+			if !writeAccountChangeError(w, err) {
+				log.Printf("Error requesting email change: %v", err)
+				http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if err := mailer.sendEmailChange(req.Email, token); err != nil {
+			log.Printf("Error sending email change confirmation to user %d: %v", userID, err)
+			http.Error(w, "Failed to send confirmation email", http.StatusInternalServerError)
+			return
+		}
+		if err := mailer.sendEmailChangeNotice(user.Email, req.Email); err != nil {
+			log.Printf("Error sending email change notice to user %d: %v", userID, err)
+		}
+
+		sendJSONResponse(w, http.StatusAccepted, nil)
+	}
+}
+
+// confirmEmailChange completes an email change with the token sent to the new address.
+func confirmEmailChange(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Token string `json:"token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		if err := repo.ConfirmEmailChange(hashToken(req.Token)); err != nil {
+			if errors.Is(err, model.ErrEmailInUse) {
+				http.Error(w, "Email already in use", http.StatusConflict)
+				return
+			}
+			if errors.Is(err, model.ErrInvalidUserInput) {
+				http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+				return
+			}
+			log.Printf("Error confirming email change: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, nil)
+	}
+}
+
+// changePassword replaces the authenticated user's password, confirmed by the current one.
+// Every other session of the user is logged out.
+func changePassword(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value("user_id").(uint)
+		sessionID, _ := r.Context().Value("session_id").(string)
+
+		var req struct {
+			CurrentPassword string `json:"current_password"`
+			NewPassword     string `json:"new_password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.NewPassword == "" {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		if err := repo.ChangePassword(userID, req.CurrentPassword, req.NewPassword, sessionID); err != nil {
+			if !writeAccountChangeError(w, err) {
+				log.Printf("Error changing password: %v", err)
+				http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, nil)
+	}
+}
+
+// deleteAccount deletes the authenticated user's account, confirmed by their password.
+// Staff accounts must have their roles removed by an administrator first.
+func deleteAccount(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value("user_id").(uint)
+
+		var req struct {
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		user, err := repo.FetchUserByID(userID)
+		if err != nil {
+			log.Printf("Error fetching user: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+		if user.IsPrivileged() {
+			http.Error(w, "Staff accounts cannot be deleted by their owner", http.StatusForbidden)
+			return
+		}
+
+		if err := repo.DeleteAccount(userID, req.Password); err != nil {
+			switch {
+			case writeAccountChangeError(w, err):
+			case errors.Is(err, model.ErrInvalidUserInput):
+				// the last administrator
+				http.Error(w, err.Error(), http.StatusConflict)
+			default:
+				log.Printf("Error deleting account: %v", err)
+				http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, nil)
+	}
+}
+
+// writeAccountChangeError responds to the user input errors of account changes and reports whether err was one.
+func writeAccountChangeError(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, model.ErrInvalidPassword):
+		http.Error(w, "Current password is incorrect", http.StatusForbidden)
+	case errors.Is(err, model.ErrEmailInUse):
+		http.Error(w, "Email already in use", http.StatusConflict)
+	case errors.Is(err, model.ErrNotFound):
+		http.Error(w, "User not found", http.StatusNotFound)
+	default:
+		return false
+	}
+	return true
+}
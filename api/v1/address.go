@@ -0,0 +1,153 @@
+package v1
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"instashop/api/model"
+	"log"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+)
+
+// addressRequest is the body of address book create and update requests.
+type addressRequest struct {
+	Label string `json:"label"`
+	model.PostalAddress
+	IsDefault bool `json:"is_default"`
+}
+
+// address validates req and returns the address it describes for userID.
+func (req addressRequest) address(userID uint) (model.Address, error) {
+	req.PostalAddress.Normalize()
+	if err := req.PostalAddress.Validate(); err != nil {
+		return model.Address{}, err
+	}
+	if utf8.RuneCountInString(req.Label) > 50 {
+		return model.Address{}, errors.New("label is too long")
+	}
+	return model.Address{UserID: userID, Label: req.Label, PostalAddress: req.PostalAddress, IsDefault: req.IsDefault}, nil
+}
+
+func getAddresses(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value("user_id").(uint)
+
+		addresses, err := repo.ListAddresses(userID)
+		if err != nil {
+			log.Printf("Error fetching addresses: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, addresses)
+	}
+}
+
+func getAddressByID(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value("user_id").(uint)
+
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			http.Error(w, "Invalid address ID", http.StatusBadRequest)
+			return
+		}
+
+		address, err := repo.FetchAddress(uint(id), userID)
+		if err != nil {
+			writeAddressError(w, err)
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, address)
+	}
+}
+
+// createAddress adds an address to the authenticated user's address book.
+// The first address becomes the default address.
+func createAddress(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value("user_id").(uint)
+
+		var req addressRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		address, err := req.address(userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := repo.CreateAddress(&address); err != nil {
+			writeAddressError(w, err)
+			return
+		}
+
+		sendJSONResponse(w, http.StatusCreated, address)
+	}
+}
+
+// updateAddress replaces an address of the authenticated user's address book.
+// Orders already placed keep the address they were placed with.
+func updateAddress(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value("user_id").(uint)
+
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			http.Error(w, "Invalid address ID", http.StatusBadRequest)
+			return
+		}
+
+		var req addressRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		address, err := req.address(userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		address.ID = uint(id)
+
+		if err := repo.UpdateAddress(&address); err != nil {
+			writeAddressError(w, err)
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, address)
+	}
+}
+
+func deleteAddress(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value("user_id").(uint)
+
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			http.Error(w, "Invalid address ID", http.StatusBadRequest)
+			return
+		}
+
+		if err := repo.DeleteAddress(uint(id), userID); err != nil {
+			writeAddressError(w, err)
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, nil)
+	}
+}
+
+func writeAddressError(w http.ResponseWriter, err error) {
+	if errors.Is(err, model.ErrNotFound) {
+		http.Error(w, "Address not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("Error accessing address book: %v", err)
+	http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+}
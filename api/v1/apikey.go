@@ -0,0 +1,161 @@
+package v1
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"instashop/api/model"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiKeyPrefix starts every API key, making leaked keys easy to recognise.
+// Keys have the form isk_<8 hex chars>_<secret>, where isk_<8 hex chars> is the key's public prefix.
+const apiKeyPrefix = "isk_"
+
+// generateAPIKey creates a new API key, returning the full key, its public prefix and the hash under which it is stored.
+func generateAPIKey() (key, prefix, hash string, err error) {
+	id := make([]byte, 4)
+	secret := make([]byte, 32)
+	if _, err = rand.Read(id); err != nil {
+		return "", "", "", err
+	}
+	if _, err = rand.Read(secret); err != nil {
+		return "", "", "", err
+	}
+
+	prefix = apiKeyPrefix + hex.EncodeToString(id)
+	key = prefix + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	return key, prefix, hashToken(key), nil
+}
+
+// apiKeyFromRequest extracts an API key from the X-API-Key header or an "Authorization: ApiKey ..." header.
+func apiKeyFromRequest(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "ApiKey "); ok {
+		return key
+	}
+	return ""
+}
+
+// parseAPIKeyPrefix returns the public prefix of key.
+func parseAPIKeyPrefix(key string) (string, bool) {
+	parts := strings.SplitN(key, "_", 3)
+	if len(parts) != 3 || parts[0]+"_" != apiKeyPrefix || parts[1] == "" || parts[2] == "" {
+		return "", false
+	}
+	return parts[0] + "_" + parts[1], true
+}
+
+func getAPIKeys(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keys, err := repo.ListAPIKeys()
+		if err != nil {
+			log.Printf("Error fetching API keys: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, keys)
+	}
+}
+
+// createAPIKey issues an API key acting on behalf of the authenticated user.
+// Keys can only be granted scopes that the user holds. The key itself is only returned in this response.
+func createAPIKey(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor := actorFromContext(r)
+
+		var req struct {
+			Name      string             `json:"name"`
+			Scopes    []model.Permission `json:"scopes"`
+			ExpiresAt *time.Time         `json:"expires_at"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if err := validateAPIKeyRequest(actor, req.Name, req.Scopes, req.ExpiresAt); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		rawKey, prefix, hash, err := generateAPIKey()
+		if err != nil {
+			log.Printf("Error generating API key: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		key := model.APIKey{
+			Name:        req.Name,
+			Prefix:      prefix,
+			KeyHash:     hash,
+			CreatedByID: actor.UserID,
+			ExpiresAt:   req.ExpiresAt,
+		}
+		for _, p := range req.Scopes {
+			key.Scopes = append(key.Scopes, model.APIKeyScope{Permission: p})
+		}
+		if err := repo.CreateAPIKey(&key); err != nil {
+			log.Printf("Error creating API key: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sendCredentialResponse(w, http.StatusCreated, map[string]interface{}{
+			"api_key": key,
+			"key":     rawKey,
+		})
+	}
+}
+
+func validateAPIKeyRequest(actor model.Actor, name string, scopes []model.Permission, expiresAt *time.Time) error {
+	if strings.TrimSpace(name) == "" {
+		return errors.New("name is required")
+	}
+	if len(scopes) == 0 {
+		return errors.New("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if !actor.Can(scope) {
+			return fmt.Errorf("cannot grant scope %q", scope)
+		}
+	}
+	if expiresAt != nil && expiresAt.Before(time.Now()) {
+		return errors.New("expires_at must be in the future")
+	}
+	return nil
+}
+
+func revokeAPIKey(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		idStr := chi.URLParam(r, "id")
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			http.Error(w, "Invalid API key ID", http.StatusBadRequest)
+			return
+		}
+
+		if err := repo.RevokeAPIKey(uint(id)); err != nil {
+			if errors.Is(err, model.ErrNotFound) {
+				http.Error(w, "API key not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("Error revoking API key: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, nil)
+	}
+}
@@ -0,0 +1,62 @@
+package v1
+
+import (
+	"fmt"
+	"instashop/api/model"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// apiKeyRepository authenticates a single API key, created by the owner of the orders of orderRepository.
+type apiKeyRepository struct {
+	orderRepository
+	key    string
+	scopes []model.Permission
+}
+
+func (r *apiKeyRepository) AuthenticateAPIKey(prefix, keyHash string) (model.APIKey, error) {
+	if keyHash != hashToken(r.key) {
+		return model.APIKey{}, fmt.Errorf("invalid API key: %w", model.ErrInvalidUserInput)
+	}
+	key := model.APIKey{ID: 5, Prefix: prefix, CreatedByID: 1}
+	for _, p := range r.scopes {
+		key.Scopes = append(key.Scopes, model.APIKeyScope{APIKeyID: key.ID, Permission: p})
+	}
+	return key, nil
+}
+
+func TestAPIKeysAreOnlyAcceptedOnAdminRoutes(t *testing.T) {
+	key, _, _, err := generateAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := &apiKeyRepository{
+		orderRepository: orderRepository{owners: map[uint]uint{10: 1}},
+		key:             key,
+		scopes:          []model.Permission{model.PermissionOrderReadAny},
+	}
+	srv := newTestServer(repo, newTestKeySet())
+
+	for _, tc := range []struct {
+		method, target string
+		want           int
+	}{
+		{http.MethodGet, "/admin/orders/10/history", http.StatusOK},
+		{http.MethodPut, "/admin/orders", http.StatusForbidden}, // not in the key's scopes
+		{http.MethodGet, "/order/10", http.StatusUnauthorized},
+		{http.MethodPut, "/order/cancel?id=10", http.StatusUnauthorized},
+		{http.MethodPost, "/order/new", http.StatusUnauthorized},
+		{http.MethodGet, "/me", http.StatusUnauthorized},
+		{http.MethodGet, "/me/addresses", http.StatusUnauthorized},
+		{http.MethodPost, "/cart/checkout", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest(tc.method, tc.target, nil)
+		req.Header.Set("X-API-Key", key)
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s %s: status = %d, want %d: %s", tc.method, tc.target, rec.Code, tc.want, rec.Body)
+		}
+	}
+}
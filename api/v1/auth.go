@@ -2,84 +2,230 @@ package v1
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"github.com/golang-jwt/jwt/v4"
+	"instashop/api/model"
+	"log"
 	"net/http"
 	"strings"
 	"time"
 )
 
-var jwtSecret = []byte("not_so_secretive_secret_key")
+const (
+	accessTokenTTL        = 15 * time.Minute
+	refreshTokenTTL       = 30 * 24 * time.Hour
+	verifyEmailTokenTTL   = 48 * time.Hour
+	resetPasswordTokenTTL = time.Hour
+	changeEmailTokenTTL   = 24 * time.Hour
+)
 
-// generateToken creates a JWT token with user-specific claims.
-func generateToken(userID uint, isAdmin bool) (string, error) {
+// generateToken creates a short-lived JWT access token with user-specific claims,
+// bound to the login session identified by sessionID.
+// The token carries the user's roles and the permissions they grant,
+// so role changes take effect once the token is refreshed.
+func generateToken(keys *KeySet, user model.User, sessionID string) (string, error) {
 	claims := jwt.MapClaims{
-		"user_id":  userID,
-		"is_admin": isAdmin,
-		"exp":      time.Now().Add(time.Hour * 24).Unix(), // Token expires in 24 hours
+		"user_id":     user.ID,
+		"roles":       user.RoleNames(),
+		"permissions": user.Permissions(),
+		"sid":         sessionID,
+		"exp":         time.Now().Add(accessTokenTTL).Unix(),
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	return keys.Sign(claims)
 }
 
-// validateToken parses and validates a JWT token, returning the claims if valid.
-func validateToken(tokenString string) (jwt.MapClaims, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errors.New("unexpected signing method")
-		}
-		return jwtSecret, nil
-	})
-	if err != nil {
-		return nil, err
+// generateOpaqueToken creates an opaque random token, such as a refresh token, and the hash under which it is stored.
+func generateOpaqueToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		return "", "", err
 	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, hashToken(token), nil
+}
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		return claims, nil
-	}
-	return nil, errors.New("invalid token")
+// hashToken returns the hex encoded SHA-256 hash of an opaque token.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
 
-func authMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			http.Error(w, "Authorization header missing", http.StatusUnauthorized)
-			return
-		}
+// authMiddleware authenticates requests bearing an access token whose session has not been revoked,
+// or an impersonation token (see serveImpersonated). API keys are rejected; see apiKeyAuthMiddleware.
+func authMiddleware(repo Repository, keys *KeySet) func(http.Handler) http.Handler {
+	return authenticator(repo, keys, false)
+}
 
-		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-		claims, err := validateToken(tokenString)
-		if err != nil {
-			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
-			return
-		}
+// apiKeyAuthMiddleware authenticates requests like authMiddleware, and also accepts active API keys.
+//
+// API keys populate the request context like access tokens do: user_id is the user who created the key
+// and permissions are the key's scopes. The key is additionally identified by api_key_id.
+// Since a key acts on behalf of its creator, it must only be accepted on routes gated by RequirePermission,
+// where its scopes apply; elsewhere it would grant its creator's full customer access.
+func apiKeyAuthMiddleware(repo Repository, keys *KeySet) func(http.Handler) http.Handler {
+	return authenticator(repo, keys, true)
+}
 
-		userID, userOk := claims["user_id"].(float64)
-		isAdmin, adminOk := claims["is_admin"].(bool)
-		if !userOk || !adminOk {
-			http.Error(w, "Invalid token claims", http.StatusUnauthorized)
-			return
-		}
+func authenticator(repo Repository, keys *KeySet, acceptAPIKeys bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if rawKey := apiKeyFromRequest(r); rawKey != "" {
+				if !acceptAPIKeys {
+					http.Error(w, "API keys are only accepted on admin routes", http.StatusUnauthorized)
+					return
+				}
+				prefix, ok := parseAPIKeyPrefix(rawKey)
+				if !ok {
+					http.Error(w, "Invalid API key", http.StatusUnauthorized)
+					return
+				}
+				key, err := repo.AuthenticateAPIKey(prefix, hashToken(rawKey))
+				if err != nil {
+					if errors.Is(err, model.ErrInvalidUserInput) {
+						http.Error(w, "Invalid API key", http.StatusUnauthorized)
+						return
+					}
+					log.Printf("Error authenticating API key: %v", err)
+					http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				ctx := context.WithValue(r.Context(), "user_id", key.CreatedByID)
+				ctx = context.WithValue(ctx, "roles", []string{})
+				ctx = context.WithValue(ctx, "permissions", key.Permissions())
+				ctx = context.WithValue(ctx, "api_key_id", key.ID)
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+
+			authHeader := r.Header.Get("Authorization")
+			if authHeader == "" {
+				http.Error(w, "Authorization header missing", http.StatusUnauthorized)
+				return
+			}
+
+			tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+			claims, err := keys.Parse(tokenString)
+			if err != nil {
+				http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+				return
+			}
+			if _, ok := claims["purpose"]; ok {
+				// MFA challenge tokens are signed with the same keys but do not grant access
+				http.Error(w, "Invalid token", http.StatusUnauthorized)
+				return
+			}
+
+			userID, userOk := claims["user_id"].(float64)
+			roles, rolesOk := stringsClaim(claims["roles"])
+			permissions, permissionsOk := stringsClaim(claims["permissions"])
+			if !userOk || !rolesOk || !permissionsOk {
+				http.Error(w, "Invalid token claims", http.StatusUnauthorized)
+				return
+			}
+
+			userIDUint := uint(userID)
+
+			// Add claims to the request context
+			ctx := context.WithValue(r.Context(), "user_id", userIDUint)
+			ctx = context.WithValue(ctx, "roles", roles)
+			ctx = context.WithValue(ctx, "permissions", toPermissions(permissions))
+
+			if impersonationID, ok := claims["imp"].(string); ok {
+				serveImpersonated(w, r.WithContext(ctx), repo, next, impersonationID)
+				return
+			}
 
-		userIDUint := uint(userID)
+			sessionID, sessionOk := claims["sid"].(string)
+			if !sessionOk {
+				http.Error(w, "Invalid token claims", http.StatusUnauthorized)
+				return
+			}
 
-		// Add claims to the request context
-		ctx := context.WithValue(r.Context(), "user_id", userIDUint)
-		ctx = context.WithValue(ctx, "is_admin", isAdmin)
-		r = r.WithContext(ctx)
+			active, err := repo.IsSessionActive(sessionID)
+			if err != nil {
+				log.Printf("Error checking session: %v", err)
+				http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !active {
+				http.Error(w, "Session has been revoked or the account disabled", http.StatusUnauthorized)
+				return
+			}
 
-		next.ServeHTTP(w, r)
-	})
+			ctx = context.WithValue(ctx, "session_id", sessionID)
+			r = r.WithContext(ctx)
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// optionalAuthMiddleware authenticates requests like authMiddleware if they carry credentials,
+// and lets anonymous requests through unauthenticated.
+func optionalAuthMiddleware(repo Repository, keys *KeySet) func(http.Handler) http.Handler {
+	authenticate := authMiddleware(repo, keys)
+	return func(next http.Handler) http.Handler {
+		authenticated := authenticate(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") == "" && apiKeyFromRequest(r) == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			authenticated.ServeHTTP(w, r)
+		})
+	}
 }
 
-func adminOnlyMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		isAdmin, ok := r.Context().Value("is_admin").(bool)
-		if !ok || !isAdmin {
-			http.Error(w, "Forbidden", http.StatusForbidden)
-			return
+// stringsClaim converts a JSON array claim into a string slice.
+func stringsClaim(claim interface{}) ([]string, bool) {
+	values, ok := claim.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	strs := make([]string, 0, len(values))
+	for _, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			return nil, false
 		}
-		next.ServeHTTP(w, r)
-	})
+		strs = append(strs, s)
+	}
+	return strs, true
+}
+
+func toPermissions(names []string) []model.Permission {
+	perms := make([]model.Permission, 0, len(names))
+	for _, name := range names {
+		perms = append(perms, model.Permission(name))
+	}
+	return perms
+}
+
+// actorFromContext returns the authenticated user placed in the request context by authMiddleware.
+func actorFromContext(r *http.Request) model.Actor {
+	userID, _ := r.Context().Value("user_id").(uint)
+	permissions, _ := r.Context().Value("permissions").([]model.Permission)
+	return model.Actor{UserID: userID, Permissions: permissions}
+}
+
+// RequirePermission rejects requests whose authenticated user has not been granted every one of permissions.
+// It must be used after authMiddleware.
+func RequirePermission(permissions ...model.Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			actor := actorFromContext(r)
+			for _, p := range permissions {
+				if !actor.Can(p) {
+					http.Error(w, "Forbidden", http.StatusForbidden)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
 }
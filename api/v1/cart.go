@@ -0,0 +1,229 @@
+package v1
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"instashop/api/model"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// cartTokenHeader carries the token of an anonymous cart.
+const cartTokenHeader = "X-Cart-Token"
+
+// cartOwner identifies the cart of a request: the authenticated user's cart,
+// or else the anonymous cart whose token is sent in the X-Cart-Token header. It returns false if there is neither.
+func cartOwner(r *http.Request) (model.CartOwner, bool) {
+	if userID, ok := r.Context().Value("user_id").(uint); ok {
+		return model.CartOwner{UserID: userID}, true
+	}
+	if token := r.Header.Get(cartTokenHeader); token != "" {
+		return model.CartOwner{TokenHash: hashToken(token)}, true
+	}
+	return model.CartOwner{}, false
+}
+
+// mergeAnonymousCart moves the anonymous cart named by the X-Cart-Token header into the cart of the authenticated user,
+// so that a cart filled before logging in is kept. Clients should drop the cart token once logged in.
+// Only requests changing the cart merge it, so that reading the cart stays safe to repeat.
+func mergeAnonymousCart(repo Repository) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID, authenticated := r.Context().Value("user_id").(uint)
+			token := r.Header.Get(cartTokenHeader)
+			safe := r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions
+			if authenticated && token != "" && !safe {
+				// a cart that is already merged or expired is not an error
+				if err := repo.MergeCarts(hashToken(token), userID); err != nil && !errors.Is(err, model.ErrNotFound) {
+					log.Printf("Error merging cart into cart of user %d: %v", userID, err)
+					http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func getCart(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		owner, ok := cartOwner(r)
+		if !ok {
+			sendJSONResponse(w, http.StatusOK, model.Cart{}.Summary())
+			return
+		}
+		sendCart(w, repo, owner, "")
+	}
+}
+
+// addCartItem adds a product to the cart. Anonymous requests without a cart token get a new anonymous cart,
+// whose token is returned in the X-Cart-Token header and the cart_token field.
+func addCartItem(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req model.OrderItemInput
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		owner, ok := cartOwner(r)
+		newToken := ""
+		if !ok {
+			token, hash, err := generateOpaqueToken()
+			if err == nil {
+				err = repo.CreateAnonymousCart(hash)
+			}
+			if err != nil {
+				log.Printf("Error creating cart: %v", err)
+				http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+				return
+			}
+			owner, newToken = model.CartOwner{TokenHash: hash}, token
+			w.Header().Set(cartTokenHeader, token)
+		}
+
+		if err := repo.AddCartItem(owner, req.ProductID, req.VariantID, req.Quantity); err != nil {
+			writeCartError(w, err)
+			return
+		}
+
+		sendCart(w, repo, owner, newToken)
+	}
+}
+
+// updateCartItem sets the quantity of a product in the cart. A quantity of zero removes the product.
+// Variants of a product are named by the variant_id query parameter.
+func updateCartItem(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		owner, productID, variantID, ok := cartItemRequest(w, r)
+		if !ok {
+			return
+		}
+
+		var req struct {
+			Quantity int `json:"quantity"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		if err := repo.SetCartItemQuantity(owner, productID, variantID, req.Quantity); err != nil {
+			writeCartError(w, err)
+			return
+		}
+
+		sendCart(w, repo, owner, "")
+	}
+}
+
+func removeCartItem(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		owner, productID, variantID, ok := cartItemRequest(w, r)
+		if !ok {
+			return
+		}
+
+		if err := repo.SetCartItemQuantity(owner, productID, variantID, 0); err != nil {
+			writeCartError(w, err)
+			return
+		}
+
+		sendCart(w, repo, owner, "")
+	}
+}
+
+func clearCart(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		owner, ok := cartOwner(r)
+		if !ok {
+			http.Error(w, "Cart not found", http.StatusNotFound)
+			return
+		}
+
+		if err := repo.ClearCart(owner); err != nil {
+			writeCartError(w, err)
+			return
+		}
+
+		sendCart(w, repo, owner, "")
+	}
+}
+
+// checkoutCart places an order for the content of the authenticated user's cart and empties the cart.
+func checkoutCart(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := r.Context().Value("user_id").(uint)
+		if !ok {
+			http.Error(w, "Log in to check out", http.StatusUnauthorized)
+			return
+		}
+
+		var req model.AddressSelection
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		order, err := repo.CheckoutCart(userID, req)
+		if err != nil {
+			writeCartError(w, err)
+			return
+		}
+
+		sendJSONResponse(w, http.StatusCreated, order)
+	}
+}
+
+// cartItemRequest resolves the cart and the {product_id} path parameter of a cart item request.
+func cartItemRequest(w http.ResponseWriter, r *http.Request) (model.CartOwner, uint, uint, bool) {
+	productID, err := strconv.Atoi(chi.URLParam(r, "product_id"))
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return model.CartOwner{}, 0, 0, false
+	}
+	variantID, err := intQuery(r.URL.Query().Get("variant_id"))
+	if err != nil || variantID < 0 {
+		http.Error(w, "Invalid variant ID", http.StatusBadRequest)
+		return model.CartOwner{}, 0, 0, false
+	}
+	owner, ok := cartOwner(r)
+	if !ok {
+		http.Error(w, "Cart not found", http.StatusNotFound)
+		return model.CartOwner{}, 0, 0, false
+	}
+	return owner, uint(productID), uint(variantID), true
+}
+
+// sendCart responds with the priced content of the cart of owner.
+func sendCart(w http.ResponseWriter, repo Repository, owner model.CartOwner, newToken string) {
+	cart, err := repo.FetchCart(owner)
+	if err != nil {
+		writeCartError(w, err)
+		return
+	}
+
+	summary := cart.Summary()
+	summary.CartToken = newToken
+	sendJSONResponse(w, http.StatusOK, summary)
+}
+
+func writeCartError(w http.ResponseWriter, err error) {
+	var stockErr *model.OutOfStockError
+	switch {
+	case errors.As(err, &stockErr):
+		sendJSONResponse(w, http.StatusConflict, map[string]interface{}{
+			"error":    stockErr.Error(),
+			"products": stockErr.Shortages,
+		})
+	case errors.Is(err, model.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, model.ErrInvalidUserInput):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Printf("Error updating cart: %v", err)
+		http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,111 @@
+package v1
+
+import (
+	"encoding/json"
+	"instashop/api/model"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// cartRepository records the carts created, changed and merged, and returns empty carts.
+type cartRepository struct {
+	Repository
+	created []string
+	changed []model.CartOwner
+	merged  []string
+}
+
+func (r *cartRepository) IsSessionActive(string) (bool, error) { return true, nil }
+
+func (r *cartRepository) CreateAnonymousCart(tokenHash string) error {
+	r.created = append(r.created, tokenHash)
+	return nil
+}
+
+func (r *cartRepository) AddCartItem(owner model.CartOwner, _, _ uint, _ int) error {
+	r.changed = append(r.changed, owner)
+	return nil
+}
+
+func (r *cartRepository) FetchCart(owner model.CartOwner) (model.Cart, error) {
+	return model.Cart{}, nil
+}
+
+func (r *cartRepository) MergeCarts(tokenHash string, _ uint) error {
+	r.merged = append(r.merged, tokenHash)
+	return nil
+}
+
+// addToCart adds a product to the cart with the given cart token and access token, either of which may be empty.
+func addToCart(srv http.Handler, cartToken, accessToken string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/cart/items", strings.NewReader(`{"product_id": 1, "quantity": 1}`))
+	req.Header.Set("Content-Type", "application/json")
+	if cartToken != "" {
+		req.Header.Set(cartTokenHeader, cartToken)
+	}
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAnonymousCartTokensAreIssuedOnce(t *testing.T) {
+	repo := &cartRepository{}
+	srv := newTestServer(repo, newTestKeySet())
+
+	rec := addToCart(srv, "", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	token := rec.Header().Get(cartTokenHeader)
+	var summary model.CartSummary
+	if err := json.NewDecoder(rec.Body).Decode(&summary); err != nil {
+		t.Fatalf("decoding cart: %v", err)
+	}
+	if token == "" || summary.CartToken != token {
+		t.Fatalf("cart token header = %q, field = %q, want the same token", token, summary.CartToken)
+	}
+	if len(repo.created) != 1 || repo.created[0] != hashToken(token) {
+		t.Fatalf("created carts %v, want one identified by the hash of the token", repo.created)
+	}
+	if repo.changed[0].TokenHash != hashToken(token) {
+		t.Errorf("item added to %+v, want the new cart", repo.changed[0])
+	}
+
+	rec = addToCart(srv, token, "")
+	if rec.Header().Get(cartTokenHeader) != "" || strings.Contains(rec.Body.String(), "cart_token") {
+		t.Errorf("second request issued another token: %s", rec.Body)
+	}
+	if len(repo.created) != 1 || repo.changed[1].TokenHash != hashToken(token) {
+		t.Errorf("second request: created carts %v, changed %+v, want the existing cart changed", repo.created, repo.changed[1])
+	}
+}
+
+func TestAnonymousCartsAreOnlyMergedByCartChanges(t *testing.T) {
+	keys := newTestKeySet()
+	repo := &cartRepository{}
+	srv := newTestServer(repo, keys)
+	token := accessToken(t, keys, testUser(1))
+
+	req := httptest.NewRequest(http.MethodGet, "/cart", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set(cartTokenHeader, "anonymous")
+	srv.ServeHTTP(httptest.NewRecorder(), req)
+	if len(repo.merged) != 0 {
+		t.Fatalf("GET /cart merged %v, want no merge", repo.merged)
+	}
+
+	if rec := addToCart(srv, "anonymous", token); rec.Code != http.StatusOK {
+		t.Fatalf("adding to cart: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if len(repo.merged) != 1 || repo.merged[0] != hashToken("anonymous") {
+		t.Errorf("merged %v, want the anonymous cart", repo.merged)
+	}
+	if len(repo.created) != 0 || repo.changed[0].UserID != 1 {
+		t.Errorf("created carts %v, changed %+v, want the user's cart changed", repo.created, repo.changed)
+	}
+}
@@ -0,0 +1,225 @@
+package v1
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"instashop/api/model"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// categoryRequest is the body of category create and update requests.
+// ParentID is only used on creation; categories are moved with moveCategory.
+type categoryRequest struct {
+	Name     string `json:"name"`
+	Slug     string `json:"slug"` // derived from the name if empty
+	ParentID *uint  `json:"parent_id"`
+	Position int    `json:"position"`
+}
+
+// category validates req and returns the category it describes.
+func (req categoryRequest) category() (model.Category, error) {
+	category := model.Category{Name: req.Name, Slug: req.Slug, ParentID: req.ParentID, Position: req.Position}
+	category.Normalize()
+	if err := category.Validate(); err != nil {
+		return model.Category{}, err
+	}
+	return category, nil
+}
+
+// categoryIDParam parses the {id} path parameter, responding with 400 Bad Request if it is invalid.
+func categoryIDParam(w http.ResponseWriter, r *http.Request) (uint, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil || id <= 0 {
+		http.Error(w, "Invalid category ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// getCategories returns the whole category tree.
+func getCategories(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		categories, err := repo.ListCategoryTree()
+		if err != nil {
+			log.Printf("Error fetching categories: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, categories)
+	}
+}
+
+// getCategory returns the category named by the {slug} path parameter with its breadcrumbs and subcategories.
+func getCategory(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		category, err := repo.FetchCategoryBySlug(chi.URLParam(r, "slug"))
+		if err != nil {
+			writeCategoryError(w, err, "fetching category")
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, category)
+	}
+}
+
+// getCategoryProducts pages through the products of a category and all its descendants,
+// taking the same query parameters as product listings.
+func getCategoryProducts(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slug := chi.URLParam(r, "slug")
+		if _, err := repo.FetchCategoryBySlug(slug); err != nil {
+			writeCategoryError(w, err, "fetching category")
+			return
+		}
+
+		query, err := productQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		query.Category = slug
+
+		sendProductPage(w, r, repo, query)
+	}
+}
+
+func createCategory(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req categoryRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		category, err := req.category()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := repo.CreateCategory(&category); err != nil {
+			writeCategoryError(w, err, "creating category")
+			return
+		}
+
+		sendJSONResponse(w, http.StatusCreated, category)
+	}
+}
+
+// updateCategory renames or reorders a category among its siblings.
+func updateCategory(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := categoryIDParam(w, r)
+		if !ok {
+			return
+		}
+
+		var req categoryRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		category, err := req.category()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		category.ID = id
+
+		if err := repo.UpdateCategory(&category); err != nil {
+			writeCategoryError(w, err, "updating category")
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, category)
+	}
+}
+
+// moveCategory moves a category and its whole subtree under another parent, or to the root of the tree.
+func moveCategory(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := categoryIDParam(w, r)
+		if !ok {
+			return
+		}
+
+		var move model.CategoryMove
+		if err := json.NewDecoder(r.Body).Decode(&move); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		category, err := repo.MoveCategory(id, move)
+		if err != nil {
+			writeCategoryError(w, err, "moving category")
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, category)
+	}
+}
+
+// deleteCategory deletes a category without subcategories. Its products are unassigned from it.
+func deleteCategory(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := categoryIDParam(w, r)
+		if !ok {
+			return
+		}
+
+		if err := repo.DeleteCategory(id); err != nil {
+			writeCategoryError(w, err, "deleting category")
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, nil)
+	}
+}
+
+// setProductCategories replaces the categories a product is assigned to.
+func setProductCategories(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil || id <= 0 {
+			http.Error(w, "Invalid product ID", http.StatusBadRequest)
+			return
+		}
+
+		var req struct {
+			CategoryIDs []uint `json:"category_ids"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		product, err := repo.SetProductCategories(uint(id), req.CategoryIDs)
+		if err != nil {
+			if errors.Is(err, model.ErrNotFound) {
+				http.Error(w, "Product not found", http.StatusNotFound)
+				return
+			}
+			writeCategoryError(w, err, "setting product categories")
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, product)
+	}
+}
+
+// writeCategoryError responds to the errors of category operations.
+func writeCategoryError(w http.ResponseWriter, err error, action string) {
+	if errors.Is(err, model.ErrNotFound) {
+		http.Error(w, "Category not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, model.ErrInvalidUserInput) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	log.Printf("Error %s: %v", action, err)
+	http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+}
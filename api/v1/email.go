@@ -0,0 +1,74 @@
+package v1
+
+import (
+	"fmt"
+	"instashop/mail"
+	"net/url"
+	"time"
+)
+
+// accountMailer composes and sends the emails of the account lifecycle.
+// Links in emails point to the storefront at appURL, which forwards the token to this API.
+type accountMailer struct {
+	mailer Mailer
+	appURL string
+}
+
+func (m accountMailer) sendEmailVerification(to, token string) error {
+	link := m.link("/verify-email", token)
+	return m.mailer.Send(mail.Message{
+		To:      to,
+		Subject: "Verify your InstaShop email address",
+		Body: fmt.Sprintf("Welcome to InstaShop!\n\nConfirm your email address by opening the link below:\n\n%s\n\n"+
+			"The link expires in %s.\n", link, humanizeDuration(verifyEmailTokenTTL)),
+	})
+}
+
+func (m accountMailer) sendPasswordReset(to, token string) error {
+	link := m.link("/reset-password", token)
+	return m.mailer.Send(mail.Message{
+		To:      to,
+		Subject: "Reset your InstaShop password",
+		Body: fmt.Sprintf("A password reset was requested for your InstaShop account.\n\n"+
+			"Choose a new password by opening the link below:\n\n%s\n\n"+
+			"The link expires in %s. If you did not request a reset, you can ignore this email.\n",
+			link, humanizeDuration(resetPasswordTokenTTL)),
+	})
+}
+
+func (m accountMailer) sendEmailChange(to, token string) error {
+	link := m.link("/confirm-email", token)
+	return m.mailer.Send(mail.Message{
+		To:      to,
+		Subject: "Confirm your new InstaShop email address",
+		Body: fmt.Sprintf("A change of your InstaShop account email to this address was requested.\n\n"+
+			"Confirm it by opening the link below:\n\n%s\n\n"+
+			"The link expires in %s. Until then, your current email address stays in use.\n",
+			link, humanizeDuration(changeEmailTokenTTL)),
+	})
+}
+
+// sendEmailChangeNotice warns the current address of an account that a change of email was requested,
+// so that the owner notices if someone else did it.
+func (m accountMailer) sendEmailChangeNotice(to, newEmail string) error {
+	return m.mailer.Send(mail.Message{
+		To:      to,
+		Subject: "Your InstaShop email address is being changed",
+		Body: fmt.Sprintf("A change of your InstaShop account email to %s was requested.\n\n"+
+			"If you did not request it, change your password immediately.\n", newEmail),
+	})
+}
+
+func (m accountMailer) link(path, token string) string {
+	return m.appURL + path + "?token=" + url.QueryEscape(token)
+}
+
+func humanizeDuration(d time.Duration) string {
+	if d%time.Hour == 0 {
+		if d == time.Hour {
+			return "1 hour"
+		}
+		return fmt.Sprintf("%d hours", d/time.Hour)
+	}
+	return d.String()
+}
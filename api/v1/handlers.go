@@ -3,16 +3,23 @@ package v1
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/go-chi/chi/v5"
 	"instashop/api/model"
 	"log"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 var errInternalServerError = errors.New("Internal Server Error")
 
-func login(repo Repository) http.HandlerFunc {
+// login authenticates a user by email and password.
+//
+// Users with two-factor authentication enabled, and staff users when requireStaffMFA is set,
+// receive a short-lived MFA challenge token instead of an access token.
+// The challenge is completed at /auth/mfa/verify, or at /auth/mfa/challenge/* when enrollment is still required.
+func login(repo Repository, keys *KeySet, requireStaffMFA bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req struct {
 			Email    string `json:"email"`
@@ -23,9 +30,22 @@ func login(repo Repository) http.HandlerFunc {
 			return
 		}
 
+		if !allowLoginAttempt(w, r, repo, req.Email) {
+			return
+		}
+
 		user, err := repo.ValidateCredentials(req.Email, req.Password)
 		if err != nil {
+			if errors.Is(err, model.ErrEmailNotVerified) {
+				http.Error(w, "Email address not verified", http.StatusForbidden)
+				return
+			}
+			if errors.Is(err, model.ErrAccountDisabled) {
+				http.Error(w, "Account disabled", http.StatusForbidden)
+				return
+			}
 			if errors.Is(err, model.ErrInvalidUserInput) {
+				recordLoginFailure(r, repo, req.Email)
 				http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 				return
 			}
@@ -35,18 +55,163 @@ func login(repo Repository) http.HandlerFunc {
 			return
 		}
 
-		token, err := generateToken(user.ID, user.IsAdmin)
+		if sendMFAChallenge(w, keys, user, requireStaffMFA) {
+			// the password was right, but failures keep counting until the second factor is verified
+			return
+		}
+
+		recordLoginSuccess(repo, user.Email)
+		startSession(w, repo, keys, user)
+	}
+}
+
+// sendMFAChallenge responds with an MFA challenge token and returns true if user must pass a second factor to log in,
+// because they enabled two-factor authentication or because requireStaffMFA is set and they are staff.
+func sendMFAChallenge(w http.ResponseWriter, keys *KeySet, user model.User, requireStaffMFA bool) bool {
+	mfaEnabled := user.MFAEnabledAt != nil
+	if !mfaEnabled && !(requireStaffMFA && user.IsPrivileged()) {
+		return false
+	}
+
+	purpose := mfaPurposeVerify
+	if !mfaEnabled {
+		purpose = mfaPurposeEnroll
+	}
+	challenge, err := generateMFAChallenge(keys, user.ID, purpose)
+	if err != nil {
+		log.Printf("Error generating MFA challenge: %v", err)
+		http.Error(w, "Login failed. Please try again", http.StatusInternalServerError)
+		return true
+	}
+
+	sendJSONResponse(w, http.StatusOK, map[string]interface{}{
+		"mfa_required":            true,
+		"mfa_enrollment_required": !mfaEnabled,
+		"mfa_token":               challenge,
+	})
+	return true
+}
+
+// startSession creates a new login session for user and responds with its access and refresh tokens.
+func startSession(w http.ResponseWriter, repo Repository, keys *KeySet, user model.User) {
+	tokens, err := newSession(repo, keys, user)
+	if err != nil {
+		log.Printf("Error starting session: %v", err)
+		http.Error(w, "Login failed. Please try again", http.StatusInternalServerError)
+		return
+	}
+
+	sendJSONResponse(w, http.StatusOK, tokens)
+}
+
+// newSession creates a new login session for user and returns the body of a token response for it.
+func newSession(repo Repository, keys *KeySet, user model.User) (map[string]interface{}, error) {
+	refreshToken, refreshHash, err := generateOpaqueToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate refresh token: %w", err)
+	}
+
+	sessionID, err := repo.CreateSession(user.ID, refreshHash, time.Now().Add(refreshTokenTTL))
+	if err != nil {
+		return nil, err
+	}
+
+	return tokenResponse(keys, user, sessionID, refreshToken)
+}
+
+func refresh(repo Repository, keys *KeySet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		refreshToken, refreshHash, err := generateOpaqueToken()
 		if err != nil {
-			log.Printf("Error generating token: %v", err)
-			http.Error(w, "Login failed. Please try again", http.StatusInternalServerError)
+			log.Printf("Error generating refresh token: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, sessionID, err := repo.RotateRefreshToken(hashToken(req.RefreshToken), refreshHash, time.Now().Add(refreshTokenTTL))
+		if err != nil {
+			if errors.Is(err, model.ErrInvalidUserInput) {
+				http.Error(w, "Invalid or expired refresh token", http.StatusUnauthorized)
+				return
+			}
+			log.Printf("Error rotating refresh token: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		sendJSONResponse(w, http.StatusOK, map[string]string{"token": token})
+		sendTokens(w, keys, user, sessionID, refreshToken)
 	}
 }
 
-func register(repo Repository) http.HandlerFunc {
+// logout revokes the session of the access token used to authenticate the request.
+func logout(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value("user_id").(uint)
+		sessionID, ok := r.Context().Value("session_id").(string)
+		if !ok {
+			http.Error(w, "Request is not authenticated with a session", http.StatusBadRequest)
+			return
+		}
+
+		if err := repo.RevokeSession(sessionID, userID); err != nil {
+			log.Printf("Error revoking session: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, nil)
+	}
+}
+
+// logoutAll revokes every session of the authenticated user.
+func logoutAll(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value("user_id").(uint)
+
+		if err := repo.RevokeAllSessions(userID); err != nil {
+			log.Printf("Error revoking sessions of user %d: %v", userID, err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, nil)
+	}
+}
+
+// sendTokens issues a new access token for user within sessionID and responds with it alongside refreshToken.
+func sendTokens(w http.ResponseWriter, keys *KeySet, user model.User, sessionID, refreshToken string) {
+	tokens, err := tokenResponse(keys, user, sessionID, refreshToken)
+	if err != nil {
+		log.Printf("Error generating token: %v", err)
+		http.Error(w, "Login failed. Please try again", http.StatusInternalServerError)
+		return
+	}
+
+	sendJSONResponse(w, http.StatusOK, tokens)
+}
+
+func tokenResponse(keys *KeySet, user model.User, sessionID, refreshToken string) (map[string]interface{}, error) {
+	token, err := generateToken(keys, user, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"token":         token,
+		"refresh_token": refreshToken,
+		"expires_in":    int(accessTokenTTL.Seconds()),
+	}, nil
+}
+
+func register(repo Repository, mailer accountMailer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req struct {
 			Email    string `json:"email"`
@@ -68,23 +233,152 @@ func register(repo Repository) http.HandlerFunc {
 			return
 		}
 
+		if err := issueEmailVerification(repo, mailer, userID, req.Email); err != nil {
+			// the account exists, so the user can request another verification email with resendVerification
+			log.Printf("Error sending verification email to user %d: %v", userID, err)
+		}
+
 		sendJSONResponse(w, http.StatusCreated, map[string]uint{"user_id": userID})
 	}
 }
 
+// issueEmailVerification creates an email verification token for userID and sends it to email.
+func issueEmailVerification(repo Repository, mailer accountMailer, userID uint, email string) error {
+	token, hash, err := generateOpaqueToken()
+	if err != nil {
+		return err
+	}
+	if err := repo.CreateUserToken(userID, model.TokenPurposeVerifyEmail, hash, time.Now().Add(verifyEmailTokenTTL)); err != nil {
+		return err
+	}
+	return mailer.sendEmailVerification(email, token)
+}
+
+func verifyEmail(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Token string `json:"token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		if err := repo.VerifyEmail(hashToken(req.Token)); err != nil {
+			if errors.Is(err, model.ErrInvalidUserInput) {
+				http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+				return
+			}
+			log.Printf("Error verifying email: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, nil)
+	}
+}
+
+// resendVerification emails a new verification link to the given address if it belongs to an unverified account.
+// Like forgotPassword, it responds identically whether or not such an account exists.
+func resendVerification(repo Repository, mailer accountMailer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Email string `json:"email"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		user, err := repo.FetchUserByEmail(req.Email)
+		switch {
+		case errors.Is(err, model.ErrNotFound):
+		case err != nil:
+			log.Printf("Error fetching user to resend verification: %v", err)
+		case user.EmailVerifiedAt == nil && user.DisabledAt == nil:
+			if err := issueEmailVerification(repo, mailer, user.ID, user.Email); err != nil {
+				log.Printf("Error resending verification email to user %d: %v", user.ID, err)
+			}
+		}
+
+		sendJSONResponse(w, http.StatusAccepted, nil)
+	}
+}
+
+// forgotPassword emails a password reset link to the given address.
+// It responds identically whether or not an account exists, so it cannot be used to discover registered emails.
+func forgotPassword(repo Repository, mailer accountMailer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Email string `json:"email"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		if err := issuePasswordReset(repo, mailer, req.Email); err != nil && !errors.Is(err, model.ErrNotFound) {
+			log.Printf("Error issuing password reset: %v", err)
+		}
+
+		sendJSONResponse(w, http.StatusAccepted, nil)
+	}
+}
+
+func issuePasswordReset(repo Repository, mailer accountMailer, email string) error {
+	user, err := repo.FetchUserByEmail(email)
+	if err != nil {
+		return err
+	}
+	token, hash, err := generateOpaqueToken()
+	if err != nil {
+		return err
+	}
+	if err := repo.CreateUserToken(user.ID, model.TokenPurposeResetPassword, hash, time.Now().Add(resetPasswordTokenTTL)); err != nil {
+		return err
+	}
+	return mailer.sendPasswordReset(user.Email, token)
+}
+
+func resetPassword(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Token    string `json:"token"`
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" || req.Password == "" {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		if err := repo.ResetPassword(hashToken(req.Token), req.Password); err != nil {
+			if errors.Is(err, model.ErrInvalidUserInput) {
+				http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+				return
+			}
+			log.Printf("Error resetting password: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, nil)
+	}
+}
+
+// getAllProducts pages through products with keyset pagination, optionally filtered and sorted (see productQuery).
 func getAllProducts(repo Repository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		products, err := repo.FetchAllProducts()
+		query, err := productQuery(r)
 		if err != nil {
-			http.Error(w, "Failed to fetch products", http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		sendJSONResponse(w, http.StatusOK, products)
+		sendProductPage(w, r, repo, query)
 	}
 }
 
-func getProductByID(repo Repository) http.HandlerFunc {
+func getProductByID(repo Repository, blobs BlobStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		idStr := chi.URLParam(r, "id")
 		id, err := strconv.Atoi(idStr)
@@ -104,6 +398,7 @@ func getProductByID(repo Repository) http.HandlerFunc {
 			return
 		}
 
+		setImageURLs(blobs, product.Images)
 		sendJSONResponse(w, http.StatusOK, product)
 	}
 }
@@ -128,13 +423,21 @@ func createProduct(repo Repository) http.HandlerFunc {
 
 func updateProduct(repo Repository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		idStr := chi.URLParam(r, "id")
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			http.Error(w, "Invalid product ID", http.StatusBadRequest)
+			return
+		}
+
 		var product model.Product
 		if err := json.NewDecoder(r.Body).Decode(&product); err != nil {
 			http.Error(w, "Invalid request payload", http.StatusBadRequest)
 			return
 		}
 
-		err := repo.UpdateProduct(product)
+		product.ID = uint(id)
+		err = repo.UpdateProduct(product)
 		if err != nil {
 			if errors.Is(err, model.ErrInvalidUserInput) {
 				http.Error(w, "Invalid product id", http.StatusBadRequest)
@@ -151,17 +454,32 @@ func updateProduct(repo Repository) http.HandlerFunc {
 
 func updateOrderStatus(repo Repository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		actorID := r.Context().Value("user_id").(uint)
+
 		var req struct {
 			Status model.OrderStatus `json:"status"`
 			ID     uint              `json:"id"`
+			Note   string            `json:"note"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, "Invalid request payload", http.StatusBadRequest)
 			return
 		}
 
-		err := repo.UpdateOrderStatus(req.Status, req.ID)
+		err := repo.UpdateOrderStatus(req.Status, req.ID, actorID, req.Note)
 		if err != nil {
+			var transitionErr *model.InvalidStatusTransitionError
+			if errors.As(err, &transitionErr) {
+				sendJSONResponse(w, http.StatusBadRequest, map[string]interface{}{
+					"error":   transitionErr.Error(),
+					"allowed": transitionErr.Allowed,
+				})
+				return
+			}
+			if errors.Is(err, model.ErrNotFound) {
+				http.Error(w, "Order not found", http.StatusNotFound)
+				return
+			}
 			if errors.Is(err, model.ErrInvalidUserInput) {
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
@@ -175,16 +493,17 @@ func updateOrderStatus(repo Repository) http.HandlerFunc {
 	}
 }
 
-func deleteProduct(repo Repository) http.HandlerFunc {
+// deleteProduct deletes a product and the blobs of its images.
+func deleteProduct(repo Repository, blobs BlobStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		idStr := r.URL.Query().Get("id")
+		idStr := chi.URLParam(r, "id")
 		id, err := strconv.Atoi(idStr)
 		if err != nil {
 			http.Error(w, "Invalid product ID", http.StatusBadRequest)
 			return
 		}
 
-		err = repo.DeleteProduct(uint(id))
+		images, err := repo.DeleteProduct(uint(id))
 		if err != nil {
 			if errors.Is(err, model.ErrInvalidUserInput) {
 				http.Error(w, "Product not found", http.StatusNotFound)
@@ -193,6 +512,9 @@ func deleteProduct(repo Repository) http.HandlerFunc {
 			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
 			return
 		}
+		for _, img := range images {
+			deleteBlobs(r.Context(), blobs, img.BlobKeys())
+		}
 
 		sendJSONResponse(w, http.StatusOK, nil)
 	}
@@ -215,14 +537,14 @@ func getOrders(repo Repository) http.HandlerFunc {
 
 func getOrderByID(repo Repository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		idStr := r.URL.Query().Get("id")
+		idStr := chi.URLParam(r, "id")
 		id, err := strconv.Atoi(idStr)
 		if err != nil {
 			http.Error(w, "Invalid order ID", http.StatusBadRequest)
 			return
 		}
 
-		order, err := repo.FetchOrderByID(uint(id))
+		order, err := repo.FetchOrderByID(uint(id), actorFromContext(r))
 		if err != nil {
 			if errors.Is(err, model.ErrInvalidUserInput) {
 				http.Error(w, "Order not found", http.StatusNotFound)
@@ -247,10 +569,14 @@ func cancelOrder(repo Repository) http.HandlerFunc {
 			return
 		}
 
-		err = repo.CancelOrder(uint(id))
+		err = repo.CancelOrder(uint(id), actorFromContext(r))
 		if err != nil {
+			if errors.Is(err, model.ErrNotFound) {
+				http.Error(w, "Order not found", http.StatusNotFound)
+				return
+			}
 			if errors.Is(err, model.ErrInvalidUserInput) {
-				http.Error(w, "Order not found", http.StatusBadRequest)
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
 			log.Printf("Error fetching order: %v", err)
@@ -262,24 +588,120 @@ func cancelOrder(repo Repository) http.HandlerFunc {
 	}
 }
 
+func getOrderStatusHistory(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		idStr := chi.URLParam(r, "id")
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			http.Error(w, "Invalid order ID", http.StatusBadRequest)
+			return
+		}
+
+		history, err := repo.FetchOrderStatusHistory(uint(id), actorFromContext(r))
+		if err != nil {
+			if errors.Is(err, model.ErrInvalidUserInput) {
+				http.Error(w, "Order not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("Error fetching order status history: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, history)
+	}
+}
+
 func createOrder(repo Repository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userID := r.Context().Value("user_id").(uint)
 
-		var order model.Order
-		if err := json.NewDecoder(r.Body).Decode(&order); err != nil {
+		var req struct {
+			Items []model.OrderItemInput `json:"items"`
+			model.AddressSelection
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, "Invalid request payload", http.StatusBadRequest)
 			return
 		}
 
-		order.UserID = userID
-		id, err := repo.CreateOrder(order)
+		order, err := repo.CreateOrder(userID, req.Items, req.AddressSelection)
 		if err != nil {
+			var stockErr *model.OutOfStockError
+			if errors.As(err, &stockErr) {
+				sendJSONResponse(w, http.StatusConflict, map[string]interface{}{
+					"error":    stockErr.Error(),
+					"products": stockErr.Shortages,
+				})
+				return
+			}
+			if errors.Is(err, model.ErrInvalidUserInput) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Printf("Error creating order: %v", err)
 			http.Error(w, "Failed to create order", http.StatusInternalServerError)
 			return
 		}
 
-		sendJSONResponse(w, http.StatusCreated, map[string]uint{"order_id": id})
+		sendJSONResponse(w, http.StatusCreated, order)
+	}
+}
+
+func getRoles(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		roles, err := repo.ListRoles()
+		if err != nil {
+			log.Printf("Error fetching roles: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, roles)
+	}
+}
+
+func setUserRoles(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		idStr := chi.URLParam(r, "id")
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+
+		var req struct {
+			Roles []string `json:"roles"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		user, err := repo.SetUserRoles(uint(id), req.Roles)
+		if err != nil {
+			if errors.Is(err, model.ErrNotFound) {
+				http.Error(w, "User not found", http.StatusNotFound)
+				return
+			}
+			if errors.Is(err, model.ErrInvalidUserInput) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Printf("Error updating user roles: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, user)
+	}
+}
+
+// getJWKS publishes the public signing keys so that other services can verify tokens issued by this API.
+func getJWKS(keys *KeySet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		sendJSONResponse(w, http.StatusOK, keys.publicKeys())
 	}
 }
 
@@ -294,3 +716,10 @@ func sendJSONResponse(w http.ResponseWriter, statusCode int, data interface{}) {
 		http.Error(w, `{"error": "Internal Server Error"}`, http.StatusInternalServerError)
 	}
 }
+
+// sendCredentialResponse sends a response carrying credentials, such as a token or a secret.
+// It is marked no-store, which keeps it out of caches and out of the idempotency key store.
+func sendCredentialResponse(w http.ResponseWriter, statusCode int, data interface{}) {
+	w.Header().Set("Cache-Control", "no-store")
+	sendJSONResponse(w, statusCode, data)
+}
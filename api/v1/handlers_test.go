@@ -0,0 +1,64 @@
+package v1
+
+import (
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"instashop/api/model"
+	"instashop/mail"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// verificationRepository holds users by email and records the tokens created for them.
+type verificationRepository struct {
+	Repository
+	users  map[string]model.User
+	tokens []uint
+}
+
+func (r *verificationRepository) FetchUserByEmail(email string) (model.User, error) {
+	user, ok := r.users[email]
+	if !ok {
+		return model.User{}, fmt.Errorf("user not found: %w", model.ErrNotFound)
+	}
+	return user, nil
+}
+
+func (r *verificationRepository) CreateUserToken(userID uint, purpose model.TokenPurpose, _ string, _ time.Time) error {
+	if purpose != model.TokenPurposeVerifyEmail {
+		return fmt.Errorf("unexpected %s token", purpose)
+	}
+	r.tokens = append(r.tokens, userID)
+	return nil
+}
+
+func TestResendVerificationDoesNotRevealAccounts(t *testing.T) {
+	verifiedAt := time.Now()
+	repo := &verificationRepository{users: map[string]model.User{
+		"new@example.com":      {ID: 1, Email: "new@example.com"},
+		"verified@example.com": {ID: 2, Email: "verified@example.com", EmailVerifiedAt: &verifiedAt},
+	}}
+	mailer := &mail.MemoryMailer{}
+	mux := chi.NewRouter()
+	AddRoutes(mux, repo, Config{Keys: newTestKeySet(), Mailer: mailer, AppURL: "https://shop.example.com"})
+
+	for _, email := range []string{"new@example.com", "verified@example.com", "unknown@example.com"} {
+		req := httptest.NewRequest(http.MethodPost, "/auth/resend-verification", strings.NewReader(`{"email":"`+email+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != http.StatusAccepted {
+			t.Errorf("%s: status = %d, want %d: %s", email, rec.Code, http.StatusAccepted, rec.Body)
+		}
+	}
+
+	if len(repo.tokens) != 1 || repo.tokens[0] != 1 {
+		t.Errorf("verification tokens created for users %v, want [1]", repo.tokens)
+	}
+	if msgs := mailer.Messages(); len(msgs) != 1 || msgs[0].To != "new@example.com" {
+		t.Errorf("sent %+v, want a single email to new@example.com", msgs)
+	}
+}
@@ -0,0 +1,57 @@
+package v1
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v4"
+	"instashop/api/model"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestKeySet returns a key set signing with a throwaway HS256 secret.
+func newTestKeySet() *KeySet {
+	key := &SigningKey{ID: "test", Method: jwt.SigningMethodHS256, signKey: []byte("test-secret"), verifyKey: []byte("test-secret")}
+	return &KeySet{active: key, keys: map[string]*SigningKey{key.ID: key}}
+}
+
+// newTestServer serves the v1 API backed by repo.
+func newTestServer(repo Repository, keys *KeySet) http.Handler {
+	mux := chi.NewRouter()
+	AddRoutes(mux, repo, Config{Keys: keys})
+	return mux
+}
+
+// testUser returns a user holding a role that grants permissions.
+func testUser(id uint, permissions ...model.Permission) model.User {
+	user := model.User{ID: id}
+	if len(permissions) > 0 {
+		role := model.Role{Name: "test"}
+		for _, p := range permissions {
+			role.Permissions = append(role.Permissions, model.RolePermission{Permission: p})
+		}
+		user.Roles = []model.Role{role}
+	}
+	return user
+}
+
+// accessToken returns an access token of user for a session the test repositories consider active.
+func accessToken(t *testing.T, keys *KeySet, user model.User) string {
+	t.Helper()
+	token, err := generateToken(keys, user, "session")
+	if err != nil {
+		t.Fatalf("generating token: %v", err)
+	}
+	return token
+}
+
+// serve sends a request to srv as the holder of token, which may be empty.
+func serve(srv http.Handler, method, target, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	return rec
+}
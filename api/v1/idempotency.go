@@ -0,0 +1,232 @@
+package v1
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5/middleware"
+	"hash"
+	"instashop/api/model"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+
+	// defaultIdempotencyKeyTTL is how long responses are kept for replay when Config.IdempotencyKeyTTL is unset.
+	defaultIdempotencyKeyTTL = 24 * time.Hour
+
+	// idempotencyLease is how long a request may hold its idempotency key without completing.
+	// Retries after that reclaim the key, so that a request interrupted by a crash does not block it until it expires.
+	idempotencyLease = time.Minute
+
+	maxIdempotencyKeyLength = 255
+
+	// maxIdempotentBodyMemory is the part of a request body kept in memory while it is fingerprinted;
+	// the rest is spooled to a temporary file.
+	maxIdempotentBodyMemory = 1 << 20
+)
+
+var errRequestBodyTooLarge = errors.New("request body too large")
+
+// idempotencyScope returns the scope in which the idempotency keys of a request are unique:
+// the API key, user or anonymous cart making it. It returns false for anonymous requests without a cart.
+func idempotencyScope(r *http.Request) (string, bool) {
+	if keyID, ok := r.Context().Value("api_key_id").(uint); ok {
+		return fmt.Sprintf("api_key:%d", keyID), true
+	}
+	if userID, ok := r.Context().Value("user_id").(uint); ok {
+		return fmt.Sprintf("user:%d", userID), true
+	}
+	if token := r.Header.Get(cartTokenHeader); token != "" {
+		return "cart:" + hashToken(token), true
+	}
+	return "", false
+}
+
+// idempotencyMiddleware makes POST, PUT and PATCH requests carrying an Idempotency-Key header safe to retry.
+//
+// The first request with a key runs normally and its response is stored for ttl.
+// Retries with the same key and the same method, path and body replay the stored response,
+// marked with an Idempotent-Replayed header, without running the handler again.
+// Reusing a key for a different request is rejected with 422 Unprocessable Entity,
+// and a retry while the first request is still running with 409 Conflict.
+// Responses with a 5xx status are not stored, so that the request can be retried, nor are responses
+// marked Cache-Control: no-store, which carry credentials; the key is released instead. A key held
+// for longer than idempotencyLease by a request that never completed can be reclaimed by a retry.
+// Bodies are fingerprinted as they are read, and those larger than maxBodySize are rejected.
+//
+// It must be used after the authentication middleware, since keys are scoped to the caller.
+func idempotencyMiddleware(repo Repository, ttl time.Duration, maxBodySize int64) func(http.Handler) http.Handler {
+	if ttl <= 0 {
+		ttl = defaultIdempotencyKeyTTL
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(idempotencyKeyHeader)
+			if key == "" || (r.Method != http.MethodPost && r.Method != http.MethodPut && r.Method != http.MethodPatch) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > maxIdempotencyKeyLength {
+				http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+				return
+			}
+			scope, ok := idempotencyScope(r)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			fingerprint := newRequestFingerprint(r)
+			cleanup, err := spoolBody(r, maxBodySize, fingerprint)
+			if err != nil {
+				if errors.Is(err, errRequestBodyTooLarge) {
+					http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+					return
+				}
+				log.Printf("Error reading idempotent request body: %v", err)
+				http.Error(w, "Invalid request payload", http.StatusBadRequest)
+				return
+			}
+			defer cleanup()
+			sum := hex.EncodeToString(fingerprint.Sum(nil))
+
+			now := time.Now()
+			record, claimed, err := repo.BeginIdempotentRequest(model.IdempotencyKey{
+				Scope:       scope,
+				Key:         key,
+				Fingerprint: sum,
+				StartedAt:   now,
+				ExpiresAt:   now.Add(ttl),
+			}, idempotencyLease)
+			if err != nil {
+				log.Printf("Error claiming idempotency key: %v", err)
+				http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			if !claimed {
+				switch {
+				case record.Fingerprint != sum:
+					http.Error(w, "Idempotency-Key was already used for a different request", http.StatusUnprocessableEntity)
+				case !record.Completed():
+					w.Header().Set("Retry-After", "1")
+					http.Error(w, "A request with this Idempotency-Key is still in progress", http.StatusConflict)
+				default:
+					if record.ResponseContentType != "" {
+						w.Header().Set("Content-Type", record.ResponseContentType)
+					}
+					w.Header().Set("Idempotent-Replayed", "true")
+					w.WriteHeader(record.ResponseStatus)
+					_, _ = w.Write(record.ResponseBody)
+				}
+				return
+			}
+
+			serveIdempotent(w, r, repo, next, record.ID)
+		})
+	}
+}
+
+// serveIdempotent serves the request that claimed the idempotency key id, recording its response.
+func serveIdempotent(w http.ResponseWriter, r *http.Request, repo Repository, next http.Handler, id uint) {
+	var response bytes.Buffer
+	ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+	ww.Tee(&response)
+
+	completed := false
+	defer func() {
+		if completed {
+			return
+		}
+		// the handler panicked; release the key so the request can be retried
+		if err := repo.ReleaseIdempotencyKey(id); err != nil {
+			log.Printf("Error releasing idempotency key: %v", err)
+		}
+	}()
+
+	next.ServeHTTP(ww, r)
+
+	status := ww.Status()
+	if status == 0 {
+		status = http.StatusOK
+	}
+	var err error
+	if status >= http.StatusInternalServerError || isNoStore(ww.Header()) {
+		err = repo.ReleaseIdempotencyKey(id)
+	} else {
+		err = repo.CompleteIdempotentRequest(id, status, ww.Header().Get("Content-Type"), response.Bytes())
+	}
+	if err != nil {
+		log.Printf("Error recording idempotent response: %v", err)
+	}
+	completed = true
+}
+
+// isNoStore reports whether the Cache-Control header of a response forbids storing it.
+func isNoStore(h http.Header) bool {
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		if strings.EqualFold(strings.TrimSpace(directive), "no-store") {
+			return true
+		}
+	}
+	return false
+}
+
+// newRequestFingerprint returns a hash identifying the method, path and body of a request,
+// to which the body still has to be written.
+func newRequestFingerprint(r *http.Request) hash.Hash {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", r.Method, r.URL.RequestURI())
+	return h
+}
+
+// spoolBody reads the body of r into h and replaces it with a copy for the handler to read.
+// Bodies larger than maxIdempotentBodyMemory are copied to a temporary file, which cleanup removes.
+// It fails with errRequestBodyTooLarge if the body is larger than maxSize.
+func spoolBody(r *http.Request, maxSize int64, h hash.Hash) (cleanup func(), err error) {
+	body := io.TeeReader(io.LimitReader(r.Body, maxSize+1), h)
+
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, body, maxIdempotentBodyMemory+1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n > maxSize {
+		return nil, errRequestBodyTooLarge
+	}
+	if n <= maxIdempotentBodyMemory {
+		r.Body = io.NopCloser(&buf)
+		return func() {}, nil
+	}
+
+	f, err := os.CreateTemp("", "idempotent-body-*")
+	if err != nil {
+		return nil, err
+	}
+	cleanup = func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}
+	n, err = io.Copy(f, io.MultiReader(&buf, body))
+	if err == nil && n > maxSize {
+		err = errRequestBodyTooLarge
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	r.Body = io.NopCloser(f)
+	return cleanup, nil
+}
@@ -0,0 +1,107 @@
+package v1
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"instashop/api/model"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// idempotencyRepository claims every idempotency key and records the claims and the responses stored.
+type idempotencyRepository struct {
+	Repository
+	claims   []model.IdempotencyKey
+	stored   [][]byte
+	released []uint
+}
+
+func (r *idempotencyRepository) BeginIdempotentRequest(record model.IdempotencyKey, _ time.Duration) (model.IdempotencyKey, bool, error) {
+	record.ID = uint(len(r.claims) + 1)
+	r.claims = append(r.claims, record)
+	return record, true, nil
+}
+
+func (r *idempotencyRepository) CompleteIdempotentRequest(_ uint, _ int, _ string, body []byte) error {
+	r.stored = append(r.stored, body)
+	return nil
+}
+
+func (r *idempotencyRepository) ReleaseIdempotencyKey(id uint) error {
+	r.released = append(r.released, id)
+	return nil
+}
+
+func (r *idempotencyRepository) IsSessionActive(string) (bool, error) { return true, nil }
+
+func (r *idempotencyRepository) CreateAPIKey(key *model.APIKey) error {
+	key.ID = 1
+	return nil
+}
+
+func TestIdempotentRequestBodiesAreFingerprintedAsTheyAreRead(t *testing.T) {
+	const maxBodySize = 3 << 20
+	repo := &idempotencyRepository{}
+	var received []byte
+	handler := idempotencyMiddleware(repo, time.Hour, maxBodySize)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = io.ReadAll(r.Body)
+	}))
+
+	for _, size := range []int{100, maxIdempotentBodyMemory + 1, maxBodySize} {
+		body := bytes.Repeat([]byte{'x'}, size)
+		req := httptest.NewRequest(http.MethodPost, "/admin/products/1/images", bytes.NewReader(body))
+		req.Header.Set(idempotencyKeyHeader, "key")
+		req = req.WithContext(context.WithValue(req.Context(), "user_id", uint(1)))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if !bytes.Equal(received, body) {
+			t.Fatalf("%d bytes: handler received %d bytes", size, len(received))
+		}
+		want := sha256.Sum256(append([]byte("POST /admin/products/1/images\n"), body...))
+		if got := repo.claims[len(repo.claims)-1].Fingerprint; got != hex.EncodeToString(want[:]) {
+			t.Fatalf("%d bytes: fingerprint = %s, want %x", size, got, want)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/products/1/images", bytes.NewReader(make([]byte, maxBodySize+1)))
+	req.Header.Set(idempotencyKeyHeader, "key")
+	req = req.WithContext(context.WithValue(req.Context(), "user_id", uint(1)))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("body over the limit: status = %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestCredentialResponsesAreNotStoredForReplay(t *testing.T) {
+	keys := newTestKeySet()
+	repo := &idempotencyRepository{}
+	srv := newTestServer(repo, keys)
+	token := accessToken(t, keys, testUser(1, model.PermissionAPIKeyManage, model.PermissionOrderReadAny))
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/api-keys", strings.NewReader(`{"name": "warehouse", "scopes": ["order:read:any"]}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set(idempotencyKeyHeader, "key")
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusCreated, rec.Body)
+	}
+	if len(repo.claims) != 1 {
+		t.Fatalf("%d idempotency keys claimed, want 1", len(repo.claims))
+	}
+	if len(repo.stored) != 0 {
+		t.Errorf("stored response %s, want none", repo.stored[0])
+	}
+	if len(repo.released) != 1 || repo.released[0] != repo.claims[0].ID {
+		t.Errorf("released keys %v, want [%d]", repo.released, repo.claims[0].ID)
+	}
+}
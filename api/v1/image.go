@@ -0,0 +1,305 @@
+package v1
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"image"
+	_ "image/gif" // registers the GIF decoder with image.Decode
+	"image/jpeg"
+	"image/png"
+	"instashop/api/model"
+	"instashop/thumbnail"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	defaultMaxImageSize = 10 << 20
+
+	// maxImagePixels bounds the dimensions of uploaded images, which are decoded in memory to generate thumbnails.
+	maxImagePixels = 40_000_000
+
+	// maxMultipartMemory is the part of an upload kept in memory; the rest is buffered to temporary files.
+	maxMultipartMemory = 8 << 20
+
+	// multipartOverhead leaves room in uploads for the other fields and the framing of the form.
+	multipartOverhead = 64 << 10
+)
+
+// imageFormats maps the content types of accepted images to the name of their decoder in the image package.
+var imageFormats = map[string]string{
+	"image/jpeg": "jpeg",
+	"image/png":  "png",
+	"image/gif":  "gif",
+}
+
+var (
+	errUnsupportedImage = errors.New("Unsupported image type, expected JPEG, PNG or GIF")
+	errInvalidImage     = errors.New("Invalid image")
+)
+
+// blobUpload is a blob to be written to the blob store.
+type blobUpload struct {
+	key         string
+	contentType string
+	data        []byte
+}
+
+// maxUploadSize returns the size of the largest request body uploading an image of at most maxSize bytes.
+func maxUploadSize(maxSize int64) int64 {
+	if maxSize <= 0 {
+		maxSize = defaultMaxImageSize
+	}
+	return maxSize + multipartOverhead
+}
+
+// uploadProductImage appends the image sent in the image field of a multipart form to the gallery of a product,
+// with the alternative text of the alt field. Thumbnails are generated in each of model.ImageSizes.
+func uploadProductImage(repo Repository, blobs BlobStore, maxSize int64) http.HandlerFunc {
+	if maxSize <= 0 {
+		maxSize = defaultMaxImageSize
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		productID, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil || productID <= 0 {
+			http.Error(w, "Invalid product ID", http.StatusBadRequest)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize(maxSize))
+		if err := r.ParseMultipartForm(maxMultipartMemory); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, fmt.Sprintf("Image must not exceed %d bytes", maxSize), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Invalid multipart form", http.StatusBadRequest)
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
+
+		file, header, err := r.FormFile("image")
+		if err != nil {
+			http.Error(w, "Missing image field", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		if header.Size > maxSize {
+			http.Error(w, fmt.Sprintf("Image must not exceed %d bytes", maxSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		alt := strings.TrimSpace(r.FormValue("alt"))
+		if utf8.RuneCountInString(alt) > 255 {
+			http.Error(w, "alt must not exceed 255 characters", http.StatusBadRequest)
+			return
+		}
+		data, err := io.ReadAll(file)
+		if err != nil {
+			log.Printf("Error reading uploaded image: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		key, err := imageKey(uint(productID))
+		if err != nil {
+			log.Printf("Error generating image key: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+		img := model.ProductImage{ProductID: uint(productID), Key: key, Alt: alt, Size: int64(len(data))}
+		uploads, err := processImage(&img, data)
+		if err != nil {
+			switch {
+			case errors.Is(err, errUnsupportedImage):
+				http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			case errors.Is(err, errInvalidImage):
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			default:
+				log.Printf("Error processing image: %v", err)
+				http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		// blobs are written before the image is recorded, so that galleries never reference missing blobs
+		for i, upload := range uploads {
+			if err := blobs.Put(r.Context(), upload.key, upload.contentType, upload.data); err != nil {
+				log.Printf("Error storing image: %v", err)
+				deleteBlobs(r.Context(), blobs, uploadKeys(uploads[:i]))
+				http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := repo.AddProductImage(&img); err != nil {
+			deleteBlobs(r.Context(), blobs, uploadKeys(uploads))
+			writeImageError(w, err, "adding product image")
+			return
+		}
+
+		images := []model.ProductImage{img}
+		setImageURLs(blobs, images)
+		sendJSONResponse(w, http.StatusCreated, images[0])
+	}
+}
+
+// reorderProductImages orders the gallery of a product as listed by the image_ids of the request.
+func reorderProductImages(repo Repository, blobs BlobStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		productID, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil || productID <= 0 {
+			http.Error(w, "Invalid product ID", http.StatusBadRequest)
+			return
+		}
+
+		var req struct {
+			ImageIDs []uint `json:"image_ids"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		images, err := repo.ReorderProductImages(uint(productID), req.ImageIDs)
+		if err != nil {
+			writeImageError(w, err, "reordering product images")
+			return
+		}
+
+		setImageURLs(blobs, images)
+		sendJSONResponse(w, http.StatusOK, images)
+	}
+}
+
+// deleteProductImage removes an image from the gallery of a product and deletes its blobs.
+func deleteProductImage(repo Repository, blobs BlobStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		productID, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil || productID <= 0 {
+			http.Error(w, "Invalid product ID", http.StatusBadRequest)
+			return
+		}
+		imageID, err := strconv.Atoi(chi.URLParam(r, "image_id"))
+		if err != nil || imageID <= 0 {
+			http.Error(w, "Invalid image ID", http.StatusBadRequest)
+			return
+		}
+
+		img, err := repo.DeleteProductImage(uint(productID), uint(imageID))
+		if err != nil {
+			writeImageError(w, err, "deleting product image")
+			return
+		}
+		deleteBlobs(r.Context(), blobs, img.BlobKeys())
+
+		sendJSONResponse(w, http.StatusOK, nil)
+	}
+}
+
+// processImage validates the uploaded image data, records its type and dimensions in img
+// and returns the blobs to store for it: the image as uploaded and its thumbnails.
+func processImage(img *model.ProductImage, data []byte) ([]blobUpload, error) {
+	img.ContentType = http.DetectContentType(data)
+	format, ok := imageFormats[img.ContentType]
+	if !ok {
+		return nil, errUnsupportedImage
+	}
+
+	// check the dimensions before decoding, so that small files cannot claim huge images
+	cfg, decoded, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || decoded != format {
+		return nil, errInvalidImage
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxImagePixels {
+		return nil, fmt.Errorf("%w: images must not exceed %d pixels", errInvalidImage, maxImagePixels)
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errInvalidImage
+	}
+	img.Width, img.Height = cfg.Width, cfg.Height
+
+	uploads := []blobUpload{{key: img.OriginalKey(), contentType: img.ContentType, data: data}}
+	for _, size := range model.ImageSizes {
+		key := img.ThumbnailKey(size)
+		if key == img.OriginalKey() {
+			continue
+		}
+		var buf bytes.Buffer
+		thumb := thumbnail.Fit(src, size.Pixels)
+		upload := blobUpload{key: key, contentType: "image/png"}
+		if img.ThumbnailExt() == ".jpg" {
+			upload.contentType = "image/jpeg"
+			err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 85})
+		} else {
+			err = png.Encode(&buf, thumb)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode %s thumbnail: %w", size.Name, err)
+		}
+		upload.data = buf.Bytes()
+		uploads = append(uploads, upload)
+	}
+	return uploads, nil
+}
+
+// imageKey returns a new random key for the blobs of an image of productID. Keys are never reused,
+// so that replacing an image never serves stale content from caches.
+func imageKey(productID uint) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("products/%d/%s", productID, hex.EncodeToString(b)), nil
+}
+
+// setImageURLs sets the URLs of the blobs of images.
+func setImageURLs(blobs BlobStore, images []model.ProductImage) {
+	for i, img := range images {
+		images[i].URL = blobs.URL(img.OriginalKey())
+		images[i].Thumbnails = make(map[string]string, len(model.ImageSizes))
+		for _, size := range model.ImageSizes {
+			images[i].Thumbnails[size.Name] = blobs.URL(img.ThumbnailKey(size))
+		}
+	}
+}
+
+// deleteBlobs deletes the blobs of keys. Failures are only logged: they leave unreferenced blobs behind,
+// which waste space but are never served.
+func deleteBlobs(ctx context.Context, blobs BlobStore, keys []string) {
+	for _, key := range keys {
+		if err := blobs.Delete(ctx, key); err != nil {
+			log.Printf("Error deleting blob %s: %v", key, err)
+		}
+	}
+}
+
+func uploadKeys(uploads []blobUpload) []string {
+	keys := make([]string, 0, len(uploads))
+	for _, upload := range uploads {
+		keys = append(keys, upload.key)
+	}
+	return keys
+}
+
+// writeImageError responds to the errors of product image operations.
+func writeImageError(w http.ResponseWriter, err error, action string) {
+	switch {
+	case errors.Is(err, model.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, model.ErrInvalidUserInput):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Printf("Error %s: %v", action, err)
+		http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+	}
+}
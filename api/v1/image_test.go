@@ -0,0 +1,245 @@
+package v1
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"hash/crc32"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"instashop/api/model"
+	"instashop/blob"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// imageRepository records the images added to galleries.
+type imageRepository struct {
+	idempotencyRepository
+	images []model.ProductImage
+}
+
+func (r *imageRepository) IsSessionActive(string) (bool, error) { return true, nil }
+
+func (r *imageRepository) AddProductImage(img *model.ProductImage) error {
+	img.ID = uint(len(r.images) + 1)
+	r.images = append(r.images, *img)
+	return nil
+}
+
+// imageTest uploads images as a catalog manager to a server storing blobs in memory.
+type imageTest struct {
+	repo  *imageRepository
+	blobs *blob.MemoryStore
+	srv   http.Handler
+	token string
+}
+
+func newImageTest(t *testing.T, maxImageSize int64) *imageTest {
+	t.Helper()
+	keys := newTestKeySet()
+	it := &imageTest{repo: &imageRepository{}, blobs: &blob.MemoryStore{}}
+	mux := chi.NewRouter()
+	AddRoutes(mux, it.repo, Config{Keys: keys, Blobs: it.blobs, MaxImageSize: maxImageSize})
+	it.srv = mux
+	it.token = accessToken(t, keys, testUser(1, model.PermissionProductWrite))
+	return it
+}
+
+// upload posts data as the image field of a multipart form, with an Idempotency-Key if key is not empty.
+func (it *imageTest) upload(t *testing.T, data []byte, key string) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("image", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = part.Write(data)
+	_ = form.WriteField("alt", "A product")
+	_ = form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/products/1/images", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+it.token)
+	if key != "" {
+		req.Header.Set(idempotencyKeyHeader, key)
+	}
+	rec := httptest.NewRecorder()
+	it.srv.ServeHTTP(rec, req)
+	return rec
+}
+
+// testImage returns an image of noise, which compresses poorly.
+func testImage(width, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	rnd := rand.New(rand.NewSource(1))
+	for i := range img.Pix {
+		img.Pix[i] = byte(rnd.Intn(256))
+	}
+	return img
+}
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestUploadProductImageStoresThumbnails(t *testing.T) {
+	it := newImageTest(t, 0)
+	rec := it.upload(t, encodePNG(t, testImage(800, 600)), "")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusCreated, rec.Body)
+	}
+	var img model.ProductImage
+	if err := json.NewDecoder(rec.Body).Decode(&img); err != nil {
+		t.Fatal(err)
+	}
+	if img.Width != 800 || img.Height != 600 || img.ContentType != "image/png" || img.Alt != "A product" {
+		t.Errorf("image = %+v", img)
+	}
+
+	want := map[string][2]int{"small": {160, 120}, "medium": {480, 360}, "large": {800, 600}}
+	for name, size := range want {
+		data, ok := it.blobs.Blob(strings.TrimPrefix(img.Thumbnails[name], "memory:///"))
+		if !ok {
+			t.Fatalf("%s thumbnail %q not stored", name, img.Thumbnails[name])
+		}
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil || cfg.Width != size[0] || cfg.Height != size[1] {
+			t.Errorf("%s thumbnail is %dx%d (err %v), want %dx%d", name, cfg.Width, cfg.Height, err, size[0], size[1])
+		}
+	}
+	if img.Thumbnails["large"] != img.URL {
+		t.Errorf("large thumbnail %q of an image smaller than the size, want the original %q", img.Thumbnails["large"], img.URL)
+	}
+}
+
+func TestUploadProductImageRejectsUnsupportedTypes(t *testing.T) {
+	it := newImageTest(t, 0)
+	for name, data := range map[string][]byte{
+		"text": []byte("just some text, not an image"),
+		"pdf":  []byte("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n"),
+	} {
+		if rec := it.upload(t, data, ""); rec.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("%s: status = %d, want %d", name, rec.Code, http.StatusUnsupportedMediaType)
+		}
+	}
+	if len(it.repo.images) != 0 {
+		t.Errorf("images added: %+v", it.repo.images)
+	}
+}
+
+func TestUploadProductImageRejectsLargeImages(t *testing.T) {
+	it := newImageTest(t, 1<<10)
+	if rec := it.upload(t, encodePNG(t, testImage(64, 64)), ""); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+	if len(it.repo.images) != 0 {
+		t.Errorf("images added: %+v", it.repo.images)
+	}
+}
+
+func TestUploadProductImageOverOneMebibyteWithIdempotencyKey(t *testing.T) {
+	it := newImageTest(t, 0)
+	data := encodePNG(t, testImage(700, 700))
+	if len(data) <= maxIdempotentBodyMemory {
+		t.Fatalf("test image is %d bytes, want over %d", len(data), maxIdempotentBodyMemory)
+	}
+	if rec := it.upload(t, data, "upload-1"); rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusCreated, rec.Body)
+	}
+	if got := it.repo.images[0].Size; got != int64(len(data)) {
+		t.Errorf("stored image size = %d, want %d", got, len(data))
+	}
+}
+
+// withDimensions returns a copy of data, a PNG image, whose header claims width x height pixels.
+func withDimensions(data []byte, width, height uint32) []byte {
+	data = append([]byte(nil), data...)
+	// the IHDR chunk follows the 8 byte signature: length, type, width, height, ..., CRC of type and data
+	binary.BigEndian.PutUint32(data[16:], width)
+	binary.BigEndian.PutUint32(data[20:], height)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+func TestProcessImage(t *testing.T) {
+	var jpegData, gifData bytes.Buffer
+	if err := jpeg.Encode(&jpegData, testImage(1600, 400), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := gif.Encode(&gifData, testImage(300, 300), nil); err != nil {
+		t.Fatal(err)
+	}
+	pngData := encodePNG(t, testImage(100, 50))
+
+	for _, tc := range []struct {
+		name        string
+		data        []byte
+		err         error
+		contentType string
+		keys        []string
+		types       []string
+	}{
+		{
+			name: "jpeg", data: jpegData.Bytes(), contentType: "image/jpeg",
+			keys:  []string{"k/original.jpg", "k/small.jpg", "k/medium.jpg", "k/large.jpg"},
+			types: []string{"image/jpeg", "image/jpeg", "image/jpeg", "image/jpeg"},
+		},
+		{
+			name: "gif", data: gifData.Bytes(), contentType: "image/gif",
+			keys:  []string{"k/original.gif", "k/small.png"},
+			types: []string{"image/gif", "image/png"},
+		},
+		{
+			name: "small png", data: pngData, contentType: "image/png",
+			keys:  []string{"k/original.png"},
+			types: []string{"image/png"},
+		},
+		{name: "text", data: []byte("hello"), err: errUnsupportedImage},
+		{name: "truncated png", data: pngData[:100], err: errInvalidImage},
+		{name: "png of too many pixels", data: withDimensions(pngData, 10000, 10000), err: errInvalidImage},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			img := model.ProductImage{Key: "k"}
+			uploads, err := processImage(&img, tc.data)
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Fatalf("err = %v, want %v", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if img.ContentType != tc.contentType {
+				t.Errorf("content type = %q, want %q", img.ContentType, tc.contentType)
+			}
+			var keys, types []string
+			for _, u := range uploads {
+				keys = append(keys, u.key)
+				types = append(types, u.contentType)
+			}
+			if fmt.Sprint(keys) != fmt.Sprint(tc.keys) || fmt.Sprint(types) != fmt.Sprint(tc.types) {
+				t.Errorf("uploads %v of types %v, want %v of types %v", keys, types, tc.keys, tc.types)
+			}
+			if fmt.Sprint(keys) != fmt.Sprint(img.BlobKeys()) {
+				t.Errorf("uploads %v, want the blob keys of the image %v", keys, img.BlobKeys())
+			}
+		})
+	}
+}
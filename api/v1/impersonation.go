@@ -0,0 +1,224 @@
+package v1
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/golang-jwt/jwt/v4"
+	"instashop/api/model"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// impersonationTTL is the lifetime of an impersonation token. Impersonation tokens cannot be refreshed.
+const impersonationTTL = 15 * time.Minute
+
+// generateImpersonationToken creates an access token for the impersonated user of imp.
+// The "imp" claim marks the token as an impersonation token and the "act" claim (RFC 8693) names the real actor.
+func generateImpersonationToken(keys *KeySet, user model.User, imp model.Impersonation) (string, error) {
+	claims := jwt.MapClaims{
+		"user_id":     user.ID,
+		"roles":       user.RoleNames(),
+		"permissions": user.Permissions(),
+		"imp":         imp.ID,
+		"act":         map[string]interface{}{"user_id": imp.ActorID},
+		"read_only":   imp.ReadOnly,
+		"exp":         imp.ExpiresAt.Unix(),
+	}
+	return keys.Sign(claims)
+}
+
+// serveImpersonated serves a request authenticated with an impersonation token, recording it in the audit log.
+// The actor must still be enabled and allowed to impersonate, so that revoking their role ends their impersonations.
+// Requests other than GET, HEAD and OPTIONS are rejected when the impersonation is read-only.
+func serveImpersonated(w http.ResponseWriter, r *http.Request, repo Repository, next http.Handler, impersonationID string) {
+	imp, err := repo.FetchImpersonation(impersonationID)
+	if err != nil && !errors.Is(err, model.ErrNotFound) {
+		log.Printf("Error fetching impersonation: %v", err)
+		http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err != nil || !imp.Active(time.Now()) {
+		http.Error(w, "Impersonation has ended", http.StatusUnauthorized)
+		return
+	}
+
+	actor, err := repo.FetchUserByID(imp.ActorID)
+	if err != nil && !errors.Is(err, model.ErrNotFound) {
+		log.Printf("Error fetching impersonating user: %v", err)
+		http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err != nil || actor.DisabledAt != nil ||
+		!(model.Actor{UserID: actor.ID, Permissions: actor.Permissions()}).Can(model.PermissionUserImpersonate) {
+		http.Error(w, "Impersonation has ended", http.StatusUnauthorized)
+		return
+	}
+
+	ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+	defer func() {
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		entry := model.AuditLogEntry{
+			ImpersonationID: imp.ID,
+			ActorID:         imp.ActorID,
+			UserID:          imp.UserID,
+			Method:          r.Method,
+			Path:            r.URL.RequestURI(),
+			Status:          status,
+		}
+		if err := repo.RecordAuditLogEntry(entry); err != nil {
+			log.Printf("Error recording impersonated request: %v", err)
+		}
+	}()
+
+	if imp.ReadOnly && r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions {
+		http.Error(ww, "Impersonation is read-only", http.StatusForbidden)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), "impersonation_id", imp.ID)
+	ctx = context.WithValue(ctx, "impersonator_id", imp.ActorID)
+	next.ServeHTTP(ww, r.WithContext(ctx))
+}
+
+// forbidImpersonation rejects requests made with an impersonation token.
+// It guards sensitive actions, such as changing credentials, that staff must never perform on a customer's behalf.
+func forbidImpersonation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value("impersonation_id").(string); ok {
+			http.Error(w, "Not allowed while impersonating", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// impersonateUser mints a short-lived token to act as a customer. The token is read-only unless allow_writes is set.
+// Staff accounts cannot be impersonated, so impersonation never grants permissions.
+func impersonateUser(repo Repository, keys *KeySet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor := actorFromContext(r)
+
+		idStr := chi.URLParam(r, "id")
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+
+		var req struct {
+			Reason      string `json:"reason"`
+			AllowWrites bool   `json:"allow_writes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if strings.TrimSpace(req.Reason) == "" {
+			http.Error(w, "A reason is required", http.StatusBadRequest)
+			return
+		}
+
+		user, err := repo.FetchUserByID(uint(id))
+		if err != nil {
+			if errors.Is(err, model.ErrNotFound) {
+				http.Error(w, "User not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("Error fetching user: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+		if user.ID == actor.UserID {
+			http.Error(w, "Cannot impersonate yourself", http.StatusBadRequest)
+			return
+		}
+		if user.IsPrivileged() {
+			http.Error(w, "Staff accounts cannot be impersonated", http.StatusForbidden)
+			return
+		}
+		if user.DisabledAt != nil {
+			http.Error(w, "Disabled accounts cannot be impersonated", http.StatusConflict)
+			return
+		}
+
+		imp := model.Impersonation{
+			ActorID:   actor.UserID,
+			UserID:    user.ID,
+			Reason:    req.Reason,
+			ReadOnly:  !req.AllowWrites,
+			ExpiresAt: time.Now().Add(impersonationTTL),
+		}
+		if err := repo.CreateImpersonation(&imp); err != nil {
+			log.Printf("Error creating impersonation: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		token, err := generateImpersonationToken(keys, user, imp)
+		if err != nil {
+			log.Printf("Error generating impersonation token: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sendCredentialResponse(w, http.StatusCreated, map[string]interface{}{
+			"token":         token,
+			"expires_in":    int(impersonationTTL.Seconds()),
+			"impersonation": imp,
+		})
+	}
+}
+
+// endImpersonation invalidates an impersonation token before it expires.
+func endImpersonation(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := repo.EndImpersonation(chi.URLParam(r, "id")); err != nil {
+			if errors.Is(err, model.ErrNotFound) {
+				http.Error(w, "Impersonation not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("Error ending impersonation: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, nil)
+	}
+}
+
+// getImpersonationAuditLog returns an impersonation with every request made during it.
+func getImpersonationAuditLog(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		imp, err := repo.FetchImpersonation(chi.URLParam(r, "id"))
+		if err != nil {
+			if errors.Is(err, model.ErrNotFound) {
+				http.Error(w, "Impersonation not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("Error fetching impersonation: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		entries, err := repo.FetchAuditLog(imp.ID)
+		if err != nil {
+			log.Printf("Error fetching audit log: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, map[string]interface{}{
+			"impersonation": imp,
+			"requests":      entries,
+		})
+	}
+}
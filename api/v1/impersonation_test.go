@@ -0,0 +1,229 @@
+package v1
+
+import (
+	"fmt"
+	"instashop/api/model"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// impersonationRepository holds users and impersonations in memory and records the audit log.
+type impersonationRepository struct {
+	Repository
+	users          map[uint]model.User
+	impersonations map[string]model.Impersonation
+	audit          []model.AuditLogEntry
+}
+
+func (r *impersonationRepository) IsSessionActive(string) (bool, error) { return true, nil }
+
+func (r *impersonationRepository) FetchUserByID(id uint) (model.User, error) {
+	user, ok := r.users[id]
+	if !ok {
+		return model.User{}, fmt.Errorf("user not found: %w", model.ErrNotFound)
+	}
+	return user, nil
+}
+
+func (r *impersonationRepository) CreateImpersonation(imp *model.Impersonation) error {
+	imp.ID = fmt.Sprintf("imp%d", len(r.impersonations)+1)
+	r.impersonations[imp.ID] = *imp
+	return nil
+}
+
+func (r *impersonationRepository) FetchImpersonation(id string) (model.Impersonation, error) {
+	imp, ok := r.impersonations[id]
+	if !ok {
+		return model.Impersonation{}, fmt.Errorf("impersonation not found: %w", model.ErrNotFound)
+	}
+	return imp, nil
+}
+
+func (r *impersonationRepository) RecordAuditLogEntry(entry model.AuditLogEntry) error {
+	r.audit = append(r.audit, entry)
+	return nil
+}
+
+const (
+	impersonatedCustomer = 1
+	impersonatingSupport = 2
+)
+
+func newImpersonationRepository() *impersonationRepository {
+	return &impersonationRepository{
+		users: map[uint]model.User{
+			impersonatedCustomer: testUser(impersonatedCustomer),
+			impersonatingSupport: testUser(impersonatingSupport, model.PermissionUserImpersonate),
+		},
+		impersonations: map[string]model.Impersonation{},
+	}
+}
+
+// impersonationToken stores an active impersonation of the customer by support staff and returns its token.
+func impersonationToken(t *testing.T, keys *KeySet, repo *impersonationRepository, readOnly bool) (string, string) {
+	t.Helper()
+	imp := model.Impersonation{
+		ActorID:   impersonatingSupport,
+		UserID:    impersonatedCustomer,
+		Reason:    "debugging",
+		ReadOnly:  readOnly,
+		ExpiresAt: time.Now().Add(impersonationTTL),
+	}
+	if err := repo.CreateImpersonation(&imp); err != nil {
+		t.Fatalf("creating impersonation: %v", err)
+	}
+	token, err := generateImpersonationToken(keys, repo.users[impersonatedCustomer], imp)
+	if err != nil {
+		t.Fatalf("generating impersonation token: %v", err)
+	}
+	return token, imp.ID
+}
+
+func TestReadOnlyImpersonationRejectsWrites(t *testing.T) {
+	keys := newTestKeySet()
+	repo := newImpersonationRepository()
+	srv := newTestServer(repo, keys)
+	token, _ := impersonationToken(t, keys, repo, true)
+
+	if rec := serve(srv, http.MethodGet, "/me", token); rec.Code != http.StatusOK {
+		t.Errorf("GET /me: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	for _, tc := range []struct{ method, target string }{
+		{http.MethodPost, "/order/new"},
+		{http.MethodPost, "/me/addresses"},
+		{http.MethodPut, "/me/addresses/1"},
+		{http.MethodPatch, "/me"},
+		{http.MethodDelete, "/me/addresses/1"},
+	} {
+		if rec := serve(srv, tc.method, tc.target, token); rec.Code != http.StatusForbidden {
+			t.Errorf("%s %s: status = %d, want %d", tc.method, tc.target, rec.Code, http.StatusForbidden)
+		}
+	}
+}
+
+func TestImpersonationCannotChangeCredentialsOrUseAdminRoutes(t *testing.T) {
+	keys := newTestKeySet()
+	repo := newImpersonationRepository()
+	srv := newTestServer(repo, keys)
+	token, _ := impersonationToken(t, keys, repo, false)
+
+	for _, tc := range []struct{ method, target string }{
+		{http.MethodPut, "/me/password"},
+		{http.MethodPut, "/me/email"},
+		{http.MethodDelete, "/me"},
+		{http.MethodPost, "/auth/logout"},
+		{http.MethodGet, "/admin/orders"},
+		{http.MethodPost, "/admin/users/3/impersonate"},
+	} {
+		rec := serve(srv, tc.method, tc.target, token)
+		if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "Not allowed while impersonating") {
+			t.Errorf("%s %s: status = %d (%s), want %d", tc.method, tc.target, rec.Code, strings.TrimSpace(rec.Body.String()), http.StatusForbidden)
+		}
+	}
+}
+
+func TestEndedImpersonationsAreRejected(t *testing.T) {
+	keys := newTestKeySet()
+	now := time.Now()
+
+	for name, end := range map[string]func(repo *impersonationRepository, id string){
+		"ended": func(repo *impersonationRepository, id string) {
+			imp := repo.impersonations[id]
+			imp.EndedAt = &now
+			repo.impersonations[id] = imp
+		},
+		"expired": func(repo *impersonationRepository, id string) {
+			imp := repo.impersonations[id]
+			imp.ExpiresAt = now.Add(-time.Second)
+			repo.impersonations[id] = imp
+		},
+		"deleted": func(repo *impersonationRepository, id string) {
+			delete(repo.impersonations, id)
+		},
+		"actor disabled": func(repo *impersonationRepository, _ string) {
+			actor := repo.users[impersonatingSupport]
+			actor.DisabledAt = &now
+			repo.users[impersonatingSupport] = actor
+		},
+		"actor lost the permission": func(repo *impersonationRepository, _ string) {
+			repo.users[impersonatingSupport] = testUser(impersonatingSupport, model.PermissionOrderReadAny)
+		},
+	} {
+		repo := newImpersonationRepository()
+		srv := newTestServer(repo, keys)
+		token, id := impersonationToken(t, keys, repo, true)
+		end(repo, id)
+
+		if rec := serve(srv, http.MethodGet, "/me", token); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: status = %d, want %d", name, rec.Code, http.StatusUnauthorized)
+		}
+		if len(repo.audit) != 0 {
+			t.Errorf("%s: recorded %d audit log entries, want none", name, len(repo.audit))
+		}
+	}
+}
+
+func TestImpersonatedRequestsAreAuditedOnce(t *testing.T) {
+	keys := newTestKeySet()
+	repo := newImpersonationRepository()
+	srv := newTestServer(repo, keys)
+	token, id := impersonationToken(t, keys, repo, true)
+
+	requests := []struct {
+		method, target string
+		status         int
+	}{
+		{http.MethodGet, "/me", http.StatusOK},
+		{http.MethodDelete, "/me/addresses/1", http.StatusForbidden},
+		{http.MethodPut, "/me/password", http.StatusForbidden},
+	}
+	for _, req := range requests {
+		serve(srv, req.method, req.target, token)
+	}
+
+	if len(repo.audit) != len(requests) {
+		t.Fatalf("recorded %d audit log entries, want %d", len(repo.audit), len(requests))
+	}
+	for i, req := range requests {
+		entry := repo.audit[i]
+		if entry.ImpersonationID != id || entry.ActorID != impersonatingSupport || entry.UserID != impersonatedCustomer {
+			t.Errorf("entry %d = %+v, want impersonation %s of user %d by %d", i, entry, id, impersonatedCustomer, impersonatingSupport)
+		}
+		if entry.Method != req.method || entry.Path != req.target || entry.Status != req.status {
+			t.Errorf("entry %d = %s %s %d, want %s %s %d", i, entry.Method, entry.Path, entry.Status, req.method, req.target, req.status)
+		}
+	}
+}
+
+func TestStaffCannotBeImpersonated(t *testing.T) {
+	const staff = 3
+	keys := newTestKeySet()
+	repo := newImpersonationRepository()
+	repo.users[staff] = testUser(staff, model.PermissionOrderReadAny)
+	srv := newTestServer(repo, keys)
+	token := accessToken(t, keys, repo.users[impersonatingSupport])
+
+	for _, tc := range []struct {
+		target uint
+		want   int
+	}{
+		{staff, http.StatusForbidden},
+		{impersonatedCustomer, http.StatusCreated},
+	} {
+		req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/admin/users/%d/impersonate", tc.target), strings.NewReader(`{"reason": "debugging"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+
+		if rec.Code != tc.want {
+			t.Errorf("impersonating user %d: status = %d, want %d", tc.target, rec.Code, tc.want)
+		}
+	}
+	if len(repo.impersonations) != 1 {
+		t.Errorf("%d impersonations created, want 1", len(repo.impersonations))
+	}
+}
@@ -0,0 +1,259 @@
+package v1
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v4"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+)
+
+// developmentSecret signs tokens in development environments without a key set (see DevelopmentKeySet).
+// It is public, so it must never be relied upon outside local development.
+var developmentSecret = []byte("not_so_secretive_secret_key")
+
+// SigningKey is a single key of a KeySet.
+// Keys without a private part (or secret) can only verify tokens, which is how retired keys are kept around during rotation.
+type SigningKey struct {
+	ID        string
+	Method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// KeySet holds the keys used to sign and verify JWTs.
+//
+// Tokens are always signed with the active key and carry its id in the "kid" header.
+// Any key in the set can verify tokens, so tokens issued with a previous key
+// remain valid after the active key is rotated.
+type KeySet struct {
+	active *SigningKey
+	keys   map[string]*SigningKey
+}
+
+// keySetConfig is the on-disk format of a key set.
+//
+//	{
+//	  "active": "2024-11",
+//	  "keys": [
+//	    {"kid": "2024-11", "alg": "ES256", "private_key_file": "/etc/instashop/es256.pem"},
+//	    {"kid": "2024-05", "alg": "RS256", "public_key_file": "/etc/instashop/rs256.pub.pem"}
+//	  ]
+//	}
+type keySetConfig struct {
+	Active string      `json:"active"`
+	Keys   []keyConfig `json:"keys"`
+}
+
+type keyConfig struct {
+	ID             string `json:"kid"`
+	Algorithm      string `json:"alg"`
+	Secret         string `json:"secret"` // HS256 only
+	PrivateKeyFile string `json:"private_key_file"`
+	PublicKeyFile  string `json:"public_key_file"` // for verification-only keys
+}
+
+// DevelopmentKeySet returns a key set holding only the hard-coded HS256 development secret.
+// Anyone can forge tokens signed with it, so it is only meant for local development, and every use is logged.
+func DevelopmentKeySet() *KeySet {
+	log.Printf("WARNING: signing tokens with the public development secret; configure a key set outside local development")
+	key := &SigningKey{
+		ID:        "development",
+		Method:    jwt.SigningMethodHS256,
+		signKey:   developmentSecret,
+		verifyKey: developmentSecret,
+	}
+	return &KeySet{active: key, keys: map[string]*SigningKey{key.ID: key}}
+}
+
+// LoadKeySet reads a key set configuration from path.
+func LoadKeySet(path string) (*KeySet, error) {
+	if path == "" {
+		return nil, errors.New("no key set configured")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key set: %w", err)
+	}
+	var cfg keySetConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse key set: %w", err)
+	}
+
+	ks := &KeySet{keys: make(map[string]*SigningKey, len(cfg.Keys))}
+	for _, kc := range cfg.Keys {
+		key, err := loadSigningKey(kc)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", kc.ID, err)
+		}
+		if _, ok := ks.keys[key.ID]; ok {
+			return nil, fmt.Errorf("duplicate key id %q", key.ID)
+		}
+		ks.keys[key.ID] = key
+	}
+
+	active, ok := ks.keys[cfg.Active]
+	if !ok {
+		return nil, fmt.Errorf("active key %q not found in key set", cfg.Active)
+	}
+	if active.signKey == nil {
+		return nil, fmt.Errorf("active key %q has no private key", cfg.Active)
+	}
+	ks.active = active
+	return ks, nil
+}
+
+func loadSigningKey(kc keyConfig) (*SigningKey, error) {
+	if kc.ID == "" {
+		return nil, errors.New("missing kid")
+	}
+	key := &SigningKey{ID: kc.ID, Method: jwt.GetSigningMethod(kc.Algorithm)}
+
+	var err error
+	switch kc.Algorithm {
+	case "HS256":
+		if kc.Secret == "" {
+			return nil, errors.New("HS256 keys require a secret")
+		}
+		key.signKey = []byte(kc.Secret)
+		key.verifyKey = key.signKey
+	case "RS256":
+		err = loadPEMKeyPair(kc, key,
+			func(b []byte) (interface{}, error) { return jwt.ParseRSAPrivateKeyFromPEM(b) },
+			func(b []byte) (interface{}, error) { return jwt.ParseRSAPublicKeyFromPEM(b) },
+			func(k interface{}) interface{} { return &k.(*rsa.PrivateKey).PublicKey })
+	case "ES256":
+		err = loadPEMKeyPair(kc, key,
+			func(b []byte) (interface{}, error) { return jwt.ParseECPrivateKeyFromPEM(b) },
+			func(b []byte) (interface{}, error) { return jwt.ParseECPublicKeyFromPEM(b) },
+			func(k interface{}) interface{} { return &k.(*ecdsa.PrivateKey).PublicKey })
+	case "EdDSA":
+		err = loadPEMKeyPair(kc, key,
+			func(b []byte) (interface{}, error) { return jwt.ParseEdPrivateKeyFromPEM(b) },
+			func(b []byte) (interface{}, error) { return jwt.ParseEdPublicKeyFromPEM(b) },
+			func(k interface{}) interface{} { return k.(ed25519.PrivateKey).Public() })
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", kc.Algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// loadPEMKeyPair fills the sign and verify keys of key from the PEM files referenced by kc.
+// The public key is derived from the private key when a private key file is given.
+func loadPEMKeyPair(
+	kc keyConfig,
+	key *SigningKey,
+	parsePrivate, parsePublic func([]byte) (interface{}, error),
+	publicOf func(interface{}) interface{},
+) error {
+	switch {
+	case kc.PrivateKeyFile != "":
+		data, err := os.ReadFile(kc.PrivateKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to read private key: %w", err)
+		}
+		private, err := parsePrivate(data)
+		if err != nil {
+			return fmt.Errorf("failed to parse private key: %w", err)
+		}
+		key.signKey = private
+		key.verifyKey = publicOf(private)
+	case kc.PublicKeyFile != "":
+		data, err := os.ReadFile(kc.PublicKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to read public key: %w", err)
+		}
+		public, err := parsePublic(data)
+		if err != nil {
+			return fmt.Errorf("failed to parse public key: %w", err)
+		}
+		key.verifyKey = public
+	default:
+		return errors.New("either private_key_file or public_key_file is required")
+	}
+	return nil
+}
+
+// Sign creates a token holding claims signed with the active key.
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.active.Method, claims)
+	token.Header["kid"] = ks.active.ID
+	return token.SignedString(ks.active.signKey)
+}
+
+// Parse validates a token signed by any key of the set and returns its claims.
+func (ks *KeySet) Parse(tokenString string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := ks.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, errors.New("unexpected signing method")
+		}
+		return key.verifyKey, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
+		return claims, nil
+	}
+	return nil, errors.New("invalid token")
+}
+
+// jsonWebKey is the RFC 7517 representation of a public key.
+type jsonWebKey struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Curve     string `json:"crv,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+// publicKeys returns the public keys of the set as a JSON Web Key Set.
+// Symmetric keys are never published.
+func (ks *KeySet) publicKeys() map[string][]jsonWebKey {
+	keys := make([]jsonWebKey, 0, len(ks.keys))
+	for _, key := range ks.keys {
+		jwk := jsonWebKey{Use: "sig", Algorithm: key.Method.Alg(), KeyID: key.ID}
+		switch public := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case *ecdsa.PublicKey:
+			size := (public.Curve.Params().BitSize + 7) / 8
+			jwk.KeyType = "EC"
+			jwk.Curve = public.Curve.Params().Name
+			jwk.X = base64.RawURLEncoding.EncodeToString(public.X.FillBytes(make([]byte, size)))
+			jwk.Y = base64.RawURLEncoding.EncodeToString(public.Y.FillBytes(make([]byte, size)))
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		default:
+			continue
+		}
+		keys = append(keys, jwk)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].KeyID < keys[j].KeyID })
+	return map[string][]jsonWebKey{"keys": keys}
+}
@@ -0,0 +1,390 @@
+package v1
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v4"
+	"instashop/api/model"
+	"instashop/totp"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	mfaIssuer         = "InstaShop"
+	mfaChallengeTTL   = 5 * time.Minute
+	recoveryCodeCount = 10
+
+	// mfaPurposeVerify challenges users with MFA enabled for a TOTP or recovery code.
+	mfaPurposeVerify = "mfa_verify"
+
+	// mfaPurposeEnroll challenges users who must enable MFA before they can log in.
+	mfaPurposeEnroll = "mfa_enroll"
+)
+
+var errInvalidSecondFactor = fmt.Errorf("invalid authentication code: %w", model.ErrInvalidUserInput)
+
+// generateMFAChallenge creates the short-lived token returned by login in place of an access token
+// when a second factor is required. It carries a "purpose" claim, which authMiddleware rejects.
+func generateMFAChallenge(keys *KeySet, userID uint, purpose string) (string, error) {
+	claims := jwt.MapClaims{
+		"user_id": userID,
+		"purpose": purpose,
+		"iat":     time.Now().Unix(),
+		"exp":     time.Now().Add(mfaChallengeTTL).Unix(),
+	}
+	return keys.Sign(claims)
+}
+
+// parseMFAChallenge validates a challenge token issued for purpose and returns the user it was issued to.
+// Challenges of disabled users, and those issued before the user's password last changed, are invalid.
+// Since issue times are in whole seconds, a challenge issued in the second the password changed is invalid too.
+func parseMFAChallenge(repo Repository, keys *KeySet, token, purpose string) (model.User, error) {
+	claims, err := keys.Parse(token)
+	if err != nil {
+		return model.User{}, fmt.Errorf("invalid MFA token: %w", model.ErrInvalidUserInput)
+	}
+	userID, userOk := claims["user_id"].(float64)
+	issuedAt, issuedOk := claims["iat"].(float64)
+	if claimed, _ := claims["purpose"].(string); !userOk || !issuedOk || claimed != purpose {
+		return model.User{}, fmt.Errorf("invalid MFA token: %w", model.ErrInvalidUserInput)
+	}
+
+	user, err := repo.FetchUserByID(uint(userID))
+	if err != nil {
+		return model.User{}, err
+	}
+	if user.DisabledAt != nil {
+		return model.User{}, fmt.Errorf("account disabled: %w", model.ErrInvalidUserInput)
+	}
+	if user.PasswordChangedAt != nil && int64(issuedAt) <= user.PasswordChangedAt.Unix() {
+		return model.User{}, fmt.Errorf("MFA token issued before the password changed: %w", model.ErrInvalidUserInput)
+	}
+	return user, nil
+}
+
+// verifySecondFactor checks either a TOTP code or a recovery code of user, consuming it on success.
+func verifySecondFactor(repo Repository, user model.User, code, recoveryCode string) error {
+	if user.MFAEnabledAt == nil {
+		return fmt.Errorf("two-factor authentication not enabled: %w", model.ErrInvalidUserInput)
+	}
+
+	if recoveryCode != "" {
+		return repo.UseRecoveryCode(user.ID, hashToken(normalizeRecoveryCode(recoveryCode)))
+	}
+
+	step, ok := totp.Validate(user.MFASecret, code, time.Now())
+	if !ok {
+		return errInvalidSecondFactor
+	}
+	fresh, err := repo.ConsumeMFAStep(user.ID, step)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return errInvalidSecondFactor
+	}
+	return nil
+}
+
+// generateRecoveryCodes returns new recovery codes along with the hashes under which they are stored.
+func generateRecoveryCodes() (codes, hashes []string, err error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		raw := strings.ToLower(encoding.EncodeToString(b))
+		code := raw[:8] + "-" + raw[8:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashToken(normalizeRecoveryCode(code)))
+	}
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// startMFAEnrollment creates a pending TOTP secret for user and responds with its provisioning details.
+func startMFAEnrollment(w http.ResponseWriter, repo Repository, user model.User) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		log.Printf("Error generating MFA secret: %v", err)
+		http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := repo.SetMFASecret(user.ID, secret); err != nil {
+		if errors.Is(err, model.ErrInvalidUserInput) {
+			http.Error(w, "Two-factor authentication already enabled", http.StatusConflict)
+			return
+		}
+		log.Printf("Error storing MFA secret: %v", err)
+		http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sendCredentialResponse(w, http.StatusOK, map[string]string{
+		"secret":           secret,
+		"provisioning_uri": totp.ProvisioningURI(secret, mfaIssuer, user.Email),
+	})
+}
+
+// completeMFAEnrollment confirms the pending secret of user with code and enables two-factor authentication,
+// returning the user's new recovery codes.
+func completeMFAEnrollment(repo Repository, user model.User, code string) ([]string, error) {
+	if user.MFAEnabledAt != nil {
+		return nil, fmt.Errorf("two-factor authentication already enabled: %w", model.ErrInvalidUserInput)
+	}
+	if user.MFASecret == "" {
+		return nil, fmt.Errorf("no pending two-factor enrollment: %w", model.ErrInvalidUserInput)
+	}
+
+	step, ok := totp.Validate(user.MFASecret, code, time.Now())
+	if !ok {
+		return nil, errInvalidSecondFactor
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err := repo.EnableMFA(user.ID, step, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// handleMFAError responds to errors of the MFA flows.
+func handleMFAError(w http.ResponseWriter, err error) {
+	if errors.Is(err, model.ErrInvalidUserInput) {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	log.Printf("Error during two-factor authentication: %v", err)
+	http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+}
+
+func verifyMFAChallenge(repo Repository, keys *KeySet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			MFAToken     string `json:"mfa_token"`
+			Code         string `json:"code"`
+			RecoveryCode string `json:"recovery_code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MFAToken == "" {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		user, err := parseMFAChallenge(repo, keys, req.MFAToken, mfaPurposeVerify)
+		if err != nil {
+			handleMFAError(w, err)
+			return
+		}
+		if !allowLoginAttempt(w, r, repo, user.Email) {
+			return
+		}
+		if err := verifySecondFactor(repo, user, req.Code, req.RecoveryCode); err != nil {
+			if errors.Is(err, model.ErrInvalidUserInput) {
+				recordLoginFailure(r, repo, user.Email)
+			}
+			handleMFAError(w, err)
+			return
+		}
+
+		recordLoginSuccess(repo, user.Email)
+		startSession(w, repo, keys, user)
+	}
+}
+
+func enrollMFAChallenge(repo Repository, keys *KeySet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			MFAToken string `json:"mfa_token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MFAToken == "" {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		user, err := parseMFAChallenge(repo, keys, req.MFAToken, mfaPurposeEnroll)
+		if err != nil {
+			handleMFAError(w, err)
+			return
+		}
+
+		startMFAEnrollment(w, repo, user)
+	}
+}
+
+// activateMFAChallenge completes a forced enrollment and the login that required it,
+// responding with the recovery codes alongside the session tokens.
+func activateMFAChallenge(repo Repository, keys *KeySet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			MFAToken string `json:"mfa_token"`
+			Code     string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MFAToken == "" {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		user, err := parseMFAChallenge(repo, keys, req.MFAToken, mfaPurposeEnroll)
+		if err != nil {
+			handleMFAError(w, err)
+			return
+		}
+		codes, err := completeMFAEnrollment(repo, user, req.Code)
+		if err != nil {
+			handleMFAError(w, err)
+			return
+		}
+
+		tokens, err := newSession(repo, keys, user)
+		if err != nil {
+			log.Printf("Error starting session: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+		tokens["recovery_codes"] = codes
+
+		sendJSONResponse(w, http.StatusOK, tokens)
+	}
+}
+
+func enrollMFA(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value("user_id").(uint)
+
+		user, err := repo.FetchUserByID(userID)
+		if err != nil {
+			log.Printf("Error fetching user %d: %v", userID, err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		startMFAEnrollment(w, repo, user)
+	}
+}
+
+func activateMFA(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value("user_id").(uint)
+
+		var req struct {
+			Code string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		user, err := repo.FetchUserByID(userID)
+		if err != nil {
+			log.Printf("Error fetching user %d: %v", userID, err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+		codes, err := completeMFAEnrollment(repo, user, req.Code)
+		if err != nil {
+			if errors.Is(err, model.ErrInvalidUserInput) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Printf("Error enabling MFA: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sendCredentialResponse(w, http.StatusOK, map[string][]string{"recovery_codes": codes})
+	}
+}
+
+// disableMFA turns off two-factor authentication after checking a current code.
+// Staff users cannot disable it while requireStaffMFA is set.
+func disableMFA(repo Repository, requireStaffMFA bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value("user_id").(uint)
+
+		var req struct {
+			Code         string `json:"code"`
+			RecoveryCode string `json:"recovery_code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		user, err := repo.FetchUserByID(userID)
+		if err != nil {
+			log.Printf("Error fetching user %d: %v", userID, err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+		if requireStaffMFA && user.IsPrivileged() {
+			http.Error(w, "Two-factor authentication is mandatory for staff accounts", http.StatusForbidden)
+			return
+		}
+		if err := verifySecondFactor(repo, user, req.Code, req.RecoveryCode); err != nil {
+			handleMFAError(w, err)
+			return
+		}
+
+		if err := repo.DisableMFA(userID); err != nil {
+			log.Printf("Error disabling MFA: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, nil)
+	}
+}
+
+// regenerateRecoveryCodes replaces the recovery codes of the user after checking a current TOTP code.
+func regenerateRecoveryCodes(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value("user_id").(uint)
+
+		var req struct {
+			Code string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		user, err := repo.FetchUserByID(userID)
+		if err != nil {
+			log.Printf("Error fetching user %d: %v", userID, err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := verifySecondFactor(repo, user, req.Code, ""); err != nil {
+			handleMFAError(w, err)
+			return
+		}
+
+		codes, hashes, err := generateRecoveryCodes()
+		if err != nil {
+			log.Printf("Error generating recovery codes: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := repo.ReplaceRecoveryCodes(userID, hashes); err != nil {
+			log.Printf("Error storing recovery codes: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sendCredentialResponse(w, http.StatusOK, map[string][]string{"recovery_codes": codes})
+	}
+}
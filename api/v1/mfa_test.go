@@ -0,0 +1,100 @@
+package v1
+
+import (
+	"errors"
+	"fmt"
+	"instashop/api/model"
+	"instashop/totp"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mfaRepository holds a single user and the last TOTP step accepted for them.
+type mfaRepository struct {
+	Repository
+	user     model.User
+	lastStep int64
+}
+
+func (r *mfaRepository) FetchUserByID(id uint) (model.User, error) {
+	if id != r.user.ID {
+		return model.User{}, fmt.Errorf("user not found: %w", model.ErrNotFound)
+	}
+	return r.user, nil
+}
+
+func (r *mfaRepository) SetMFASecret(uint, string) error { return nil }
+
+func (r *mfaRepository) ConsumeMFAStep(_ uint, step int64) (bool, error) {
+	if step <= r.lastStep {
+		return false, nil
+	}
+	r.lastStep = step
+	return true, nil
+}
+
+func TestTOTPCodesCannotBeReplayed(t *testing.T) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatalf("generating secret: %v", err)
+	}
+	enabled := time.Now()
+	user := model.User{ID: 1, MFASecret: secret, MFAEnabledAt: &enabled}
+	repo := &mfaRepository{user: user}
+
+	code := totpCode(t, secret, time.Now())
+	if err := verifySecondFactor(repo, user, code, ""); err != nil {
+		t.Fatalf("first use of code: %v", err)
+	}
+	if err := verifySecondFactor(repo, user, code, ""); !errors.Is(err, errInvalidSecondFactor) {
+		t.Errorf("replayed code: err = %v, want errInvalidSecondFactor", err)
+	}
+	// a code of an earlier step, still within the accepted drift, is a replay too
+	if err := verifySecondFactor(repo, user, totpCode(t, secret, time.Now().Add(-30*time.Second)), ""); !errors.Is(err, errInvalidSecondFactor) {
+		t.Errorf("code of an earlier step: err = %v, want errInvalidSecondFactor", err)
+	}
+}
+
+// totpCode returns the code of secret at t.
+func totpCode(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+	code, err := totp.Generate(secret, at)
+	if err != nil {
+		t.Fatalf("generating code: %v", err)
+	}
+	return code
+}
+
+func TestMFAChallengesAreInvalidatedByDisablingOrPasswordChanges(t *testing.T) {
+	keys := newTestKeySet()
+	challenge, err := generateMFAChallenge(keys, 1, mfaPurposeEnroll)
+	if err != nil {
+		t.Fatalf("generating challenge: %v", err)
+	}
+	earlier, later := time.Now().Add(-time.Minute), time.Now().Add(time.Minute)
+
+	for _, tc := range []struct {
+		name string
+		user model.User
+		want int
+	}{
+		{"valid", model.User{ID: 1, Email: "staff@example.com"}, http.StatusOK},
+		{"password changed before", model.User{ID: 1, Email: "staff@example.com", PasswordChangedAt: &earlier}, http.StatusOK},
+		{"disabled", model.User{ID: 1, Email: "staff@example.com", DisabledAt: &earlier}, http.StatusUnauthorized},
+		{"password changed since", model.User{ID: 1, Email: "staff@example.com", PasswordChangedAt: &later}, http.StatusUnauthorized},
+		{"deleted", model.User{ID: 2}, http.StatusUnauthorized},
+	} {
+		srv := newTestServer(&mfaRepository{user: tc.user}, keys)
+		req := httptest.NewRequest(http.MethodPost, "/auth/mfa/challenge/enroll", strings.NewReader(fmt.Sprintf(`{"mfa_token": %q}`, challenge)))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+
+		if rec.Code != tc.want {
+			t.Errorf("%s: status = %d (%s), want %d", tc.name, rec.Code, strings.TrimSpace(rec.Body.String()), tc.want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package v1
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"instashop/api/model"
+	"instashop/oidc"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// oidcAuthRequestTTL is how long a user has to complete a sign-in at an external provider.
+const oidcAuthRequestTTL = 10 * time.Minute
+
+// oidcProviders holds the configured external identity providers by name.
+type oidcProviders map[string]*oidc.Provider
+
+func newOIDCProviders(providers []*oidc.Provider) oidcProviders {
+	m := make(oidcProviders, len(providers))
+	for _, p := range providers {
+		m[p.Name()] = p
+	}
+	return m
+}
+
+// provider returns the provider named in the request path, responding with 404 Not Found if there is none.
+func (p oidcProviders) provider(w http.ResponseWriter, r *http.Request) (*oidc.Provider, bool) {
+	provider, ok := p[chi.URLParam(r, "provider")]
+	if !ok {
+		http.Error(w, "Unknown identity provider", http.StatusNotFound)
+	}
+	return provider, ok
+}
+
+// oidcAuthorize starts a sign-in at an external provider.
+//
+// It responds with the provider URL to send the user to and the state the provider will send back.
+// The client must keep the state and check that it matches before completing the sign-in at oidcCallback,
+// which ties the sign-in to the browser that started it.
+func oidcAuthorize(repo Repository, providers oidcProviders) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		provider, ok := providers.provider(w, r)
+		if !ok {
+			return
+		}
+
+		state, stateHash, err := generateOpaqueToken()
+		if err != nil {
+			log.Printf("Error generating OIDC state: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+		nonce, _, err := generateOpaqueToken()
+		if err != nil {
+			log.Printf("Error generating OIDC nonce: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+		verifier, err := oidc.GenerateCodeVerifier()
+		if err != nil {
+			log.Printf("Error generating PKCE verifier: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = repo.CreateOIDCAuthRequest(model.OIDCAuthRequest{
+			StateHash:    stateHash,
+			Provider:     provider.Name(),
+			Nonce:        nonce,
+			CodeVerifier: verifier,
+			ExpiresAt:    time.Now().Add(oidcAuthRequestTTL),
+		})
+		if err != nil {
+			log.Printf("Error creating OIDC sign-in request: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, map[string]string{
+			"authorization_url": provider.AuthCodeURL(state, nonce, oidc.CodeChallenge(verifier)),
+			"state":             state,
+		})
+	}
+}
+
+// oidcCallback completes a sign-in at an external provider with the code and state the provider redirected back with.
+//
+// The provider's identity is linked to a user by verified email the first time it is used.
+// The response is the same as for login, including MFA challenges.
+func oidcCallback(repo Repository, keys *KeySet, providers oidcProviders, requireStaffMFA bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		provider, ok := providers.provider(w, r)
+		if !ok {
+			return
+		}
+
+		var req struct {
+			Code  string `json:"code"`
+			State string `json:"state"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" || req.State == "" {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		authRequest, err := repo.ConsumeOIDCAuthRequest(provider.Name(), hashToken(req.State))
+		if err != nil {
+			if errors.Is(err, model.ErrInvalidUserInput) {
+				http.Error(w, "Invalid or expired sign-in request", http.StatusBadRequest)
+				return
+			}
+			log.Printf("Error consuming OIDC sign-in request: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		identity, err := provider.Exchange(r.Context(), req.Code, authRequest.CodeVerifier, authRequest.Nonce)
+		if err != nil {
+			log.Printf("Error completing sign-in with %s: %v", provider.Name(), err)
+			http.Error(w, "Sign-in with identity provider failed", http.StatusUnauthorized)
+			return
+		}
+		if identity.Email == "" || !identity.EmailVerified {
+			http.Error(w, "Identity provider did not supply a verified email address", http.StatusForbidden)
+			return
+		}
+
+		user, err := repo.SignInWithExternalIdentity(provider.Name(), identity.Subject, identity.Email)
+		if err != nil {
+			log.Printf("Error signing in with %s: %v", provider.Name(), err)
+			http.Error(w, "Login failed. Please try again", http.StatusInternalServerError)
+			return
+		}
+
+		if user.DisabledAt != nil {
+			http.Error(w, "Account disabled", http.StatusForbidden)
+			return
+		}
+
+		if sendMFAChallenge(w, keys, user, requireStaffMFA) {
+			return
+		}
+		startSession(w, repo, keys, user)
+	}
+}
+
+func getOIDCProviders(providers oidcProviders) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		names := make([]string, 0, len(providers))
+		for name := range providers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		sendJSONResponse(w, http.StatusOK, names)
+	}
+}
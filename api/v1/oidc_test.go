@@ -0,0 +1,232 @@
+package v1
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v4"
+	"instashop/api/model"
+	"instashop/oidc"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// oidcRepository holds pending sign-ins in memory and records the emails of the external identities signed in with.
+type oidcRepository struct {
+	Repository
+	authRequests map[string]model.OIDCAuthRequest // by state hash
+	signIns      []string
+}
+
+func (r *oidcRepository) CreateOIDCAuthRequest(req model.OIDCAuthRequest) error {
+	r.authRequests[req.StateHash] = req
+	return nil
+}
+
+func (r *oidcRepository) ConsumeOIDCAuthRequest(provider, stateHash string) (model.OIDCAuthRequest, error) {
+	req, ok := r.authRequests[stateHash]
+	if !ok || req.Provider != provider {
+		return model.OIDCAuthRequest{}, fmt.Errorf("invalid or expired sign-in request: %w", model.ErrInvalidUserInput)
+	}
+	delete(r.authRequests, stateHash)
+	return req, nil
+}
+
+func (r *oidcRepository) SignInWithExternalIdentity(_, _, email string) (model.User, error) {
+	r.signIns = append(r.signIns, email)
+	return model.User{ID: 1, Email: email}, nil
+}
+
+func (r *oidcRepository) CreateSession(uint, string, time.Time) (string, error) {
+	return "session", nil
+}
+
+// fakeOIDCProvider is an identity provider serving a discovery document, a JWKS and a token endpoint.
+// Like a real provider, it redeems the codes it issued with authorize for the PKCE verifier of their challenge,
+// and issues an ID token carrying the nonce of the authorization request.
+type fakeOIDCProvider struct {
+	*httptest.Server
+	key           *rsa.PrivateKey
+	emailVerified bool
+
+	mu    sync.Mutex
+	codes map[string]url.Values // the query of the authorization request of each code
+}
+
+func newFakeOIDCProvider(t *testing.T, emailVerified bool) *fakeOIDCProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeOIDCProvider{key: key, emailVerified: emailVerified, codes: make(map[string]url.Values)}
+	p.Server = httptest.NewServer(http.HandlerFunc(p.serveHTTP))
+	t.Cleanup(p.Close)
+	return p
+}
+
+// authorize signs the user in at authorizationURL and returns the code the provider redirects back with.
+func (p *fakeOIDCProvider) authorize(t *testing.T, authorizationURL string) string {
+	t.Helper()
+	u, err := url.Parse(authorizationURL)
+	if err != nil || !strings.HasPrefix(authorizationURL, p.URL+"/authorize?") {
+		t.Fatalf("authorization URL %q does not point to the provider", authorizationURL)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	code := fmt.Sprintf("code-%d", len(p.codes))
+	p.codes[code] = u.Query()
+	return code
+}
+
+func (p *fakeOIDCProvider) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		sendJSONResponse(w, http.StatusOK, map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	case "/jwks":
+		sendJSONResponse(w, http.StatusOK, map[string]interface{}{"keys": []map[string]string{{
+			"kid": "key",
+			"kty": "RSA",
+			"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+		}}})
+	case "/token":
+		p.mu.Lock()
+		authorization, ok := p.codes[r.PostFormValue("code")]
+		delete(p.codes, r.PostFormValue("code"))
+		p.mu.Unlock()
+		if !ok || oidc.CodeChallenge(r.PostFormValue("code_verifier")) != authorization.Get("code_challenge") {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss":            p.URL,
+			"aud":            authorization.Get("client_id"),
+			"sub":            "subject",
+			"nonce":          authorization.Get("nonce"),
+			"email":          "user@example.com",
+			"email_verified": p.emailVerified,
+			"exp":            time.Now().Add(time.Hour).Unix(),
+		})
+		token.Header["kid"] = "key"
+		idToken, err := token.SignedString(p.key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sendJSONResponse(w, http.StatusOK, map[string]string{"id_token": idToken})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// newOIDCTestServer serves the v1 API with the fake provider, named "fake".
+func newOIDCTestServer(t *testing.T, repo Repository, fake *fakeOIDCProvider) http.Handler {
+	t.Helper()
+	provider, err := oidc.Discover(context.Background(), oidc.Config{
+		Name:        "fake",
+		Issuer:      fake.URL,
+		ClientID:    "client",
+		RedirectURL: "https://shop.example.com/callback",
+	}, fake.Client())
+	if err != nil {
+		t.Fatalf("discovering provider: %v", err)
+	}
+	mux := chi.NewRouter()
+	AddRoutes(mux, repo, Config{Keys: newTestKeySet(), OIDCProviders: []*oidc.Provider{provider}})
+	return mux
+}
+
+// startOIDCSignIn starts a sign-in at the fake provider and returns the code and state to complete it with.
+func startOIDCSignIn(t *testing.T, srv http.Handler, fake *fakeOIDCProvider) (code, state string) {
+	t.Helper()
+	rec := serve(srv, http.MethodGet, "/auth/oidc/fake/authorize", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("authorize: status = %d: %s", rec.Code, rec.Body)
+	}
+	var res struct {
+		AuthorizationURL string `json:"authorization_url"`
+		State            string `json:"state"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	return fake.authorize(t, res.AuthorizationURL), res.State
+}
+
+func completeOIDCSignIn(srv http.Handler, code, state string) *httptest.ResponseRecorder {
+	body := fmt.Sprintf(`{"code":%q,"state":%q}`, code, state)
+	req := httptest.NewRequest(http.MethodPost, "/auth/oidc/fake/callback", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestOIDCSignInStateIsSingleUse(t *testing.T) {
+	fake := newFakeOIDCProvider(t, true)
+	repo := &oidcRepository{authRequests: make(map[string]model.OIDCAuthRequest)}
+	srv := newOIDCTestServer(t, repo, fake)
+
+	code, state := startOIDCSignIn(t, srv, fake)
+	if rec := completeOIDCSignIn(srv, code, state); rec.Code != http.StatusOK {
+		t.Fatalf("callback: status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if len(repo.signIns) != 1 || repo.signIns[0] != "user@example.com" {
+		t.Fatalf("signed in with %v, want [user@example.com]", repo.signIns)
+	}
+
+	// replaying the state fails even with a code the provider would redeem
+	replayCode, _ := startOIDCSignIn(t, srv, fake)
+	if rec := completeOIDCSignIn(srv, replayCode, state); rec.Code != http.StatusBadRequest {
+		t.Errorf("callback with a used state: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if len(repo.signIns) != 1 {
+		t.Errorf("signed in %d times, want 1", len(repo.signIns))
+	}
+}
+
+func TestOIDCSignInForwardsTheVerifierOfItsState(t *testing.T) {
+	fake := newFakeOIDCProvider(t, true)
+	repo := &oidcRepository{authRequests: make(map[string]model.OIDCAuthRequest)}
+	srv := newOIDCTestServer(t, repo, fake)
+
+	// a code issued for another sign-in is bound to another PKCE challenge, so the provider refuses it
+	code, _ := startOIDCSignIn(t, srv, fake)
+	_, state := startOIDCSignIn(t, srv, fake)
+	if rec := completeOIDCSignIn(srv, code, state); rec.Code != http.StatusUnauthorized {
+		t.Errorf("callback with the code of another sign-in: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if len(repo.signIns) != 0 {
+		t.Errorf("signed in with %v, want no sign-in", repo.signIns)
+	}
+}
+
+func TestOIDCSignInRequiresAVerifiedEmail(t *testing.T) {
+	fake := newFakeOIDCProvider(t, false)
+	repo := &oidcRepository{authRequests: make(map[string]model.OIDCAuthRequest)}
+	srv := newOIDCTestServer(t, repo, fake)
+
+	code, state := startOIDCSignIn(t, srv, fake)
+	if rec := completeOIDCSignIn(srv, code, state); rec.Code != http.StatusForbidden {
+		t.Errorf("callback with an unverified email: status = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	if len(repo.signIns) != 0 {
+		t.Errorf("unverified identity linked to %v, want no user", repo.signIns)
+	}
+}
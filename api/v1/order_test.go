@@ -0,0 +1,110 @@
+package v1
+
+import (
+	"fmt"
+	"instashop/api/model"
+	"net/http"
+	"testing"
+)
+
+// orderRepository holds orders in memory and scopes them to actors as the database repository does:
+// orders are visible to their owner and to actors granted the permission to see any order.
+type orderRepository struct {
+	Repository
+	owners map[uint]uint // order ID to user ID
+	actors []model.Actor // actors of the order operations, in call order
+}
+
+func (r *orderRepository) IsSessionActive(string) (bool, error) { return true, nil }
+
+func (r *orderRepository) visible(id uint, actor model.Actor, anyOrder model.Permission) error {
+	r.actors = append(r.actors, actor)
+	owner, ok := r.owners[id]
+	if !ok || (owner != actor.UserID && !actor.Can(anyOrder)) {
+		return fmt.Errorf("order not found: %w", model.ErrNotFound)
+	}
+	return nil
+}
+
+func (r *orderRepository) FetchOrderByID(id uint, actor model.Actor) (model.Order, error) {
+	if err := r.visible(id, actor, model.PermissionOrderReadAny); err != nil {
+		return model.Order{}, err
+	}
+	return model.Order{ID: id, UserID: r.owners[id], Status: model.OrderStatusPending}, nil
+}
+
+func (r *orderRepository) FetchOrderStatusHistory(id uint, actor model.Actor) ([]model.OrderStatusChange, error) {
+	if err := r.visible(id, actor, model.PermissionOrderReadAny); err != nil {
+		return nil, err
+	}
+	return []model.OrderStatusChange{{OrderID: id, ToStatus: model.OrderStatusPending}}, nil
+}
+
+func (r *orderRepository) CancelOrder(id uint, actor model.Actor) error {
+	return r.visible(id, actor, model.PermissionOrderCancelAny)
+}
+
+func TestOrdersOfOtherUsersAreNotFound(t *testing.T) {
+	const userA, userB, orderOfA = 1, 2, 10
+	keys := newTestKeySet()
+	repo := &orderRepository{owners: map[uint]uint{orderOfA: userA}}
+	srv := newTestServer(repo, keys)
+	tokenB := accessToken(t, keys, testUser(userB))
+
+	for _, tc := range []struct{ method, target string }{
+		{http.MethodGet, "/order/10"},
+		{http.MethodGet, "/order/10/history"},
+		{http.MethodPut, "/order/cancel?id=10"},
+	} {
+		t.Run(tc.method+" "+tc.target, func(t *testing.T) {
+			repo.actors = nil
+			rec := serve(srv, tc.method, tc.target, tokenB)
+			if rec.Code != http.StatusNotFound {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusNotFound, rec.Body)
+			}
+			if len(repo.actors) != 1 || repo.actors[0].UserID != userB || len(repo.actors[0].Permissions) != 0 {
+				t.Fatalf("repository called with actors %+v, want user %d without permissions", repo.actors, userB)
+			}
+		})
+	}
+}
+
+func TestOrdersOfOwnerAreFound(t *testing.T) {
+	const userA, orderOfA = 1, 10
+	keys := newTestKeySet()
+	srv := newTestServer(&orderRepository{owners: map[uint]uint{orderOfA: userA}}, keys)
+	tokenA := accessToken(t, keys, testUser(userA))
+
+	for _, target := range []string{"/order/10", "/order/10/history"} {
+		if rec := serve(srv, http.MethodGet, target, tokenA); rec.Code != http.StatusOK {
+			t.Errorf("GET %s: status = %d, want %d", target, rec.Code, http.StatusOK)
+		}
+	}
+	if rec := serve(srv, http.MethodPut, "/order/cancel?id=10", tokenA); rec.Code != http.StatusOK {
+		t.Errorf("PUT /order/cancel: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestOrderReadAnyPermissionGrantsAccess(t *testing.T) {
+	const userA, staff, orderOfA = 1, 3, 10
+	keys := newTestKeySet()
+	repo := &orderRepository{owners: map[uint]uint{orderOfA: userA}}
+	srv := newTestServer(repo, keys)
+	token := accessToken(t, keys, testUser(staff, model.PermissionOrderReadAny))
+
+	for _, target := range []string{"/order/10", "/order/10/history", "/admin/orders/10/history"} {
+		repo.actors = nil
+		rec := serve(srv, http.MethodGet, target, token)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: status = %d, want %d: %s", target, rec.Code, http.StatusOK, rec.Body)
+		}
+		if len(repo.actors) != 1 || !repo.actors[0].Can(model.PermissionOrderReadAny) {
+			t.Fatalf("GET %s: repository called with actors %+v, want one granted %s", target, repo.actors, model.PermissionOrderReadAny)
+		}
+	}
+
+	// reading any order does not allow cancelling it
+	if rec := serve(srv, http.MethodPut, "/order/cancel?id=10", token); rec.Code != http.StatusNotFound {
+		t.Errorf("PUT /order/cancel: status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
@@ -1,28 +1,237 @@
 package v1
 
 import (
+	"context"
 	"instashop/api/model"
+	"instashop/mail"
+	"time"
 )
 
+// Mailer delivers emails to users.
+type Mailer interface {
+	Send(msg mail.Message) error
+}
+
+// BlobStore stores uploaded files, such as product images, under slash-separated keys.
+// Deleting a missing blob is not an error.
+type BlobStore interface {
+	Put(ctx context.Context, key, contentType string, data []byte) error
+	Delete(ctx context.Context, key string) error
+	// URL returns the address clients download the blob of key from.
+	URL(key string) string
+}
+
 // Repository provides a data storage client to manipulate data on a given database server.
 //
 // Concrete implementations of Repository should wrap errors generated
 // as a result of wrong data input from user with api.ErrInvalidUserInput
 // to enable handlers propagate the errors effectively.
+// Errors caused by references to nonexistent resources may be wrapped with model.ErrNotFound instead,
+// which itself wraps model.ErrInvalidUserInput.
 // Errors not wrapped with api.ErrInvalidUserInput will be considered an internal error
 type Repository interface {
+	// ValidateCredentials returns the user matching email and password.
+	// It may reject users whose email is not verified with model.ErrEmailNotVerified.
 	ValidateCredentials(email, password string) (model.User, error)
 	Register(email, password string) (uint, error)
-	FetchAllProducts() ([]model.Product, error)
+	FetchUserByEmail(email string) (model.User, error)
+
+	// CreateUserToken stores the hash of a single-use token, invalidating earlier unused tokens issued to the user for purpose.
+	CreateUserToken(userID uint, purpose model.TokenPurpose, tokenHash string, expiresAt time.Time) error
+
+	// VerifyEmail and ResetPassword consume the token identified by tokenHash.
+	// Unknown, expired and used tokens are rejected with model.ErrInvalidUserInput.
+	VerifyEmail(tokenHash string) error
+
+	// ResetPassword also revokes every session of the user.
+	ResetPassword(tokenHash, newPassword string) error
+
+	FetchUserByID(id uint) (model.User, error)
+
+	// SetMFASecret stores a pending TOTP secret; it fails with model.ErrInvalidUserInput if MFA is already enabled.
+	SetMFASecret(userID uint, secret string) error
+
+	// EnableMFA activates the pending secret, records step as the last accepted TOTP step and replaces the recovery codes.
+	EnableMFA(userID uint, step int64, recoveryCodeHashes []string) error
+	DisableMFA(userID uint) error
+
+	// ConsumeMFAStep records step as the last accepted TOTP step,
+	// reporting false if that step or a later one was already accepted (i.e. the code is being replayed).
+	ConsumeMFAStep(userID uint, step int64) (bool, error)
+
+	// UseRecoveryCode marks a recovery code as used; unknown or used codes yield model.ErrInvalidUserInput.
+	UseRecoveryCode(userID uint, codeHash string) error
+	ReplaceRecoveryCodes(userID uint, codeHashes []string) error
+
+	// FetchLoginLockout returns the latest time until which any of keys is locked out, or the zero time.
+	FetchLoginLockout(keys ...string) (time.Time, error)
+
+	// RecordFailedLogin counts a failed login against key, locking it out as dictated by policy.
+	RecordFailedLogin(key string, policy model.LoginThrottlePolicy) (lockedUntil time.Time, err error)
+	ResetLoginFailures(key string) error
+	FetchUserEmail(userID uint) (string, error)
+
+	// ListUsers returns a page of the users matching filter and the total number of matching users.
+	ListUsers(filter model.UserFilter) ([]model.User, int64, error)
+
+	// DisableUser disables an account, ending its sessions and impersonations.
+	// Disabling the last administrator yields model.ErrInvalidUserInput.
+	DisableUser(userID uint) error
+	EnableUser(userID uint) error
+
+	// GrantRole and RevokeRole grant and revoke a single role. Unknown roles yield model.ErrNotFound,
+	// and revoking the admin role from the last administrator yields model.ErrInvalidUserInput.
+	GrantRole(userID uint, role string) (model.User, error)
+	RevokeRole(userID uint, role string) (model.User, error)
+
+	// ForcePasswordReset invalidates the password and sessions of userID and returns the user.
+	ForcePasswordReset(userID uint) (model.User, error)
+
+	// UpdateProfile sets the name and phone number of a user, leaving nil values unchanged, and returns the updated user.
+	UpdateProfile(userID uint, name, phone *string) (model.User, error)
+
+	// RequestEmailChange records newEmail as pending for userID and stores the hash of the token confirming it.
+	// A wrong password yields model.ErrInvalidPassword and a taken email model.ErrEmailInUse.
+	RequestEmailChange(userID uint, password, newEmail, tokenHash string, expiresAt time.Time) error
+	ConfirmEmailChange(tokenHash string) error
+
+	// ChangePassword replaces the password of userID and revokes every session except keepSessionID.
+	// A wrong current password yields model.ErrInvalidPassword.
+	ChangePassword(userID uint, currentPassword, newPassword, keepSessionID string) error
+
+	// DeleteAccount anonymises and deletes the account of userID. A wrong password yields model.ErrInvalidPassword,
+	// and deleting the last administrator model.ErrInvalidUserInput.
+	DeleteAccount(userID uint, password string) error
+
+	CreateOIDCAuthRequest(req model.OIDCAuthRequest) error
+
+	// ConsumeOIDCAuthRequest deletes and returns a pending sign-in at provider.
+	// Unknown, expired and already consumed requests yield model.ErrInvalidUserInput.
+	ConsumeOIDCAuthRequest(provider, stateHash string) (model.OIDCAuthRequest, error)
+
+	// SignInWithExternalIdentity returns the user linked to an identity at an external provider,
+	// linking it to the user registered with the verified email, or a new user, on first use.
+	SignInWithExternalIdentity(provider, subject, email string) (model.User, error)
+
+	// CreateImpersonation stores a new impersonation, filling in its ID.
+	CreateImpersonation(imp *model.Impersonation) error
+	FetchImpersonation(id string) (model.Impersonation, error)
+	EndImpersonation(id string) error
+	RecordAuditLogEntry(entry model.AuditLogEntry) error
+	FetchAuditLog(impersonationID string) ([]model.AuditLogEntry, error)
+
+	// BeginIdempotentRequest claims an idempotency key within its scope,
+	// or returns the existing record with claimed set to false if the key is already in use.
+	// A key held for longer than lease by a request that did not complete is claimed again for the same request.
+	BeginIdempotentRequest(record model.IdempotencyKey, lease time.Duration) (existing model.IdempotencyKey, claimed bool, err error)
+	CompleteIdempotentRequest(id uint, status int, contentType string, body []byte) error
+	ReleaseIdempotencyKey(id uint) error
+
+	CreateAPIKey(key *model.APIKey) error
+	ListAPIKeys() ([]model.APIKey, error)
+	RevokeAPIKey(id uint) error
+
+	// AuthenticateAPIKey returns the API key identified by prefix if it matches keyHash and is neither revoked nor expired.
+	// Invalid keys yield model.ErrInvalidUserInput.
+	AuthenticateAPIKey(prefix, keyHash string) (model.APIKey, error)
+
+	// CreateSession starts a login session for userID with its first refresh token,
+	// returning the session id. Refresh tokens are identified by their hash only.
+	CreateSession(userID uint, refreshTokenHash string, expiresAt time.Time) (sessionID string, err error)
+
+	// RotateRefreshToken marks the refresh token identified by oldHash as used and issues newHash in its place.
+	// Replaying a used refresh token revokes its whole session and yields model.ErrRefreshTokenReused.
+	RotateRefreshToken(oldHash, newHash string, expiresAt time.Time) (user model.User, sessionID string, err error)
+	RevokeSession(sessionID string, userID uint) error
+	RevokeAllSessions(userID uint) error
+	IsSessionActive(sessionID string) (bool, error)
+
+	// ListProducts returns a page of the products matching query, with the position of its last product
+	// if more products follow.
+	ListProducts(query model.ProductQuery) (model.ProductPage, error)
+	// SearchProducts runs a full-text search of the catalog. Searches without terms yield model.ErrInvalidUserInput.
+	SearchProducts(search model.ProductSearch) ([]model.ProductSearchResult, error)
 	FetchProductByID(id uint) (model.Product, error)
 	CreateProduct(product model.Product) (id uint, err error)
+
+	ListCategoryTree() ([]model.Category, error)
+	// FetchCategoryBySlug returns a category with its breadcrumbs and direct children.
+	FetchCategoryBySlug(slug string) (model.Category, error)
+	CreateCategory(category *model.Category) error
+	UpdateCategory(category *model.Category) error
+	// MoveCategory moves a category and its subtree under move.ParentID.
+	// Moves that would make a category its own ancestor yield model.ErrInvalidUserInput.
+	MoveCategory(id uint, move model.CategoryMove) (model.Category, error)
+	DeleteCategory(id uint) error
+	SetProductCategories(productID uint, categoryIDs []uint) (model.Product, error)
+
+	// GenerateVariants sets the options of a product and generates a variant per combination of option values,
+	// keeping the variants of existing combinations.
+	GenerateVariants(productID uint, matrix model.VariantMatrix) (model.Product, error)
+	UpdateVariant(variant *model.ProductVariant) error
+
+	// AddProductImage appends an image to the gallery of a product, filling in its ID and position.
+	// Full galleries yield model.ErrInvalidUserInput.
+	AddProductImage(image *model.ProductImage) error
+	// ReorderProductImages orders the gallery of a product as listed by imageIDs, which must list each image once.
+	ReorderProductImages(productID uint, imageIDs []uint) ([]model.ProductImage, error)
+	// DeleteProductImage removes an image from the gallery of a product and returns it.
+	DeleteProductImage(productID, imageID uint) (model.ProductImage, error)
+
 	UpdateProduct(product model.Product) error
-	UpdateOrderStatus(status model.OrderStatus, orderID uint) error
-	DeleteProduct(id uint) error
+
+	// UpdateOrderStatus moves an order to status if the order state machine allows it.
+	// Disallowed transitions yield a *model.InvalidStatusTransitionError and
+	// unknown orders an error wrapping model.ErrNotFound.
+	// Every change is recorded in the order status history with actorID and the optional note.
+	UpdateOrderStatus(status model.OrderStatus, orderID, actorID uint, note string) error
+	// DeleteProduct deletes a product and its images, returning the images whose blobs are to be deleted.
+	DeleteProduct(id uint) ([]model.ProductImage, error)
 	FetchUserOrders(userID uint) ([]model.Order, error)
-	FetchOrderByID(id uint) (model.Order, error)
+
+	// FetchOrderByID, CancelOrder and FetchOrderStatusHistory only operate on orders owned by actor,
+	// unless actor has been granted model.PermissionOrderReadAny (or model.PermissionOrderCancelAny for cancellation). Orders not visible to actor are reported as model.ErrNotFound
+	// so that callers cannot probe for the existence of other users' orders.
+	FetchOrderByID(id uint, actor model.Actor) (model.Order, error)
 
 	// CancelOrder updates the order status to "Cancelled" if the order is in a "Pending" state
-	CancelOrder(id uint) error
-	CreateOrder(order model.Order) (id uint, err error)
+	// and returns the order's reserved stock to inventory
+	CancelOrder(id uint, actor model.Actor) error
+
+	// CreateOrder places a new order for userID, snapshotting product prices into the
+	// order items and computing the order total server-side.
+	// Stock is reserved atomically; a *model.OutOfStockError is returned if any product lacks stock.
+	// The selected addresses are snapshotted into the order.
+	CreateOrder(userID uint, items []model.OrderItemInput, addresses model.AddressSelection) (model.Order, error)
+
+	// FetchCart returns the cart of owner with its products loaded; a user without a cart gets an empty one.
+	FetchCart(owner model.CartOwner) (model.Cart, error)
+	CreateAnonymousCart(tokenHash string) error
+
+	// AddCartItem and SetCartItemQuantity check the stock of the product, or of its variant variantID,
+	// returning a *model.OutOfStockError if it is insufficient. Products with variants require a variant.
+	AddCartItem(owner model.CartOwner, productID, variantID uint, quantity int) error
+	SetCartItemQuantity(owner model.CartOwner, productID, variantID uint, quantity int) error
+	ClearCart(owner model.CartOwner) error
+
+	// MergeCarts moves the anonymous cart identified by tokenHash into the cart of userID.
+	MergeCarts(tokenHash string, userID uint) error
+
+	// CheckoutCart places an order for the cart of userID as CreateOrder does and empties the cart, atomically.
+	CheckoutCart(userID uint, addresses model.AddressSelection) (model.Order, error)
+
+	ListAddresses(userID uint) ([]model.Address, error)
+	FetchAddress(id, userID uint) (model.Address, error)
+	CreateAddress(address *model.Address) error
+	UpdateAddress(address *model.Address) error
+	DeleteAddress(id, userID uint) error
+
+	// FetchOrderStatusHistory returns every status change of an order, oldest first
+	FetchOrderStatusHistory(orderID uint, actor model.Actor) ([]model.OrderStatusChange, error)
+
+	ListRoles() ([]model.Role, error)
+
+	// SetUserRoles replaces the roles of a user with the named roles, returning the updated user.
+	// Unknown role names are rejected with model.ErrInvalidUserInput.
+	SetUserRoles(userID uint, roles []string) (model.User, error)
 }
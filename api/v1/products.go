@@ -0,0 +1,207 @@
+package v1
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"instashop/api/model"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sendProductPage responds with the page of products selected by query.
+// The cursor of the next page is returned in the next_cursor field and a Link header.
+func sendProductPage(w http.ResponseWriter, r *http.Request, repo Repository, query model.ProductQuery) {
+	page, err := repo.ListProducts(query)
+	if err != nil {
+		if errors.Is(err, model.ErrInvalidUserInput) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Error fetching products: %v", err)
+		http.Error(w, "Failed to fetch products", http.StatusInternalServerError)
+		return
+	}
+
+	var nextCursor string
+	if page.Next != nil {
+		if nextCursor, err = encodeProductCursor(query.Sort, *page.Next); err != nil {
+			log.Printf("Error encoding product cursor: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+		next := *r.URL
+		q := next.Query()
+		q.Set("cursor", nextCursor)
+		next.RawQuery = q.Encode()
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.RequestURI()))
+	}
+
+	sendJSONResponse(w, http.StatusOK, map[string]interface{}{
+		"products":    page.Products,
+		"next_cursor": nextCursor,
+	})
+}
+
+// productCursor is the content of the opaque cursors of product listings.
+// It records the sort of the listing, since a position is only meaningful in the order it was taken from.
+type productCursor struct {
+	Sort string `json:"s"`
+	model.ProductCursor
+}
+
+// encodeProductCursor returns the opaque cursor of position in a listing sorted by sorts.
+func encodeProductCursor(sorts []model.ProductSort, position model.ProductCursor) (string, error) {
+	b, err := json.Marshal(productCursor{Sort: productSortString(sorts), ProductCursor: position})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// decodeProductCursor parses a cursor returned by encodeProductCursor for a listing sorted by sorts.
+func decodeProductCursor(cursor string, sorts []model.ProductSort) (model.ProductCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return model.ProductCursor{}, errors.New("Invalid cursor")
+	}
+	var c productCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return model.ProductCursor{}, errors.New("Invalid cursor")
+	}
+	if c.Sort != productSortString(sorts) {
+		return model.ProductCursor{}, errors.New("Cursor was issued for a different sort")
+	}
+	return c.ProductCursor, nil
+}
+
+func productSortString(sorts []model.ProductSort) string {
+	parts := make([]string, 0, len(sorts))
+	for _, s := range sorts {
+		parts = append(parts, s.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+// productQuery parses the query parameters of product listings:
+//   - the filters of productFilter,
+//   - sort lists the fields to sort by, e.g. "-price,name" for the most expensive first, then by name,
+//   - limit is the page size and cursor the next_cursor of the previous page.
+//
+// Filters and sort must be repeated with the cursor; the Link header of a page does so.
+func productQuery(r *http.Request) (model.ProductQuery, error) {
+	q := r.URL.Query()
+	filter, err := productFilter(q)
+	if err != nil {
+		return model.ProductQuery{}, err
+	}
+	query := model.ProductQuery{ProductFilter: filter}
+
+	if query.Sort, err = model.ParseProductSorts(q.Get("sort")); err != nil {
+		return query, errors.New("Invalid sort, expected a comma separated list of name, price, created_at " +
+			"or updated_at, each optionally prefixed with - to sort in descending order")
+	}
+	if query.Limit, err = intQuery(q.Get("limit")); err != nil {
+		return query, errors.New("Invalid limit")
+	}
+	if cursor := q.Get("cursor"); cursor != "" {
+		after, err := decodeProductCursor(cursor, query.Sort)
+		if err != nil {
+			return query, err
+		}
+		query.After = &after
+	}
+	return query, nil
+}
+
+// productFilter parses the category, name_prefix, min_price, max_price, in_stock and created_/updated_after/before
+// query parameters filtering products.
+func productFilter(q url.Values) (model.ProductFilter, error) {
+	filter := model.ProductFilter{Category: q.Get("category"), NamePrefix: q.Get("name_prefix")}
+
+	var err error
+	if filter.MinPrice, err = floatQuery(q.Get("min_price")); err != nil {
+		return filter, errors.New("Invalid min_price")
+	}
+	if filter.MaxPrice, err = floatQuery(q.Get("max_price")); err != nil {
+		return filter, errors.New("Invalid max_price")
+	}
+	if v := q.Get("in_stock"); v != "" {
+		inStock, err := strconv.ParseBool(v)
+		if err != nil {
+			return filter, errors.New("Invalid in_stock, expected true or false")
+		}
+		filter.InStock = &inStock
+	}
+	for _, p := range []struct {
+		name  string
+		value **time.Time
+	}{
+		{"created_after", &filter.CreatedAfter},
+		{"created_before", &filter.CreatedBefore},
+		{"updated_after", &filter.UpdatedAfter},
+		{"updated_before", &filter.UpdatedBefore},
+	} {
+		if *p.value, err = timeQuery(q.Get(p.name)); err != nil {
+			return filter, errors.New("Invalid " + p.name + ", expected an RFC 3339 date-time")
+		}
+	}
+	return filter, nil
+}
+
+// searchProducts runs a full-text search of the catalog given by the q query parameter, best matches first.
+// Results can be narrowed with the filters of productFilter and are paged with page and per_page.
+func searchProducts(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		filter, err := productFilter(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		search := model.ProductSearch{ProductFilter: filter, Query: q.Get("q")}
+		if search.Page, err = intQuery(q.Get("page")); err != nil {
+			http.Error(w, "Invalid page", http.StatusBadRequest)
+			return
+		}
+		if search.PerPage, err = intQuery(q.Get("per_page")); err != nil {
+			http.Error(w, "Invalid per_page", http.StatusBadRequest)
+			return
+		}
+
+		results, err := repo.SearchProducts(search)
+		if err != nil {
+			if errors.Is(err, model.ErrInvalidUserInput) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Printf("Error searching products: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, map[string]interface{}{
+			"results": results,
+		})
+	}
+}
+
+func floatQuery(v string) (*float64, error) {
+	if v == "" {
+		return nil, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return nil, err
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, errors.New("not a finite number")
+	}
+	return &f, nil
+}
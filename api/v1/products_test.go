@@ -0,0 +1,55 @@
+package v1
+
+import (
+	"encoding/json"
+	"instashop/api/model"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// productPageRepository returns a single product on every page, with a next page, and records the queries.
+type productPageRepository struct {
+	Repository
+	queries []model.ProductQuery
+}
+
+func (r *productPageRepository) ListProducts(query model.ProductQuery) (model.ProductPage, error) {
+	r.queries = append(r.queries, query)
+	product := model.Product{ID: 7, Name: "Lamp", Price: 20}
+	next := model.CursorOf(product)
+	return model.ProductPage{Products: []model.Product{product}, Next: &next}, nil
+}
+
+func TestProductCursorsAreBoundToTheirSort(t *testing.T) {
+	repo := &productPageRepository{}
+	srv := newTestServer(repo, newTestKeySet())
+
+	rec := serve(srv, http.MethodGet, "/products?sort=-price,name&limit=1", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("first page: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var page struct {
+		NextCursor string `json:"next_cursor"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&page); err != nil || page.NextCursor == "" {
+		t.Fatalf("first page: next_cursor = %q (%v), want a cursor", page.NextCursor, err)
+	}
+	cursor := url.QueryEscape(page.NextCursor)
+
+	for _, sort := range []string{"name", "price,name", "-price", ""} {
+		if rec := serve(srv, http.MethodGet, "/products?sort="+sort+"&cursor="+cursor, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("cursor of -price,name with sort %q: status = %d, want %d", sort, rec.Code, http.StatusBadRequest)
+		}
+	}
+	if len(repo.queries) != 1 {
+		t.Fatalf("listed %d pages, want only the first", len(repo.queries))
+	}
+
+	if rec := serve(srv, http.MethodGet, "/products?sort=-price,name&cursor="+cursor, ""); rec.Code != http.StatusOK {
+		t.Fatalf("second page: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if after := repo.queries[1].After; after == nil || after.ID != 7 || after.Price != 20 || after.Name != "Lamp" {
+		t.Errorf("second page starts after %+v, want the last product of the first page", after)
+	}
+}
@@ -3,38 +3,257 @@ package v1
 import (
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"instashop/api/model"
+	"instashop/oidc"
 	"net/http"
+	"strings"
+	"time"
 )
 
-func AddRoutes(mux *chi.Mux, repo Repository) {
-	mux.Use(middleware.AllowContentType("application/json"))
-	mux.Use(authMiddleware)
+// Config holds the dependencies and settings of the v1 API besides its Repository.
+type Config struct {
+	// Keys signs and verifies access tokens.
+	Keys *KeySet
 
-	mux.Mount("/", adminRoutes(repo))
-	mux.Mount("/auth", authenticationRoutes(repo))
-	mux.Mount("/order", orderRoutes(repo))
+	// Mailer sends account emails, with links pointing to the storefront at AppURL.
+	Mailer Mailer
+	AppURL string
+
+	// RequireStaffMFA forces two-factor authentication on every user granted a permission.
+	RequireStaffMFA bool
+
+	// OIDCProviders are the external identity providers users can sign in with.
+	OIDCProviders []*oidc.Provider
+
+	// IdempotencyKeyTTL is how long responses to requests with an Idempotency-Key header are kept for replay.
+	// It defaults to 24 hours.
+	IdempotencyKeyTTL time.Duration
+
+	// Blobs stores product images. Stores that are also an http.Handler, such as the local filesystem store,
+	// serve their blobs under /media.
+	Blobs BlobStore
+
+	// MaxImageSize is the size in bytes images uploaded may not exceed. It defaults to 10 MiB.
+	MaxImageSize int64
+}
+
+// AddRoutes registers the v1 API on mux.
+//
+// Routes are split into four groups:
+//   - public routes (authentication, the read-only product catalog and categories, and media) that require no token,
+//   - the cart, which works anonymously with a cart token or for an authenticated user,
+//   - customer routes that require a valid token,
+//   - admin routes under /admin that additionally require the permissions granted by staff roles.
+//     They are the only routes accepting API keys, whose scopes are permissions.
+//
+// Mutating requests of the cart, customer and admin routes can carry an Idempotency-Key header.
+// Authentication routes do not support it, since their responses carry credentials that must not be stored.
+func AddRoutes(mux *chi.Mux, repo Repository, cfg Config) {
+	keys := cfg.Keys
+	idempotent := idempotencyMiddleware(repo, cfg.IdempotencyKeyTTL, maxUploadSize(cfg.MaxImageSize))
+	accountMail := accountMailer{mailer: cfg.Mailer, appURL: strings.TrimSuffix(cfg.AppURL, "/")}
+
+	// multipart forms carry uploaded images
+	mux.Use(middleware.AllowContentType("application/json", "multipart/form-data"))
+
+	// public
+	mux.Get("/.well-known/jwks.json", getJWKS(keys))
+	mux.Mount("/auth", authenticationRoutes(repo, keys, accountMail, newOIDCProviders(cfg.OIDCProviders), cfg.RequireStaffMFA))
+	mux.Mount("/products", catalogRoutes(repo, cfg.Blobs))
+	mux.Mount("/categories", categoryRoutes(repo))
+	if media, ok := cfg.Blobs.(http.Handler); ok {
+		mux.Mount("/media", http.StripPrefix("/media", media))
+	}
+
+	// anonymous or authenticated
+	mux.Group(func(r chi.Router) {
+		r.Use(optionalAuthMiddleware(repo, keys))
+		r.Use(idempotent)
+
+		r.Mount("/cart", cartRoutes(repo))
+	})
+
+	// authenticated
+	mux.Group(func(r chi.Router) {
+		r.Use(authMiddleware(repo, keys))
+		r.Use(idempotent)
+
+		r.Mount("/me", accountRoutes(repo, accountMail))
+		r.Mount("/order", orderRoutes(repo))
+	})
+
+	// authenticated, by a token or an API key; every admin route requires a permission
+	mux.Group(func(r chi.Router) {
+		r.Use(apiKeyAuthMiddleware(repo, keys))
+		r.Use(idempotent)
+
+		r.Mount("/admin", adminRoutes(repo, keys, accountMail, cfg.Blobs, cfg.MaxImageSize))
+	})
 }
 
-func authenticationRoutes(repo Repository) http.Handler {
+func authenticationRoutes(repo Repository, keys *KeySet, mailer accountMailer, providers oidcProviders, requireStaffMFA bool) http.Handler {
 	r := chi.NewRouter()
-	r.Post("/login", login(repo))
-	r.Post("/register", register(repo))
+	r.Post("/login", login(repo, keys, requireStaffMFA))
+	r.Post("/register", register(repo, mailer))
+	r.Post("/refresh", refresh(repo, keys))
+
+	r.Post("/verify-email", verifyEmail(repo))
+	r.Post("/resend-verification", resendVerification(repo, mailer))
+	r.Post("/forgot-password", forgotPassword(repo, mailer))
+	r.Post("/reset-password", resetPassword(repo))
+	r.Post("/confirm-email", confirmEmailChange(repo))
+
+	// second step of a login requiring two-factor authentication, authenticated by the MFA challenge token
+	r.Post("/mfa/verify", verifyMFAChallenge(repo, keys))
+	r.Post("/mfa/challenge/enroll", enrollMFAChallenge(repo, keys))
+	r.Post("/mfa/challenge/activate", activateMFAChallenge(repo, keys))
+
+	// sign-in with external OpenID Connect providers
+	r.Get("/oidc", getOIDCProviders(providers))
+	r.Get("/oidc/{provider}/authorize", oidcAuthorize(repo, providers))
+	r.Post("/oidc/{provider}/callback", oidcCallback(repo, keys, providers, requireStaffMFA))
+
+	r.Group(func(r chi.Router) {
+		r.Use(authMiddleware(repo, keys))
+		r.Use(forbidImpersonation)
+
+		r.Post("/logout", logout(repo))
+		r.Post("/logout/all", logoutAll(repo))
+
+		r.Post("/mfa/enroll", enrollMFA(repo))
+		r.Post("/mfa/activate", activateMFA(repo))
+		r.Post("/mfa/disable", disableMFA(repo, requireStaffMFA))
+		r.Post("/mfa/recovery-codes", regenerateRecoveryCodes(repo))
+	})
+
 	return r
 }
 
-func adminRoutes(repo Repository) http.Handler {
+func cartRoutes(repo Repository) http.Handler {
 	r := chi.NewRouter()
+	r.Use(mergeAnonymousCart(repo))
+
+	r.Get("/", getCart(repo))
+	r.Delete("/", clearCart(repo))
+
+	r.Post("/items", addCartItem(repo))
+	r.Put("/items/{product_id}", updateCartItem(repo))
+	r.Delete("/items/{product_id}", removeCartItem(repo))
+
+	r.Post("/checkout", checkoutCart(repo))
+
+	return r
+}
+
+func accountRoutes(repo Repository, mailer accountMailer) http.Handler {
+	r := chi.NewRouter()
+
+	r.Get("/", getProfile(repo))
+	r.Patch("/", updateProfile(repo))
+
+	r.Get("/addresses", getAddresses(repo))
+	r.Get("/addresses/{id}", getAddressByID(repo))
+	r.Post("/addresses", createAddress(repo))
+	r.Put("/addresses/{id}", updateAddress(repo))
+	r.Delete("/addresses/{id}", deleteAddress(repo))
+
+	// changing credentials or deleting the account is never allowed while impersonating
+	r.Group(func(r chi.Router) {
+		r.Use(forbidImpersonation)
+
+		r.Put("/email", changeEmail(repo, mailer))
+		r.Put("/password", changePassword(repo))
+		r.Delete("/", deleteAccount(repo))
+	})
+
+	return r
+}
+
+func catalogRoutes(repo Repository, blobs BlobStore) http.Handler {
+	r := chi.NewRouter()
+
+	r.Get("/", getAllProducts(repo))
+	r.Get("/search", searchProducts(repo))
+	r.Get("/{id}", getProductByID(repo, blobs))
+
+	return r
+}
+
+func categoryRoutes(repo Repository) http.Handler {
+	r := chi.NewRouter()
+
+	r.Get("/", getCategories(repo))
+	r.Get("/{slug}", getCategory(repo))
+	r.Get("/{slug}/products", getCategoryProducts(repo))
+
+	return r
+}
+
+func adminRoutes(repo Repository, keys *KeySet, mailer accountMailer, blobs BlobStore, maxImageSize int64) http.Handler {
+	r := chi.NewRouter()
+	r.Use(forbidImpersonation)
+
+	r.Group(func(r chi.Router) {
+		r.Use(RequirePermission(model.PermissionProductWrite))
+
+		r.Get("/products", getAllProducts(repo))
+		r.Get("/products/{id}", getProductByID(repo, blobs))
+
+		r.Post("/products", createProduct(repo))
+
+		r.Put("/products/{id}", updateProduct(repo))
+		r.Delete("/products/{id}", deleteProduct(repo, blobs))
+		r.Put("/products/{id}/categories", setProductCategories(repo))
+		r.Post("/products/{id}/variants/generate", generateVariants(repo, blobs))
+		r.Put("/products/{id}/variants/{variant_id}", updateVariant(repo))
+		r.Post("/products/{id}/images", uploadProductImage(repo, blobs, maxImageSize))
+		r.Put("/products/{id}/images", reorderProductImages(repo, blobs))
+		r.Delete("/products/{id}/images/{image_id}", deleteProductImage(repo, blobs))
+
+		r.Post("/categories", createCategory(repo))
+		r.Put("/categories/{id}", updateCategory(repo))
+		r.Post("/categories/{id}/move", moveCategory(repo))
+		r.Delete("/categories/{id}", deleteCategory(repo))
+	})
+
+	r.With(RequirePermission(model.PermissionOrderStatusUpdate)).Put("/orders", updateOrderStatus(repo))
+	r.With(RequirePermission(model.PermissionOrderReadAny)).Get("/orders/{id}/history", getOrderStatusHistory(repo))
+
+	r.Group(func(r chi.Router) {
+		r.Use(RequirePermission(model.PermissionRoleAssign))
+
+		r.Get("/roles", getRoles(repo))
+		r.Put("/users/{id}/roles", setUserRoles(repo))
+		r.Put("/users/{id}/roles/{role}", grantRole(repo))
+		r.Delete("/users/{id}/roles/{role}", revokeRole(repo))
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(RequirePermission(model.PermissionUserManage))
+
+		r.Get("/users", getUsers(repo))
+		r.Get("/users/{id}", getUser(repo))
+		r.Post("/users/{id}/disable", disableUser(repo))
+		r.Post("/users/{id}/enable", enableUser(repo))
+		r.Post("/users/{id}/unlock", unlockUser(repo))
+		r.Post("/users/{id}/password-reset", forcePasswordReset(repo, mailer))
+	})
 
-	r.Use(adminOnlyMiddleware)
+	r.Group(func(r chi.Router) {
+		r.Use(RequirePermission(model.PermissionUserImpersonate))
 
-	r.Get("/products", getAllProducts(repo))
-	r.Get("/product/{id}", getProductByID(repo))
+		r.Post("/users/{id}/impersonate", impersonateUser(repo, keys))
+		r.Delete("/impersonations/{id}", endImpersonation(repo))
+	})
+	r.With(RequirePermission(model.PermissionUserManage)).Get("/impersonations/{id}/audit", getImpersonationAuditLog(repo))
 
-	r.Post("/product", createProduct(repo))
+	r.Group(func(r chi.Router) {
+		r.Use(RequirePermission(model.PermissionAPIKeyManage))
 
-	r.Put("/product/", updateProduct(repo))
-	r.Put("/orders", updateOrderStatus(repo))
-	r.Delete("/products", deleteProduct(repo))
+		r.Get("/api-keys", getAPIKeys(repo))
+		r.Post("/api-keys", createAPIKey(repo))
+		r.Delete("/api-keys/{id}", revokeAPIKey(repo))
+	})
 
 	return r
 }
@@ -44,6 +263,7 @@ func orderRoutes(repo Repository) http.Handler {
 
 	r.Get("/", getOrders(repo))
 	r.Get("/{id}", getOrderByID(repo))
+	r.Get("/{id}/history", getOrderStatusHistory(repo))
 
 	r.Put("/cancel", cancelOrder(repo))
 
@@ -0,0 +1,113 @@
+package v1
+
+import (
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"instashop/api/model"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// accountThrottlePolicy guards a single account against password guessing.
+	// It applies to unknown emails too, so lockouts do not reveal which emails are registered.
+	accountThrottlePolicy = model.LoginThrottlePolicy{
+		Threshold:   5,
+		BaseLockout: time.Minute,
+		MaxLockout:  time.Hour,
+		ResetAfter:  time.Hour,
+	}
+
+	// ipThrottlePolicy guards against a single client spraying passwords over many accounts.
+	ipThrottlePolicy = model.LoginThrottlePolicy{
+		Threshold:   20,
+		BaseLockout: time.Minute,
+		MaxLockout:  time.Hour,
+		ResetAfter:  time.Hour,
+	}
+)
+
+func accountThrottleKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipThrottleKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// allowLoginAttempt responds with 429 Too Many Requests and returns false
+// if either the account identified by email or the client is locked out.
+func allowLoginAttempt(w http.ResponseWriter, r *http.Request, repo Repository, email string) bool {
+	until, err := repo.FetchLoginLockout(accountThrottleKey(email), ipThrottleKey(r))
+	if err != nil {
+		log.Printf("Error checking login lockout: %v", err)
+		http.Error(w, "Login failed. Please try again", http.StatusInternalServerError)
+		return false
+	}
+	if until.IsZero() {
+		return true
+	}
+
+	retryAfter := int(math.Ceil(time.Until(until).Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	http.Error(w, "Too many failed login attempts. Try again later", http.StatusTooManyRequests)
+	return false
+}
+
+// recordLoginFailure counts a failed login attempt against the account identified by email and the client.
+func recordLoginFailure(r *http.Request, repo Repository, email string) {
+	if _, err := repo.RecordFailedLogin(accountThrottleKey(email), accountThrottlePolicy); err != nil {
+		log.Printf("Error recording failed login: %v", err)
+	}
+	if _, err := repo.RecordFailedLogin(ipThrottleKey(r), ipThrottlePolicy); err != nil {
+		log.Printf("Error recording failed login: %v", err)
+	}
+}
+
+// recordLoginSuccess clears the failed attempts of the account identified by email.
+// Failures of the client are left to expire, so that a valid account cannot be used to reset them.
+func recordLoginSuccess(repo Repository, email string) {
+	if err := repo.ResetLoginFailures(accountThrottleKey(email)); err != nil {
+		log.Printf("Error resetting failed logins: %v", err)
+	}
+}
+
+// unlockUser lifts the login lockout of a user account.
+func unlockUser(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		idStr := chi.URLParam(r, "id")
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+
+		email, err := repo.FetchUserEmail(uint(id))
+		if err != nil {
+			if errors.Is(err, model.ErrNotFound) {
+				http.Error(w, "User not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("Error fetching user: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := repo.ResetLoginFailures(accountThrottleKey(email)); err != nil {
+			log.Printf("Error unlocking user %d: %v", id, err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, nil)
+	}
+}
@@ -0,0 +1,240 @@
+package v1
+
+import (
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"instashop/api/model"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// userIDParam parses the {id} path parameter, responding with 400 Bad Request if it is invalid.
+func userIDParam(w http.ResponseWriter, r *http.Request) (uint, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil || id <= 0 {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// writeUserError responds to the errors of user management operations.
+func writeUserError(w http.ResponseWriter, err error, action string) {
+	if errors.Is(err, model.ErrNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, model.ErrInvalidUserInput) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	log.Printf("Error %s: %v", action, err)
+	http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+}
+
+// authorizeUserManagement fetches the user of id and reports whether the actor may manage it, writing an error otherwise.
+func authorizeUserManagement(repo Repository, w http.ResponseWriter, r *http.Request, id uint) bool {
+	user, err := repo.FetchUserByID(id)
+	if err != nil {
+		writeUserError(w, err, "fetching user")
+		return false
+	}
+	if !actorFromContext(r).CanManage(user) {
+		http.Error(w, "Cannot manage a user with permissions you do not hold", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// getUsers pages through users, optionally filtered by email substring, role, creation date and disabled state.
+func getUsers(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		filter := model.UserFilter{
+			Email: q.Get("email"),
+			Role:  q.Get("role"),
+		}
+
+		var err error
+		if filter.Page, err = intQuery(q.Get("page")); err != nil {
+			http.Error(w, "Invalid page", http.StatusBadRequest)
+			return
+		}
+		if filter.PerPage, err = intQuery(q.Get("per_page")); err != nil {
+			http.Error(w, "Invalid per_page", http.StatusBadRequest)
+			return
+		}
+		if filter.CreatedAfter, err = timeQuery(q.Get("created_after")); err != nil {
+			http.Error(w, "Invalid created_after, expected an RFC 3339 date-time", http.StatusBadRequest)
+			return
+		}
+		if filter.CreatedBefore, err = timeQuery(q.Get("created_before")); err != nil {
+			http.Error(w, "Invalid created_before, expected an RFC 3339 date-time", http.StatusBadRequest)
+			return
+		}
+		if v := q.Get("disabled"); v != "" {
+			disabled, err := strconv.ParseBool(v)
+			if err != nil {
+				http.Error(w, "Invalid disabled, expected true or false", http.StatusBadRequest)
+				return
+			}
+			filter.Disabled = &disabled
+		}
+
+		users, total, err := repo.ListUsers(filter)
+		if err != nil {
+			log.Printf("Error fetching users: %v", err)
+			http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, map[string]interface{}{
+			"users": users,
+			"total": total,
+		})
+	}
+}
+
+func getUser(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := userIDParam(w, r)
+		if !ok {
+			return
+		}
+
+		user, err := repo.FetchUserByID(id)
+		if err != nil {
+			writeUserError(w, err, "fetching user")
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, user)
+	}
+}
+
+// disableUser disables an account, logging the user out everywhere. Admins cannot disable themselves,
+// nor staff holding permissions they do not hold.
+func disableUser(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := userIDParam(w, r)
+		if !ok {
+			return
+		}
+		if id == actorFromContext(r).UserID {
+			http.Error(w, "Cannot disable your own account", http.StatusBadRequest)
+			return
+		}
+		if !authorizeUserManagement(repo, w, r, id) {
+			return
+		}
+
+		if err := repo.DisableUser(id); err != nil {
+			writeUserError(w, err, "disabling user")
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, nil)
+	}
+}
+
+func enableUser(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := userIDParam(w, r)
+		if !ok {
+			return
+		}
+
+		if err := repo.EnableUser(id); err != nil {
+			writeUserError(w, err, "enabling user")
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, nil)
+	}
+}
+
+// grantRole grants the role named in the path to a user, e.g. admin.
+func grantRole(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := userIDParam(w, r)
+		if !ok {
+			return
+		}
+
+		user, err := repo.GrantRole(id, chi.URLParam(r, "role"))
+		if err != nil {
+			writeUserError(w, err, "granting role")
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, user)
+	}
+}
+
+// revokeRole revokes the role named in the path from a user. The last administrator cannot lose the admin role.
+func revokeRole(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := userIDParam(w, r)
+		if !ok {
+			return
+		}
+
+		user, err := repo.RevokeRole(id, chi.URLParam(r, "role"))
+		if err != nil {
+			writeUserError(w, err, "revoking role")
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, user)
+	}
+}
+
+// forcePasswordReset invalidates a user's password and sessions and emails them a password reset link.
+// Staff holding permissions the admin does not hold are refused, as for disableUser.
+func forcePasswordReset(repo Repository, mailer accountMailer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := userIDParam(w, r)
+		if !ok {
+			return
+		}
+
+		if !authorizeUserManagement(repo, w, r, id) {
+			return
+		}
+
+		user, err := repo.ForcePasswordReset(id)
+		if err != nil {
+			writeUserError(w, err, "forcing password reset")
+			return
+		}
+
+		if err := issuePasswordReset(repo, mailer, user.Email); err != nil {
+			// the password is already invalidated, so the user can still request another reset email
+			log.Printf("Error sending password reset to user %d: %v", user.ID, err)
+			http.Error(w, "Password invalidated, but the reset email could not be sent", http.StatusInternalServerError)
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, nil)
+	}
+}
+
+func intQuery(v string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(v)
+}
+
+func timeQuery(v string) (*time.Time, error) {
+	if v == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
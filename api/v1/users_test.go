@@ -0,0 +1,66 @@
+package v1
+
+import (
+	"fmt"
+	"instashop/api/model"
+	"net/http"
+	"testing"
+)
+
+// userRepository holds users in memory and records the users disabled.
+type userRepository struct {
+	Repository
+	users    map[uint]model.User
+	disabled []uint
+}
+
+func (r *userRepository) IsSessionActive(string) (bool, error) { return true, nil }
+
+func (r *userRepository) FetchUserByID(id uint) (model.User, error) {
+	user, ok := r.users[id]
+	if !ok {
+		return model.User{}, fmt.Errorf("user not found: %w", model.ErrNotFound)
+	}
+	return user, nil
+}
+
+func (r *userRepository) DisableUser(id uint) error {
+	r.disabled = append(r.disabled, id)
+	return nil
+}
+
+func (r *userRepository) ForcePasswordReset(id uint) (model.User, error) {
+	return model.User{}, fmt.Errorf("unexpected password reset of user %d", id)
+}
+
+func TestStaffCannotManageMorePrivilegedUsers(t *testing.T) {
+	const customer, admin, support, roleAssigner = 1, 2, 3, 4
+	keys := newTestKeySet()
+	repo := &userRepository{users: map[uint]model.User{
+		customer:     testUser(customer),
+		admin:        testUser(admin, model.AllPermissions...),
+		support:      testUser(support, model.BuiltinRoles[model.RoleSupport]...),
+		roleAssigner: testUser(roleAssigner, model.PermissionUserManage, model.PermissionRoleAssign),
+	}}
+	srv := newTestServer(repo, keys)
+	supportToken := accessToken(t, keys, repo.users[support])
+
+	for _, target := range []string{"/admin/users/2/disable", "/admin/users/2/password-reset"} {
+		if rec := serve(srv, http.MethodPost, target, supportToken); rec.Code != http.StatusForbidden {
+			t.Errorf("POST %s by support: status = %d, want %d: %s", target, rec.Code, http.StatusForbidden, rec.Body)
+		}
+	}
+	if len(repo.disabled) != 0 {
+		t.Fatalf("disabled users %v, want none", repo.disabled)
+	}
+
+	if rec := serve(srv, http.MethodPost, "/admin/users/1/disable", supportToken); rec.Code != http.StatusOK {
+		t.Errorf("disabling a customer by support: status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if rec := serve(srv, http.MethodPost, "/admin/users/2/disable", accessToken(t, keys, repo.users[roleAssigner])); rec.Code != http.StatusOK {
+		t.Errorf("disabling an admin with %s: status = %d, want %d: %s", model.PermissionRoleAssign, rec.Code, http.StatusOK, rec.Body)
+	}
+	if len(repo.disabled) != 2 || repo.disabled[0] != customer || repo.disabled[1] != admin {
+		t.Errorf("disabled users %v, want [%d %d]", repo.disabled, customer, admin)
+	}
+}
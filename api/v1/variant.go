@@ -0,0 +1,97 @@
+package v1
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"instashop/api/model"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// generateVariants sets the options of a product, e.g. size and colour with their values,
+// and generates a variant for every combination of their values.
+// Regenerating keeps the SKU, price and stock of the variants whose combination remains.
+func generateVariants(repo Repository, blobs BlobStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil || id <= 0 {
+			http.Error(w, "Invalid product ID", http.StatusBadRequest)
+			return
+		}
+
+		var matrix model.VariantMatrix
+		if err := json.NewDecoder(r.Body).Decode(&matrix); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		matrix.Normalize()
+		if err := matrix.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		product, err := repo.GenerateVariants(uint(id), matrix)
+		if err != nil {
+			writeVariantError(w, err, "generating variants")
+			return
+		}
+
+		setImageURLs(blobs, product.Images)
+		sendJSONResponse(w, http.StatusOK, product)
+	}
+}
+
+// updateVariant sets the SKU, price override and stock of a variant. A null price sells the variant at the product price.
+func updateVariant(repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		productID, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil || productID <= 0 {
+			http.Error(w, "Invalid product ID", http.StatusBadRequest)
+			return
+		}
+		variantID, err := strconv.Atoi(chi.URLParam(r, "variant_id"))
+		if err != nil || variantID <= 0 {
+			http.Error(w, "Invalid variant ID", http.StatusBadRequest)
+			return
+		}
+
+		var req struct {
+			SKU      string   `json:"sku"`
+			Price    *float64 `json:"price"`
+			Quantity int      `json:"quantity"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		variant := model.ProductVariant{
+			ID:        uint(variantID),
+			ProductID: uint(productID),
+			SKU:       req.SKU,
+			Price:     req.Price,
+			Quantity:  req.Quantity,
+		}
+		if err := repo.UpdateVariant(&variant); err != nil {
+			writeVariantError(w, err, "updating variant")
+			return
+		}
+
+		sendJSONResponse(w, http.StatusOK, variant)
+	}
+}
+
+// writeVariantError responds to the errors of variant operations.
+func writeVariantError(w http.ResponseWriter, err error, action string) {
+	switch {
+	case errors.Is(err, model.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, model.ErrInvalidUserInput):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Printf("Error %s: %v", action, err)
+		http.Error(w, errInternalServerError.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,28 @@
+// Package blob provides implementations for storing uploaded files, such as product images.
+//
+// Blobs are identified by slash-separated keys, e.g. "products/12/3f9c0a/original.jpg",
+// made of lower case letters, digits, dots, dashes and underscores.
+package blob
+
+import (
+	"fmt"
+	"strings"
+)
+
+// validateKey ensures key is a relative slash-separated path that cannot escape the root of a store.
+func validateKey(key string) error {
+	if key == "" || len(key) > 1024 {
+		return fmt.Errorf("invalid blob key %q", key)
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf("invalid blob key %q", key)
+		}
+		for _, c := range segment {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_') {
+				return fmt.Errorf("invalid blob key %q", key)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package blob
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFileStoreServesStoredBlobs(t *testing.T) {
+	store, err := NewFileStore(t.TempDir(), "/media/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	const key = "products/12/3f9c0a/original.png"
+
+	if err := store.Put(ctx, key, "image/png", []byte("png data")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if got, want := store.URL(key), "/media/"+key; got != want {
+		t.Errorf("URL = %q, want %q", got, want)
+	}
+
+	rec := httptest.NewRecorder()
+	store.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+key, nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "png data" {
+		t.Errorf("GET: status = %d, body = %q", rec.Code, rec.Body)
+	}
+
+	for _, path := range []string{"/../file_test.go", "/products/12", "/products/12/3f9c0a/missing.png"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.URL.Path = path
+		rec := httptest.NewRecorder()
+		store.ServeHTTP(rec, req)
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s: status = %d, want %d", path, rec.Code, http.StatusNotFound)
+		}
+	}
+
+	if err := store.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	rec = httptest.NewRecorder()
+	store.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+key, nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET after Delete: status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if err := store.Put(ctx, "../escape", "image/png", nil); err == nil {
+		t.Error("Put of a key outside the store succeeded")
+	}
+}
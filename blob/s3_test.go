@@ -0,0 +1,231 @@
+package blob
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is an S3 stand-in holding the objects of a single bucket, which checks the signature of every request.
+type fakeS3 struct {
+	t         *testing.T
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+
+	mu       sync.Mutex
+	objects  map[string][]byte
+	types    map[string]string
+	requests int
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *S3Store) {
+	t.Helper()
+	fake := &fakeS3{
+		t:         t,
+		bucket:    "media",
+		region:    "eu-west-1",
+		accessKey: "AKIDEXAMPLE",
+		secretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		objects:   make(map[string][]byte),
+		types:     make(map[string]string),
+	}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	store, err := NewS3Store(S3Config{
+		Endpoint:        srv.URL,
+		Region:          fake.region,
+		Bucket:          fake.bucket,
+		AccessKeyID:     fake.accessKey,
+		SecretAccessKey: fake.secretKey,
+	})
+	if err != nil {
+		t.Fatalf("creating store: %v", err)
+	}
+	return fake, store
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.verify(r, body); err != nil {
+		s.t.Errorf("%s %s: %v", r.Method, r.URL.Path, err)
+		http.Error(w, "<Error><Code>SignatureDoesNotMatch</Code></Error>", http.StatusForbidden)
+		return
+	}
+
+	key, ok := strings.CutPrefix(r.URL.Path, "/"+s.bucket+"/")
+	if !ok {
+		http.Error(w, "<Error><Code>NoSuchBucket</Code></Error>", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		s.objects[key] = body
+		s.types[key] = r.Header.Get("Content-Type")
+	case http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "<Error><Code>NotImplemented</Code></Error>", http.StatusNotImplemented)
+	}
+}
+
+// verify recomputes the AWS Signature Version 4 of r from what was received.
+func (s *fakeS3) verify(r *http.Request, body []byte) error {
+	auth := r.Header.Get("Authorization")
+	fields := map[string]string{}
+	algorithm, rest, _ := strings.Cut(auth, " ")
+	for _, field := range strings.Split(rest, ", ") {
+		name, value, _ := strings.Cut(field, "=")
+		fields[name] = value
+	}
+	if algorithm != "AWS4-HMAC-SHA256" {
+		return fmt.Errorf("unexpected algorithm %q", algorithm)
+	}
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	if len(amzDate) != len("20060102T150405Z") {
+		return fmt.Errorf("invalid X-Amz-Date %q", amzDate)
+	}
+	scope := amzDate[:8] + "/" + s.region + "/s3/aws4_request"
+	if fields["Credential"] != s.accessKey+"/"+scope {
+		return fmt.Errorf("credential %q, want %q", fields["Credential"], s.accessKey+"/"+scope)
+	}
+	payloadHash := sha256.Sum256(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(payloadHash[:]) {
+		return fmt.Errorf("X-Amz-Content-Sha256 does not match the body")
+	}
+
+	signed := strings.Split(fields["SignedHeaders"], ";")
+	if !sort.StringsAreSorted(signed) {
+		return fmt.Errorf("signed headers %v are not sorted", signed)
+	}
+	for _, required := range []string{"host", "x-amz-content-sha256", "x-amz-date"} {
+		if !contains(signed, required) {
+			return fmt.Errorf("header %s is not signed", required)
+		}
+	}
+	if r.Header.Get("Content-Type") != "" && !contains(signed, "content-type") {
+		return fmt.Errorf("content-type is not signed")
+	}
+	var canonicalHeaders strings.Builder
+	for _, h := range signed {
+		value := r.Header.Get(h)
+		if h == "host" {
+			value = r.Host
+		}
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", h, strings.TrimSpace(value))
+	}
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		r.URL.RawQuery,
+		canonicalHeaders.String(),
+		fields["SignedHeaders"],
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{amzDate[:8], s.region, "s3", "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	if want := hex.EncodeToString(key); fields["Signature"] != want {
+		return fmt.Errorf("signature %q, want %q", fields["Signature"], want)
+	}
+	return nil
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+func TestS3StorePutsAndDeletesSignedObjects(t *testing.T) {
+	fake, store := newFakeS3(t)
+	ctx := context.Background()
+	const key = "products/12/3f9c0a/original.jpg"
+
+	if err := store.Put(ctx, key, "image/jpeg", []byte("jpeg data")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if got := string(fake.objects[key]); got != "jpeg data" {
+		t.Errorf("object = %q, want %q", got, "jpeg data")
+	}
+	if got := fake.types[key]; got != "image/jpeg" {
+		t.Errorf("content type = %q, want image/jpeg", got)
+	}
+
+	if err := store.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, ok := fake.objects[key]; ok {
+		t.Error("object still stored after Delete")
+	}
+	// deleting a missing object succeeds
+	if err := store.Delete(ctx, key); err != nil {
+		t.Errorf("Delete of a missing object: %v", err)
+	}
+}
+
+func TestS3StoreRejectsInvalidKeys(t *testing.T) {
+	fake, store := newFakeS3(t)
+	ctx := context.Background()
+
+	for _, key := range []string{"", "../secret", "products/../../secret", "/products/1", "products//1", "Products/1", "products/1?acl", "products/1 2"} {
+		if err := store.Put(ctx, key, "image/png", []byte("data")); err == nil {
+			t.Errorf("Put(%q) succeeded, want an error", key)
+		}
+		if err := store.Delete(ctx, key); err == nil {
+			t.Errorf("Delete(%q) succeeded, want an error", key)
+		}
+	}
+	if fake.requests != 0 {
+		t.Errorf("%d requests sent for invalid keys, want none", fake.requests)
+	}
+}
+
+func TestS3StoreURL(t *testing.T) {
+	store, err := NewS3Store(S3Config{Endpoint: "http://localhost:9000/", Bucket: "media", AccessKeyID: "id", SecretAccessKey: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := store.URL("products/1/a/small.png"), "http://localhost:9000/media/products/1/a/small.png"; got != want {
+		t.Errorf("URL = %q, want %q", got, want)
+	}
+
+	store, err = NewS3Store(S3Config{Endpoint: "https://s3.amazonaws.com", Bucket: "media", AccessKeyID: "id", SecretAccessKey: "secret", PublicURL: "https://cdn.example.com/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := store.URL("products/1/a/small.png"), "https://cdn.example.com/products/1/a/small.png"; got != want {
+		t.Errorf("URL with a public URL = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,193 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"instashop/api/model"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// UpdateProfile sets the name and phone number of userID. Nil values are left unchanged.
+func (db *DB) UpdateProfile(userID uint, name, phone *string) (model.User, error) {
+	updates := map[string]interface{}{}
+	if name != nil {
+		updates["name"] = *name
+	}
+	if phone != nil {
+		updates["phone"] = *phone
+	}
+
+	if len(updates) > 0 {
+		res := db.client.Model(&model.User{}).Where("id = ?", userID).Updates(updates)
+		if res.Error != nil {
+			return model.User{}, fmt.Errorf("failed to update profile: %w", res.Error)
+		}
+		if res.RowsAffected == 0 {
+			return model.User{}, fmt.Errorf("user not found: %w", model.ErrNotFound)
+		}
+	}
+
+	return db.FetchUserByID(userID)
+}
+
+// RequestEmailChange records newEmail as the pending email of userID, confirmed by password,
+// and stores the hash of the token that confirms the change. The current email stays in use until then.
+func (db *DB) RequestEmailChange(userID uint, password, newEmail, tokenHash string, expiresAt time.Time) error {
+	return db.client.Transaction(func(tx *gorm.DB) error {
+		if _, err := checkPassword(tx, userID, password); err != nil {
+			return err
+		}
+		if err := checkEmailAvailable(tx, userID, newEmail); err != nil {
+			return err
+		}
+
+		err := tx.Model(&model.User{}).Where("id = ?", userID).Update("pending_email", newEmail).Error
+		if err != nil {
+			return fmt.Errorf("failed to set pending email: %w", err)
+		}
+		return createUserToken(tx, userID, model.TokenPurposeChangeEmail, tokenHash, expiresAt)
+	})
+}
+
+// ConfirmEmailChange consumes an email change token, replacing the owner's email with their pending email.
+// The new email is verified by the confirmation.
+func (db *DB) ConfirmEmailChange(tokenHash string) error {
+	return db.client.Transaction(func(tx *gorm.DB) error {
+		token, err := consumeUserToken(tx, model.TokenPurposeChangeEmail, tokenHash)
+		if err != nil {
+			return err
+		}
+
+		var user model.User
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, token.UserID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("user not found: %w", model.ErrInvalidUserInput)
+			}
+			return fmt.Errorf("error fetching user: %w", err)
+		}
+		if user.PendingEmail == "" {
+			return fmt.Errorf("no pending email change: %w", model.ErrInvalidUserInput)
+		}
+		if err := checkEmailAvailable(tx, user.ID, user.PendingEmail); err != nil {
+			return err
+		}
+
+		err = tx.Model(&user).Updates(map[string]interface{}{
+			"email":             user.PendingEmail,
+			"pending_email":     "",
+			"email_verified_at": time.Now(),
+		}).Error
+		if err != nil {
+			return fmt.Errorf("failed to change email: %w", err)
+		}
+		return nil
+	})
+}
+
+// ChangePassword replaces the password of userID after checking currentPassword,
+// revoking every session of the user except keepSessionID.
+func (db *DB) ChangePassword(userID uint, currentPassword, newPassword, keepSessionID string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to generate hash from password: %w", err)
+	}
+
+	return db.client.Transaction(func(tx *gorm.DB) error {
+		if _, err := checkPassword(tx, userID, currentPassword); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		err := tx.Model(&model.User{}).Where("id = ?", userID).
+			Updates(map[string]interface{}{"password": string(hashedPassword), "password_changed_at": now}).Error
+		if err != nil {
+			return fmt.Errorf("failed to change password: %w", err)
+		}
+		return revokeSessions(tx.Where("user_id = ? AND id <> ?", userID, keepSessionID), now)
+	})
+}
+
+// DeleteAccount deletes the account of userID after checking password.
+//
+// Orders are kept for bookkeeping, so the user row is anonymised and soft deleted rather than removed.
+// Sessions, API keys, linked identities, saved addresses and the cart of the user are removed,
+// and the email address is freed for a new account.
+func (db *DB) DeleteAccount(userID uint, password string) error {
+	return db.client.Transaction(func(tx *gorm.DB) error {
+		if _, err := checkPassword(tx, userID, password); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		err := tx.Model(&model.User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+			"email":             fmt.Sprintf("deleted-%d@deleted.invalid", userID),
+			"pending_email":     "",
+			"password":          "",
+			"name":              "",
+			"phone":             "",
+			"mfa_secret":        "",
+			"mfa_enabled_at":    nil,
+			"email_verified_at": nil,
+		}).Error
+		if err != nil {
+			return fmt.Errorf("failed to anonymise user: %w", err)
+		}
+
+		if err := revokeSessions(tx.Where("user_id = ?", userID), now); err != nil {
+			return err
+		}
+		err = tx.Model(&model.APIKey{}).Where("created_by_id = ? AND revoked_at IS NULL", userID).Update("revoked_at", now).Error
+		if err != nil {
+			return fmt.Errorf("failed to revoke API keys: %w", err)
+		}
+		for _, m := range []interface{}{&model.ExternalIdentity{}, &model.RecoveryCode{}, &model.UserToken{}, &model.Address{}, &model.Cart{}} {
+			if err := tx.Where("user_id = ?", userID).Delete(m).Error; err != nil {
+				return fmt.Errorf("failed to delete account data: %w", err)
+			}
+		}
+		if err := tx.Model(&model.User{ID: userID}).Association("Roles").Clear(); err != nil {
+			return fmt.Errorf("failed to remove roles: %w", err)
+		}
+		// deleting the last administrator would also free its email for the seeded default admin account
+		if err := ensureAdminRemains(tx); err != nil {
+			return err
+		}
+
+		if err := tx.Delete(&model.User{}, userID).Error; err != nil {
+			return fmt.Errorf("failed to delete user: %w", err)
+		}
+		return nil
+	})
+}
+
+// checkPassword locks the user row of userID and checks password against it.
+func checkPassword(tx *gorm.DB, userID uint, password string) (model.User, error) {
+	var user model.User
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, userID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return model.User{}, fmt.Errorf("user not found: %w", model.ErrNotFound)
+		}
+		return model.User{}, fmt.Errorf("error fetching user: %w", err)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		return model.User{}, model.ErrInvalidPassword
+	}
+	return user, nil
+}
+
+// checkEmailAvailable returns model.ErrEmailInUse if email is registered to a user other than userID.
+func checkEmailAvailable(tx *gorm.DB, userID uint, email string) error {
+	var count int64
+	err := tx.Model(&model.User{}).Where("LOWER(email) = LOWER(?) AND id <> ?", email, userID).Count(&count).Error
+	if err != nil {
+		return fmt.Errorf("error checking email: %w", err)
+	}
+	if count > 0 {
+		return model.ErrEmailInUse
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"instashop/api/model"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ListAddresses returns the address book of userID, default address first.
+func (db *DB) ListAddresses(userID uint) ([]model.Address, error) {
+	addresses := make([]model.Address, 0)
+	err := db.client.Where("user_id = ?", userID).Order("is_default DESC, id").Find(&addresses).Error
+	if err != nil {
+		return nil, fmt.Errorf("error fetching addresses: %w", err)
+	}
+	return addresses, nil
+}
+
+// FetchAddress retrieves an address of userID's address book.
+func (db *DB) FetchAddress(id, userID uint) (model.Address, error) {
+	return fetchAddress(db.client, id, userID)
+}
+
+// CreateAddress adds address to the address book of address.UserID.
+// The first address of a user becomes the default; making an address the default unsets the previous one.
+func (db *DB) CreateAddress(address *model.Address) error {
+	return db.client.Transaction(func(tx *gorm.DB) error {
+		if err := lockAddressBook(tx, address.UserID); err != nil {
+			return err
+		}
+
+		var count int64
+		if err := tx.Model(&model.Address{}).Where("user_id = ?", address.UserID).Count(&count).Error; err != nil {
+			return fmt.Errorf("error counting addresses: %w", err)
+		}
+		if count == 0 {
+			address.IsDefault = true
+		}
+		if address.IsDefault {
+			if err := clearDefaultAddress(tx, address.UserID); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Create(address).Error; err != nil {
+			return fmt.Errorf("failed to create address: %w", err)
+		}
+		return nil
+	})
+}
+
+// UpdateAddress replaces an address of the address book of address.UserID.
+func (db *DB) UpdateAddress(address *model.Address) error {
+	return db.client.Transaction(func(tx *gorm.DB) error {
+		if err := lockAddressBook(tx, address.UserID); err != nil {
+			return err
+		}
+
+		existing, err := fetchAddress(tx, address.ID, address.UserID)
+		if err != nil {
+			return err
+		}
+		if address.IsDefault && !existing.IsDefault {
+			if err := clearDefaultAddress(tx, address.UserID); err != nil {
+				return err
+			}
+		}
+
+		address.CreatedAt = existing.CreatedAt
+		if err := tx.Save(address).Error; err != nil {
+			return fmt.Errorf("failed to update address: %w", err)
+		}
+		return nil
+	})
+}
+
+// DeleteAddress removes an address from userID's address book.
+// If it was the default address, the oldest remaining address becomes the default.
+func (db *DB) DeleteAddress(id, userID uint) error {
+	return db.client.Transaction(func(tx *gorm.DB) error {
+		if err := lockAddressBook(tx, userID); err != nil {
+			return err
+		}
+
+		address, err := fetchAddress(tx, id, userID)
+		if err != nil {
+			return err
+		}
+		if err := tx.Delete(&address).Error; err != nil {
+			return fmt.Errorf("failed to delete address: %w", err)
+		}
+		if !address.IsDefault {
+			return nil
+		}
+
+		var next model.Address
+		err = tx.Where("user_id = ?", userID).Order("id").First(&next).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error fetching address: %w", err)
+		}
+		if err := tx.Model(&next).Update("is_default", true).Error; err != nil {
+			return fmt.Errorf("failed to set default address: %w", err)
+		}
+		return nil
+	})
+}
+
+// resolveOrderAddresses returns the shipping and billing addresses selected from userID's address book.
+func resolveOrderAddresses(tx *gorm.DB, userID uint, sel model.AddressSelection) (shipping, billing model.PostalAddress, err error) {
+	var shippingAddress model.Address
+	if sel.ShippingAddressID == 0 {
+		err = tx.Where("user_id = ? AND is_default", userID).First(&shippingAddress).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return shipping, billing, fmt.Errorf("a shipping address is required: %w", model.ErrInvalidUserInput)
+		}
+		if err != nil {
+			return shipping, billing, fmt.Errorf("error fetching default address: %w", err)
+		}
+	} else if shippingAddress, err = fetchAddress(tx, sel.ShippingAddressID, userID); err != nil {
+		return shipping, billing, err
+	}
+
+	billingAddress := shippingAddress
+	if sel.BillingAddressID != 0 && sel.BillingAddressID != shippingAddress.ID {
+		if billingAddress, err = fetchAddress(tx, sel.BillingAddressID, userID); err != nil {
+			return shipping, billing, err
+		}
+	}
+
+	return shippingAddress.PostalAddress, billingAddress.PostalAddress, nil
+}
+
+func fetchAddress(tx *gorm.DB, id, userID uint) (model.Address, error) {
+	var address model.Address
+	if err := tx.Where("id = ? AND user_id = ?", id, userID).First(&address).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return model.Address{}, fmt.Errorf("address %d not found: %w", id, model.ErrNotFound)
+		}
+		return model.Address{}, fmt.Errorf("error fetching address: %w", err)
+	}
+	return address, nil
+}
+
+// lockAddressBook serialises changes to the address book of userID, so that it never has two default addresses.
+func lockAddressBook(tx *gorm.DB, userID uint) error {
+	var user model.User
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").First(&user, userID).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("user not found: %w", model.ErrNotFound)
+		}
+		return fmt.Errorf("error locking address book: %w", err)
+	}
+	return nil
+}
+
+func clearDefaultAddress(tx *gorm.DB, userID uint) error {
+	err := tx.Model(&model.Address{}).Where("user_id = ? AND is_default", userID).Update("is_default", false).Error
+	if err != nil {
+		return fmt.Errorf("failed to unset default address: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package db
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"instashop/api/model"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// apiKeyUsageResolution is how often the last-used timestamp of an API key is refreshed,
+// to avoid a write on every request.
+const apiKeyUsageResolution = time.Minute
+
+// CreateAPIKey stores a new API key. The key's ID and CreatedAt are filled in on success.
+func (db *DB) CreateAPIKey(key *model.APIKey) error {
+	if err := db.client.Create(key).Error; err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return fmt.Errorf("API key prefix already in use: %w", model.ErrInvalidUserInput)
+		}
+		return fmt.Errorf("failed to create API key: %w", err)
+	}
+	return nil
+}
+
+// ListAPIKeys returns every API key, newest first.
+func (db *DB) ListAPIKeys() ([]model.APIKey, error) {
+	keys := make([]model.APIKey, 0)
+	if err := db.client.Preload("Scopes").Order("created_at DESC").Find(&keys).Error; err != nil {
+		return nil, fmt.Errorf("error fetching API keys: %w", err)
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey revokes an API key so that it can no longer authenticate.
+func (db *DB) RevokeAPIKey(id uint) error {
+	res := db.client.Model(&model.APIKey{}).Where("id = ? AND revoked_at IS NULL", id).Update("revoked_at", time.Now())
+	if res.Error != nil {
+		return fmt.Errorf("failed to revoke API key: %w", res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("API key %d not found: %w", id, model.ErrNotFound)
+	}
+	return nil
+}
+
+// AuthenticateAPIKey returns the active API key identified by prefix if its hash matches keyHash
+// and its creator is still enabled, recording that the key has been used.
+func (db *DB) AuthenticateAPIKey(prefix, keyHash string) (model.APIKey, error) {
+	var key model.APIKey
+	if err := db.client.Preload("Scopes").Where("prefix = ?", prefix).First(&key).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return model.APIKey{}, fmt.Errorf("invalid API key: %w", model.ErrInvalidUserInput)
+		}
+		return model.APIKey{}, fmt.Errorf("error fetching API key: %w", err)
+	}
+
+	now := time.Now()
+	if subtle.ConstantTimeCompare([]byte(key.KeyHash), []byte(keyHash)) != 1 ||
+		key.RevokedAt != nil ||
+		(key.ExpiresAt != nil && now.After(*key.ExpiresAt)) {
+		return model.APIKey{}, fmt.Errorf("invalid API key: %w", model.ErrInvalidUserInput)
+	}
+
+	// keys act on behalf of their creator, so they stop working when the creator is disabled or deleted
+	var active int64
+	if err := db.client.Model(&model.User{}).Where("id = ? AND disabled_at IS NULL", key.CreatedByID).Count(&active).Error; err != nil {
+		return model.APIKey{}, fmt.Errorf("error checking API key owner: %w", err)
+	}
+	if active == 0 {
+		return model.APIKey{}, fmt.Errorf("API key owner disabled: %w", model.ErrInvalidUserInput)
+	}
+
+	err := db.client.Model(&model.APIKey{}).
+		Where("id = ? AND (last_used_at IS NULL OR last_used_at < ?)", key.ID, now.Add(-apiKeyUsageResolution)).
+		Update("last_used_at", now).Error
+	if err != nil {
+		return model.APIKey{}, fmt.Errorf("failed to record API key usage: %w", err)
+	}
+	return key, nil
+}
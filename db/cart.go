@@ -0,0 +1,293 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"instashop/api/model"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// anonymousCartTTL is how long an anonymous cart is kept after it was last changed.
+const anonymousCartTTL = 30 * 24 * time.Hour
+
+// FetchCart returns the cart of owner with the products and variants of its items loaded.
+// A user without a cart gets an empty one; an unknown anonymous cart yields model.ErrNotFound.
+func (db *DB) FetchCart(owner model.CartOwner) (model.Cart, error) {
+	var cart model.Cart
+	err := ownerScope(db.client, owner).Preload("Items", func(tx *gorm.DB) *gorm.DB {
+		return tx.Order("cart_items.id")
+	}).Preload("Items.Product").First(&cart).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			if owner.UserID != 0 {
+				return model.Cart{UserID: &owner.UserID}, nil
+			}
+			return model.Cart{}, fmt.Errorf("cart not found: %w", model.ErrNotFound)
+		}
+		return model.Cart{}, fmt.Errorf("error fetching cart: %w", err)
+	}
+
+	var variantIDs []uint
+	for _, item := range cart.Items {
+		if item.VariantID != 0 {
+			variantIDs = append(variantIDs, item.VariantID)
+		}
+	}
+	variants, err := loadVariants(db.client, variantIDs)
+	if err != nil {
+		return model.Cart{}, err
+	}
+	for i, item := range cart.Items {
+		if v, ok := variants[item.VariantID]; ok {
+			cart.Items[i].Variant = &v
+		}
+	}
+	return cart, nil
+}
+
+// CreateAnonymousCart creates an empty cart identified by the hash of its token.
+// Anonymous carts left unchanged for 30 days are purged on the way.
+func (db *DB) CreateAnonymousCart(tokenHash string) error {
+	err := db.client.Where("user_id IS NULL AND updated_at < ?", time.Now().Add(-anonymousCartTTL)).Delete(&model.Cart{}).Error
+	if err != nil {
+		return fmt.Errorf("failed to purge abandoned carts: %w", err)
+	}
+	if err := db.client.Create(&model.Cart{TokenHash: &tokenHash}).Error; err != nil {
+		return fmt.Errorf("failed to create cart: %w", err)
+	}
+	return nil
+}
+
+// AddCartItem adds quantity units of a product, or of its variant variantID, to the cart of owner.
+// It fails with a *model.OutOfStockError if the product does not have enough stock for the resulting quantity.
+func (db *DB) AddCartItem(owner model.CartOwner, productID, variantID uint, quantity int) error {
+	if quantity <= 0 {
+		return fmt.Errorf("quantity must be positive: %w", model.ErrInvalidUserInput)
+	}
+	return db.client.Transaction(func(tx *gorm.DB) error {
+		cart, err := lockCart(tx, owner)
+		if err != nil {
+			return err
+		}
+
+		var item model.CartItem
+		err = tx.Where("cart_id = ? AND product_id = ? AND variant_id = ?", cart.ID, productID, variantID).First(&item).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("error fetching cart item: %w", err)
+		}
+		return setCartItemQuantity(tx, cart, productID, variantID, item.Quantity+quantity)
+	})
+}
+
+// SetCartItemQuantity sets the quantity of a product, or of its variant variantID, in the cart of owner.
+// A quantity of zero removes the product. It fails with a *model.OutOfStockError if the product does not have enough stock.
+func (db *DB) SetCartItemQuantity(owner model.CartOwner, productID, variantID uint, quantity int) error {
+	if quantity < 0 {
+		return fmt.Errorf("quantity must not be negative: %w", model.ErrInvalidUserInput)
+	}
+	return db.client.Transaction(func(tx *gorm.DB) error {
+		cart, err := lockCart(tx, owner)
+		if err != nil {
+			return err
+		}
+		return setCartItemQuantity(tx, cart, productID, variantID, quantity)
+	})
+}
+
+// ClearCart removes every item from the cart of owner.
+func (db *DB) ClearCart(owner model.CartOwner) error {
+	return db.client.Transaction(func(tx *gorm.DB) error {
+		cart, err := lockCart(tx, owner)
+		if err != nil {
+			return err
+		}
+		if err := tx.Where("cart_id = ?", cart.ID).Delete(&model.CartItem{}).Error; err != nil {
+			return fmt.Errorf("failed to clear cart: %w", err)
+		}
+		return touchCart(tx, cart)
+	})
+}
+
+// MergeCarts moves the items of the anonymous cart identified by tokenHash into the cart of userID
+// and deletes the anonymous cart. Quantities of products in both carts are added up.
+//
+// Merged lines are checked like AddCartItem does: a line exceeding the available stock is reduced to it,
+// without reducing the quantity already in the user's cart, and a line that can no longer be ordered is dropped.
+func (db *DB) MergeCarts(tokenHash string, userID uint) error {
+	return db.client.Transaction(func(tx *gorm.DB) error {
+		anonymous, err := lockCart(tx, model.CartOwner{TokenHash: tokenHash})
+		if err != nil {
+			return err
+		}
+		cart, err := lockCart(tx, model.CartOwner{UserID: userID})
+		if err != nil {
+			return err
+		}
+
+		var items []model.CartItem
+		if err := tx.Where("cart_id = ?", anonymous.ID).Order("id").Find(&items).Error; err != nil {
+			return fmt.Errorf("error fetching cart items: %w", err)
+		}
+		for _, item := range items {
+			if err := mergeCartItem(tx, cart, item); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Delete(&anonymous).Error; err != nil {
+			return fmt.Errorf("failed to delete anonymous cart: %w", err)
+		}
+		return touchCart(tx, cart)
+	})
+}
+
+// CheckoutCart places an order for the content of the cart of userID and empties the cart, in one transaction.
+// Orders are placed through the same path as CreateOrder, so prices and stock are checked again.
+func (db *DB) CheckoutCart(userID uint, addresses model.AddressSelection) (model.Order, error) {
+	var order model.Order
+	err := db.client.Transaction(func(tx *gorm.DB) error {
+		cart, err := lockCart(tx, model.CartOwner{UserID: userID})
+		if err != nil {
+			return err
+		}
+
+		var items []model.CartItem
+		if err := tx.Where("cart_id = ?", cart.ID).Order("id").Find(&items).Error; err != nil {
+			return fmt.Errorf("error fetching cart items: %w", err)
+		}
+		if len(items) == 0 {
+			return fmt.Errorf("cart is empty: %w", model.ErrInvalidUserInput)
+		}
+
+		lines := make([]model.OrderItemInput, 0, len(items))
+		for _, item := range items {
+			lines = append(lines, model.OrderItemInput{ProductID: item.ProductID, VariantID: item.VariantID, Quantity: item.Quantity})
+		}
+		if order, err = createOrder(tx, userID, lines, addresses); err != nil {
+			return err
+		}
+
+		if err := tx.Where("cart_id = ?", cart.ID).Delete(&model.CartItem{}).Error; err != nil {
+			return fmt.Errorf("failed to empty cart: %w", err)
+		}
+		return touchCart(tx, cart)
+	})
+	if err != nil {
+		return model.Order{}, err
+	}
+	return order, nil
+}
+
+// mergeCartItem adds the quantity of item to the same product and variant in cart, clamped to the available stock.
+// Items whose product or variant can no longer be ordered are skipped.
+func mergeCartItem(tx *gorm.DB, cart model.Cart, item model.CartItem) error {
+	var existing model.CartItem
+	err := tx.Where("cart_id = ? AND product_id = ? AND variant_id = ?", cart.ID, item.ProductID, item.VariantID).First(&existing).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("error fetching cart item: %w", err)
+	}
+
+	err = setCartItemQuantity(tx, cart, item.ProductID, item.VariantID, existing.Quantity+item.Quantity)
+	var stockErr *model.OutOfStockError
+	switch {
+	case errors.As(err, &stockErr):
+		if available := stockErr.Shortages[0].Available; available > existing.Quantity {
+			return setCartItemQuantity(tx, cart, item.ProductID, item.VariantID, available)
+		}
+		return nil
+	case errors.Is(err, model.ErrInvalidUserInput):
+		// the product or variant was deleted, or the product is now sold in variants
+		return nil
+	default:
+		return err
+	}
+}
+
+func setCartItemQuantity(tx *gorm.DB, cart model.Cart, productID, variantID uint, quantity int) error {
+	if quantity == 0 {
+		err := tx.Where("cart_id = ? AND product_id = ? AND variant_id = ?", cart.ID, productID, variantID).Delete(&model.CartItem{}).Error
+		if err != nil {
+			return fmt.Errorf("failed to remove cart item: %w", err)
+		}
+		return touchCart(tx, cart)
+	}
+
+	var product model.Product
+	if err := tx.First(&product, productID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("product %d not found: %w", productID, model.ErrNotFound)
+		}
+		return fmt.Errorf("error fetching product: %w", err)
+	}
+	shortage := model.StockShortage{ProductID: product.ID, Name: product.Name, Requested: quantity, Available: product.Quantity}
+
+	if variantID != 0 {
+		var variant model.ProductVariant
+		if err := tx.Where("id = ? AND product_id = ?", variantID, productID).First(&variant).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("variant %d of product %d not found: %w", variantID, productID, model.ErrNotFound)
+			}
+			return fmt.Errorf("error fetching variant: %w", err)
+		}
+		shortage.VariantID, shortage.SKU, shortage.Available = variant.ID, variant.SKU, variant.Quantity
+	} else {
+		var variants int64
+		if err := tx.Model(&model.ProductVariant{}).Where("product_id = ?", productID).Count(&variants).Error; err != nil {
+			return fmt.Errorf("error counting variants: %w", err)
+		}
+		if variants > 0 {
+			return fmt.Errorf("product %d is sold in variants, choose one: %w", productID, model.ErrInvalidUserInput)
+		}
+	}
+	if shortage.Available < quantity {
+		shortage.Available = max(shortage.Available, 0)
+		return &model.OutOfStockError{Shortages: []model.StockShortage{shortage}}
+	}
+
+	item := model.CartItem{CartID: cart.ID, ProductID: productID, VariantID: variantID, Quantity: quantity}
+	err := tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "cart_id"}, {Name: "product_id"}, {Name: "variant_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"quantity", "updated_at"}),
+	}).Create(&item).Error
+	if err != nil {
+		return fmt.Errorf("failed to update cart item: %w", err)
+	}
+	return touchCart(tx, cart)
+}
+
+// lockCart locks the cart of owner for the rest of tx, creating the cart of a user if it does not exist yet.
+func lockCart(tx *gorm.DB, owner model.CartOwner) (model.Cart, error) {
+	if owner.UserID != 0 {
+		err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&model.Cart{UserID: &owner.UserID}).Error
+		if err != nil {
+			return model.Cart{}, fmt.Errorf("failed to create cart: %w", err)
+		}
+	}
+
+	var cart model.Cart
+	if err := ownerScope(tx, owner).Clauses(clause.Locking{Strength: "UPDATE"}).First(&cart).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return model.Cart{}, fmt.Errorf("cart not found: %w", model.ErrNotFound)
+		}
+		return model.Cart{}, fmt.Errorf("error fetching cart: %w", err)
+	}
+	return cart, nil
+}
+
+// touchCart records that cart changed, which keeps anonymous carts from being purged.
+func touchCart(tx *gorm.DB, cart model.Cart) error {
+	if err := tx.Model(&cart).Update("updated_at", time.Now()).Error; err != nil {
+		return fmt.Errorf("failed to update cart: %w", err)
+	}
+	return nil
+}
+
+func ownerScope(tx *gorm.DB, owner model.CartOwner) *gorm.DB {
+	if owner.UserID != 0 {
+		return tx.Where("user_id = ?", owner.UserID)
+	}
+	return tx.Where("token_hash = ? AND user_id IS NULL", owner.TokenHash)
+}
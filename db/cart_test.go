@@ -0,0 +1,135 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"instashop/api/model"
+	"testing"
+	"time"
+)
+
+// cartQuantities returns the quantity of each product in the cart of owner.
+func cartQuantities(t *testing.T, db *DB, owner model.CartOwner) map[uint]int {
+	t.Helper()
+	cart, err := db.FetchCart(owner)
+	if err != nil {
+		t.Fatalf("fetching cart: %v", err)
+	}
+	quantities := make(map[uint]int, len(cart.Items))
+	for _, item := range cart.Items {
+		quantities[item.ProductID] = item.Quantity
+	}
+	return quantities
+}
+
+func createTestProduct(t *testing.T, db *DB, name string, quantity int) uint {
+	t.Helper()
+	id, err := db.CreateProduct(model.Product{Name: name, Price: 10, Quantity: quantity})
+	if err != nil {
+		t.Fatalf("creating product %s: %v", name, err)
+	}
+	return id
+}
+
+func TestMergeCartsAddsUpQuantitiesWithinStock(t *testing.T) {
+	db := newTestDB(t)
+	userID := registerTestUser(t, db, "merge")
+	user := model.CartOwner{UserID: userID}
+	anonymous := model.CartOwner{TokenHash: fmt.Sprintf("merge-test-%d", time.Now().UnixNano())}
+	if err := db.CreateAnonymousCart(anonymous.TokenHash); err != nil {
+		t.Fatalf("creating anonymous cart: %v", err)
+	}
+
+	plenty := createTestProduct(t, db, "Merge test plenty", 10)
+	scarce := createTestProduct(t, db, "Merge test scarce", 4)
+	deleted := createTestProduct(t, db, "Merge test deleted", 5)
+	for _, line := range []struct {
+		owner     model.CartOwner
+		productID uint
+		quantity  int
+	}{
+		{user, plenty, 2},
+		{anonymous, plenty, 3},
+		{user, scarce, 3},
+		{anonymous, scarce, 3},
+		{anonymous, deleted, 1},
+	} {
+		if err := db.AddCartItem(line.owner, line.productID, 0, line.quantity); err != nil {
+			t.Fatalf("adding product %d to cart: %v", line.productID, err)
+		}
+	}
+	if _, err := db.DeleteProduct(deleted); err != nil {
+		t.Fatalf("deleting product: %v", err)
+	}
+
+	if err := db.MergeCarts(anonymous.TokenHash, userID); err != nil {
+		t.Fatalf("merging carts: %v", err)
+	}
+
+	got := cartQuantities(t, db, user)
+	want := map[uint]int{plenty: 5, scarce: 4}
+	if len(got) != len(want) || got[plenty] != want[plenty] || got[scarce] != want[scarce] {
+		t.Errorf("merged cart = %v, want %v", got, want)
+	}
+	if _, err := db.FetchCart(anonymous); !errors.Is(err, model.ErrNotFound) {
+		t.Errorf("fetching merged anonymous cart: err = %v, want model.ErrNotFound", err)
+	}
+	if err := db.MergeCarts(anonymous.TokenHash, userID); !errors.Is(err, model.ErrNotFound) {
+		t.Errorf("merging again: err = %v, want model.ErrNotFound", err)
+	}
+}
+
+func TestCheckoutCartIsAllOrNothing(t *testing.T) {
+	db := newTestDB(t)
+	userID := registerTestUser(t, db, "checkout")
+	owner := model.CartOwner{UserID: userID}
+
+	inStock := createTestProduct(t, db, "Checkout test in stock", 5)
+	soldOut := createTestProduct(t, db, "Checkout test sold out", 1)
+	if err := db.AddCartItem(owner, inStock, 0, 2); err != nil {
+		t.Fatalf("adding product to cart: %v", err)
+	}
+	if err := db.AddCartItem(owner, soldOut, 0, 1); err != nil {
+		t.Fatalf("adding product to cart: %v", err)
+	}
+	// another customer buys the last unit after it was added to the cart
+	other := registerTestUser(t, db, "checkout-other")
+	if _, err := db.CreateOrder(other, []model.OrderItemInput{{ProductID: soldOut, Quantity: 1}}, model.AddressSelection{}); err != nil {
+		t.Fatalf("creating order: %v", err)
+	}
+
+	var stockErr *model.OutOfStockError
+	if _, err := db.CheckoutCart(userID, model.AddressSelection{}); !errors.As(err, &stockErr) {
+		t.Fatalf("checking out: err = %v, want *model.OutOfStockError", err)
+	}
+	if got := cartQuantities(t, db, owner); got[inStock] != 2 || got[soldOut] != 1 {
+		t.Errorf("cart after failed checkout = %v, want it unchanged", got)
+	}
+	product, err := db.FetchProductByID(inStock)
+	if err != nil {
+		t.Fatalf("fetching product: %v", err)
+	}
+	if product.Quantity != 5 {
+		t.Errorf("stock after failed checkout = %d, want 5", product.Quantity)
+	}
+
+	if err := db.SetCartItemQuantity(owner, soldOut, 0, 0); err != nil {
+		t.Fatalf("removing product from cart: %v", err)
+	}
+	order, err := db.CheckoutCart(userID, model.AddressSelection{})
+	if err != nil {
+		t.Fatalf("checking out: %v", err)
+	}
+	if len(order.Items) != 1 || order.Items[0].ProductID != inStock || order.Items[0].Quantity != 2 {
+		t.Errorf("order items = %+v, want 2 of product %d", order.Items, inStock)
+	}
+	if got := cartQuantities(t, db, owner); len(got) != 0 {
+		t.Errorf("cart after checkout = %v, want it empty", got)
+	}
+	if product, err = db.FetchProductByID(inStock); err != nil {
+		t.Fatalf("fetching product: %v", err)
+	}
+	if product.Quantity != 3 {
+		t.Errorf("stock after checkout = %d, want 3", product.Quantity)
+	}
+}
@@ -0,0 +1,341 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"instashop/api/model"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// categorySubtreeQuery selects the IDs of the category with the given slug and of all its descendants.
+const categorySubtreeQuery = `WITH RECURSIVE subtree AS (
+	SELECT id FROM categories WHERE slug = ?
+	UNION ALL
+	SELECT categories.id FROM categories JOIN subtree ON categories.parent_id = subtree.id
+) SELECT id FROM subtree`
+
+// ListCategoryTree returns the roots of the category tree, with their children populated recursively.
+func (db *DB) ListCategoryTree() ([]model.Category, error) {
+	var categories []model.Category
+	if err := db.client.Order("position, name").Find(&categories).Error; err != nil {
+		return nil, fmt.Errorf("error fetching categories: %w", err)
+	}
+
+	children := make(map[uint][]model.Category)
+	for _, c := range categories {
+		if c.ParentID != nil {
+			children[*c.ParentID] = append(children[*c.ParentID], c)
+		}
+	}
+	var build func(c model.Category) model.Category
+	build = func(c model.Category) model.Category {
+		for _, child := range children[c.ID] {
+			c.Children = append(c.Children, build(child))
+		}
+		return c
+	}
+
+	roots := make([]model.Category, 0)
+	for _, c := range categories {
+		if c.ParentID == nil {
+			roots = append(roots, build(c))
+		}
+	}
+	return roots, nil
+}
+
+// FetchCategoryBySlug retrieves a category with its breadcrumbs and its direct children.
+func (db *DB) FetchCategoryBySlug(slug string) (model.Category, error) {
+	var category model.Category
+	if err := db.client.Where("slug = ?", slug).First(&category).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return model.Category{}, fmt.Errorf("category %q not found: %w", slug, model.ErrNotFound)
+		}
+		return model.Category{}, fmt.Errorf("error fetching category: %w", err)
+	}
+
+	if err := db.client.Where("parent_id = ?", category.ID).Order("position, name").Find(&category.Children).Error; err != nil {
+		return model.Category{}, fmt.Errorf("error fetching subcategories: %w", err)
+	}
+	ancestors, err := categoryAncestors(db.client, []uint{category.ID})
+	if err != nil {
+		return model.Category{}, err
+	}
+	category.Breadcrumbs = breadcrumbs(ancestors, category.ID)
+	return category, nil
+}
+
+// CreateCategory adds category to the tree, under category.ParentID if set.
+func (db *DB) CreateCategory(category *model.Category) error {
+	return db.client.Transaction(func(tx *gorm.DB) error {
+		if err := lockCategoryTree(tx); err != nil {
+			return err
+		}
+		if category.ParentID != nil {
+			if _, err := fetchCategory(tx, *category.ParentID); err != nil {
+				return parentCategoryError(err)
+			}
+		}
+		if err := checkSlugAvailable(tx, category.Slug, 0); err != nil {
+			return err
+		}
+
+		if err := tx.Omit(clause.Associations).Create(category).Error; err != nil {
+			return fmt.Errorf("failed to create category: %w", err)
+		}
+		return nil
+	})
+}
+
+// UpdateCategory renames or reorders a category. Its parent is left unchanged; see MoveCategory.
+func (db *DB) UpdateCategory(category *model.Category) error {
+	return db.client.Transaction(func(tx *gorm.DB) error {
+		if err := lockCategoryTree(tx); err != nil {
+			return err
+		}
+		existing, err := fetchCategory(tx, category.ID)
+		if err != nil {
+			return err
+		}
+		if err := checkSlugAvailable(tx, category.Slug, category.ID); err != nil {
+			return err
+		}
+
+		existing.Name = category.Name
+		existing.Slug = category.Slug
+		existing.Position = category.Position
+		if err := tx.Omit(clause.Associations).Save(&existing).Error; err != nil {
+			return fmt.Errorf("failed to update category: %w", err)
+		}
+		*category = existing
+		return nil
+	})
+}
+
+// MoveCategory moves a category, along with all its descendants, under a new parent.
+// Moving a category under itself or one of its descendants is rejected.
+func (db *DB) MoveCategory(id uint, move model.CategoryMove) (model.Category, error) {
+	var category model.Category
+	err := db.client.Transaction(func(tx *gorm.DB) error {
+		// moves are serialised, so that two concurrent moves cannot create a cycle together
+		if err := lockCategoryTree(tx); err != nil {
+			return err
+		}
+		var err error
+		if category, err = fetchCategory(tx, id); err != nil {
+			return err
+		}
+
+		if move.ParentID != nil {
+			if _, err := fetchCategory(tx, *move.ParentID); err != nil {
+				return parentCategoryError(err)
+			}
+			ancestors, err := categoryAncestors(tx, []uint{*move.ParentID})
+			if err != nil {
+				return err
+			}
+			if _, ok := ancestors[id]; ok {
+				return fmt.Errorf("cannot move a category under itself or one of its descendants: %w", model.ErrInvalidUserInput)
+			}
+		}
+
+		category.ParentID = move.ParentID
+		category.Position = move.Position
+		err = tx.Model(&category).Updates(map[string]interface{}{
+			"parent_id": move.ParentID,
+			"position":  move.Position,
+		}).Error
+		if err != nil {
+			return fmt.Errorf("failed to move category: %w", err)
+		}
+		return nil
+	})
+	return category, err
+}
+
+// DeleteCategory removes a category without children from the tree, unassigning its products.
+func (db *DB) DeleteCategory(id uint) error {
+	return db.client.Transaction(func(tx *gorm.DB) error {
+		if err := lockCategoryTree(tx); err != nil {
+			return err
+		}
+		category, err := fetchCategory(tx, id)
+		if err != nil {
+			return err
+		}
+
+		var children int64
+		if err := tx.Model(&model.Category{}).Where("parent_id = ?", id).Count(&children).Error; err != nil {
+			return fmt.Errorf("error counting subcategories: %w", err)
+		}
+		if children > 0 {
+			return fmt.Errorf("category has subcategories, delete or move them first: %w", model.ErrInvalidUserInput)
+		}
+
+		if err := tx.Exec("DELETE FROM product_categories WHERE category_id = ?", id).Error; err != nil {
+			return fmt.Errorf("failed to unassign products: %w", err)
+		}
+		if err := tx.Delete(&category).Error; err != nil {
+			return fmt.Errorf("failed to delete category: %w", err)
+		}
+		return nil
+	})
+}
+
+// SetProductCategories replaces the categories a product is assigned to, returning the product with its breadcrumbs.
+func (db *DB) SetProductCategories(productID uint, categoryIDs []uint) (model.Product, error) {
+	var product model.Product
+	err := db.client.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&product, productID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("product %d not found: %w", productID, model.ErrNotFound)
+			}
+			return fmt.Errorf("error fetching product: %w", err)
+		}
+
+		categories := make([]model.Category, 0, len(categoryIDs))
+		if len(categoryIDs) > 0 {
+			if err := tx.Where("id IN ?", categoryIDs).Find(&categories).Error; err != nil {
+				return fmt.Errorf("error fetching categories: %w", err)
+			}
+		}
+		found := make(map[uint]bool, len(categories))
+		for _, c := range categories {
+			found[c.ID] = true
+		}
+		for _, id := range categoryIDs {
+			if !found[id] {
+				return fmt.Errorf("category %d not found: %w", id, model.ErrInvalidUserInput)
+			}
+		}
+
+		if err := tx.Model(&product).Omit("Categories.*").Association("Categories").Replace(categories); err != nil {
+			return fmt.Errorf("failed to set product categories: %w", err)
+		}
+
+		products := []model.Product{product}
+		if err := loadBreadcrumbs(tx, products); err != nil {
+			return err
+		}
+		product = products[0]
+		return nil
+	})
+	return product, err
+}
+
+// loadBreadcrumbs populates the breadcrumbs of products, from the categories they are assigned to.
+func loadBreadcrumbs(tx *gorm.DB, products []model.Product) error {
+	if len(products) == 0 {
+		return nil
+	}
+	ids := make([]uint, len(products))
+	for i, p := range products {
+		ids[i] = p.ID
+	}
+
+	var assignments []struct {
+		ProductID  uint
+		CategoryID uint
+	}
+	err := tx.Table("product_categories").Select("product_id, category_id").
+		Where("product_id IN ?", ids).Order("category_id").Scan(&assignments).Error
+	if err != nil {
+		return fmt.Errorf("error fetching product categories: %w", err)
+	}
+	if len(assignments) == 0 {
+		return nil
+	}
+
+	categoryIDs := make([]uint, len(assignments))
+	for i, a := range assignments {
+		categoryIDs[i] = a.CategoryID
+	}
+	ancestors, err := categoryAncestors(tx, categoryIDs)
+	if err != nil {
+		return err
+	}
+
+	index := make(map[uint]int, len(products))
+	for i, p := range products {
+		index[p.ID] = i
+	}
+	for _, a := range assignments {
+		p := &products[index[a.ProductID]]
+		p.Breadcrumbs = append(p.Breadcrumbs, breadcrumbs(ancestors, a.CategoryID))
+	}
+	return nil
+}
+
+// categoryAncestors returns the categories of ids and all their ancestors, by ID.
+func categoryAncestors(tx *gorm.DB, ids []uint) (map[uint]model.Category, error) {
+	var categories []model.Category
+	err := tx.Raw(`WITH RECURSIVE ancestors AS (
+		SELECT * FROM categories WHERE id IN ?
+		UNION
+		SELECT categories.* FROM categories JOIN ancestors ON categories.id = ancestors.parent_id
+	) SELECT * FROM ancestors`, ids).Scan(&categories).Error
+	if err != nil {
+		return nil, fmt.Errorf("error fetching category ancestors: %w", err)
+	}
+
+	byID := make(map[uint]model.Category, len(categories))
+	for _, c := range categories {
+		byID[c.ID] = c
+	}
+	return byID, nil
+}
+
+// breadcrumbs returns the path from the root of the tree to the category id, from the categories returned by categoryAncestors.
+func breadcrumbs(ancestors map[uint]model.Category, id uint) []model.CategoryRef {
+	var path []model.CategoryRef
+	for c, ok := ancestors[id]; ok; {
+		path = append([]model.CategoryRef{c.Ref()}, path...)
+		if c.ParentID == nil {
+			break
+		}
+		c, ok = ancestors[*c.ParentID]
+	}
+	return path
+}
+
+func fetchCategory(tx *gorm.DB, id uint) (model.Category, error) {
+	var category model.Category
+	if err := tx.First(&category, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return model.Category{}, fmt.Errorf("category %d not found: %w", id, model.ErrNotFound)
+		}
+		return model.Category{}, fmt.Errorf("error fetching category: %w", err)
+	}
+	return category, nil
+}
+
+// parentCategoryError reports a missing parent category as invalid input rather than as the category not being found.
+func parentCategoryError(err error) error {
+	if errors.Is(err, model.ErrNotFound) {
+		return fmt.Errorf("parent category not found: %w", model.ErrInvalidUserInput)
+	}
+	return err
+}
+
+// checkSlugAvailable fails if a category other than exceptID uses slug.
+func checkSlugAvailable(tx *gorm.DB, slug string, exceptID uint) error {
+	var count int64
+	if err := tx.Model(&model.Category{}).Where("slug = ? AND id <> ?", slug, exceptID).Count(&count).Error; err != nil {
+		return fmt.Errorf("error checking slug: %w", err)
+	}
+	if count > 0 {
+		return fmt.Errorf("slug %q is already used by another category: %w", slug, model.ErrInvalidUserInput)
+	}
+	return nil
+}
+
+// lockCategoryTree serialises changes to the category tree for the rest of the transaction.
+// Readers are not blocked.
+func lockCategoryTree(tx *gorm.DB) error {
+	if err := tx.Exec("LOCK TABLE categories IN SHARE ROW EXCLUSIVE MODE").Error; err != nil {
+		return fmt.Errorf("failed to lock categories: %w", err)
+	}
+	return nil
+}
@@ -4,30 +4,70 @@ import (
 	"errors"
 	"fmt"
 	"instashop/api/model"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type DB struct {
 	client *gorm.DB
+
+	requireVerifiedEmail bool
+}
+
+// Option configures optional behaviour of DB.
+type Option func(*DB)
+
+// WithVerifiedEmailRequired makes ValidateCredentials reject accounts
+// whose email address has not been verified.
+func WithVerifiedEmailRequired() Option {
+	return func(db *DB) {
+		db.requireVerifiedEmail = true
+	}
 }
 
-func NewDB(dsn string) (*DB, error) {
+func NewDB(dsn string, opts ...Option) (*DB, error) {
 	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
 	if err != nil {
 		return nil, err
 	}
 
-	err = db.AutoMigrate(&model.User{}, &model.Product{}, &model.Order{}, &model.OrderItem{})
+	err = db.AutoMigrate(
+		&model.User{}, &model.Role{}, &model.RolePermission{}, &model.UserToken{}, &model.RecoveryCode{},
+		&model.Session{}, &model.RefreshToken{}, &model.LoginThrottle{}, &model.APIKey{}, &model.APIKeyScope{},
+		&model.ExternalIdentity{}, &model.OIDCAuthRequest{}, &model.Impersonation{}, &model.AuditLogEntry{},
+		&model.IdempotencyKey{},
+		&model.Address{},
+		&model.Category{}, &model.Product{}, &model.ProductOption{}, &model.ProductOptionValue{}, &model.ProductVariant{},
+		&model.ProductImage{},
+		&model.Cart{}, &model.CartItem{},
+		&model.Order{}, &model.OrderItem{}, &model.OrderStatusChange{},
+	)
 	if err != nil {
 		return nil, err
 	}
+	if err = applyMigrations(db); err != nil {
+		return nil, err
+	}
+	if err = seedRoles(db); err != nil {
+		return nil, err
+	}
+	if err = migrateAdminFlag(db); err != nil {
+		return nil, err
+	}
 	if err = seedAdminAccount(db); err != nil {
 		return nil, err
 	}
-	return &DB{client: db}, nil
+
+	repo := &DB{client: db}
+	for _, opt := range opts {
+		opt(repo)
+	}
+	return repo, nil
 }
 
 // seedAdminAccount creates an admin account to database if it does not already exist.
@@ -39,12 +79,22 @@ func seedAdminAccount(db *gorm.DB) error {
 	password := "admin123"
 
 	// Check if an admin account already exists
-	var admin model.User
-	if err := db.Where("email = ? AND is_admin = ?", email, true).First(&admin).Error; err == nil {
-
+	var count int64
+	err := db.Model(&model.User{}).
+		Joins("JOIN user_roles ON user_roles.user_id = users.id").
+		Joins("JOIN roles ON roles.id = user_roles.role_id").
+		Where("users.email = ? AND roles.name = ?", email, model.RoleAdmin).
+		Count(&count).Error
+	if err != nil {
+		return fmt.Errorf("failed to check for admin account: %w", err)
+	}
+	if count > 0 {
 		return nil // Admin already exists, no need to create
-	} else if errors.Is(err, gorm.ErrRecordNotFound) {
-		return err
+	}
+
+	var adminRole model.Role
+	if err := db.Where("name = ?", model.RoleAdmin).First(&adminRole).Error; err != nil {
+		return fmt.Errorf("failed to fetch admin role: %w", err)
 	}
 
 	bytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
@@ -52,10 +102,12 @@ func seedAdminAccount(db *gorm.DB) error {
 		return fmt.Errorf("failed to hash admin password: %w", err)
 	}
 
+	verifiedAt := time.Now()
 	newAdmin := model.User{
-		Email:    email,
-		Password: string(bytes),
-		IsAdmin:  true,
+		Email:           email,
+		Password:        string(bytes),
+		Roles:           []model.Role{adminRole},
+		EmailVerifiedAt: &verifiedAt,
 	}
 	if err := db.Create(&newAdmin).Error; err != nil {
 		return fmt.Errorf("failed to create admin account: %w", err)
@@ -64,18 +116,33 @@ func seedAdminAccount(db *gorm.DB) error {
 	return nil
 }
 
+// dummyPasswordHash is compared against when no user matches an email,
+// so that unknown emails take as long to reject as wrong passwords.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("instashop-dummy-password"), bcrypt.DefaultCost)
+
+// ValidateCredentials returns the user registered with email if password matches.
+// Unknown emails and wrong passwords both yield model.ErrInvalidUserInput after a bcrypt comparison,
+// so the two cases cannot be told apart by response or timing.
 func (db *DB) ValidateCredentials(email, password string) (model.User, error) {
 	var user model.User
-	err := db.client.Where("email = ?", email).First(&user).Error
+	err := db.client.Preload("Roles.Permissions").Where("email = ?", email).First(&user).Error
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return user, model.ErrInvalidUserInput
+			_ = bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+			return model.User{}, fmt.Errorf("invalid credentials: %w", model.ErrInvalidUserInput)
 		}
 		return user, err
 	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
-		return user, errors.New("invalid credentials")
+		return model.User{}, fmt.Errorf("invalid credentials: %w", model.ErrInvalidUserInput)
+	}
+
+	if user.DisabledAt != nil {
+		return model.User{}, model.ErrAccountDisabled
+	}
+	if db.requireVerifiedEmail && user.EmailVerifiedAt == nil {
+		return user, model.ErrEmailNotVerified
 	}
 
 	return user, nil
@@ -102,73 +169,240 @@ func (db *DB) Register(email, password string) (uint, error) {
 	return user.ID, nil
 }
 
-func (db *DB) FetchAllProducts() ([]model.Product, error) {
-	var products []model.Product
+const (
+	defaultProductsPerPage = 50
+	maxProductsPerPage     = 200
 
-	if err := db.client.Find(&products).Error; err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) || errors.Is(err, gorm.ErrEmptySlice) {
-			return products, nil
+	// productSortID sorts listings by ID, last, so that every product has a unique position.
+	productSortID model.ProductSortField = "id"
+)
+
+// ListProducts returns the page of products matching query, in the order of query.Sort and then by ID.
+func (db *DB) ListProducts(query model.ProductQuery) (model.ProductPage, error) {
+	if err := query.Validate(); err != nil {
+		return model.ProductPage{}, err
+	}
+
+	q := applyProductFilter(db.client.Model(&model.Product{}), query.ProductFilter)
+
+	sorts := append(append([]model.ProductSort(nil), query.Sort...), model.ProductSort{Field: productSortID})
+	if query.After != nil {
+		cond, args := productKeysetCondition(sorts, *query.After)
+		q = q.Where(cond, args...)
+	}
+	for _, sort := range sorts {
+		q = q.Order(clause.OrderByColumn{Column: clause.Column{Table: "products", Name: string(sort.Field)}, Desc: sort.Descending})
+	}
+
+	limit := query.Limit
+	if limit < 1 {
+		limit = defaultProductsPerPage
+	}
+	if limit > maxProductsPerPage {
+		limit = maxProductsPerPage
+	}
+
+	// fetch one extra product to know whether there is a next page
+	products := make([]model.Product, 0, limit+1)
+	if err := q.Limit(limit + 1).Find(&products).Error; err != nil {
+		return model.ProductPage{}, fmt.Errorf("error fetching products: %w", err)
+	}
+
+	page := model.ProductPage{Products: products}
+	if len(products) > limit {
+		page.Products = products[:limit]
+		next := model.CursorOf(products[limit-1])
+		page.Next = &next
+	}
+	if err := loadBreadcrumbs(db.client, page.Products); err != nil {
+		return model.ProductPage{}, err
+	}
+	return page, nil
+}
+
+// applyProductFilter narrows a query of products to those matching filter.
+func applyProductFilter(q *gorm.DB, filter model.ProductFilter) *gorm.DB {
+	if filter.NamePrefix != "" {
+		q = q.Where("LOWER(products.name) LIKE ?", escapeLike(strings.ToLower(filter.NamePrefix))+"%")
+	}
+	if filter.Category != "" {
+		q = q.Where("products.id IN (SELECT product_id FROM product_categories WHERE category_id IN ("+categorySubtreeQuery+"))", filter.Category)
+	}
+	if filter.MinPrice != nil {
+		q = q.Where("products.price >= ?", *filter.MinPrice)
+	}
+	if filter.MaxPrice != nil {
+		q = q.Where("products.price <= ?", *filter.MaxPrice)
+	}
+	if filter.InStock != nil {
+		if *filter.InStock {
+			q = q.Where("products.quantity > 0")
+		} else {
+			q = q.Where("products.quantity <= 0")
+		}
+	}
+	if filter.CreatedAfter != nil {
+		q = q.Where("products.created_at >= ?", *filter.CreatedAfter)
+	}
+	if filter.CreatedBefore != nil {
+		q = q.Where("products.created_at < ?", *filter.CreatedBefore)
+	}
+	if filter.UpdatedAfter != nil {
+		q = q.Where("products.updated_at >= ?", *filter.UpdatedAfter)
+	}
+	if filter.UpdatedBefore != nil {
+		q = q.Where("products.updated_at < ?", *filter.UpdatedBefore)
+	}
+	return q
+}
+
+// productKeysetCondition selects the products sorted after the position after, in the order of sorts.
+// For sorts a, b it is: a > ? OR (a = ? AND b > ?), comparing with < for descending fields.
+func productKeysetCondition(sorts []model.ProductSort, after model.ProductCursor) (string, []interface{}) {
+	value := func(field model.ProductSortField) interface{} {
+		switch field {
+		case model.ProductSortName:
+			return after.Name
+		case model.ProductSortPrice:
+			return after.Price
+		case model.ProductSortCreatedAt:
+			return after.CreatedAt
+		case model.ProductSortUpdatedAt:
+			return after.UpdatedAt
+		default:
+			return after.ID
 		}
-		return nil, fmt.Errorf("error fetch products: %w", err)
 	}
 
-	return products, nil
+	var (
+		alternatives []string
+		args         []interface{}
+	)
+	for i, sort := range sorts {
+		var terms []string
+		for _, equal := range sorts[:i] {
+			terms = append(terms, "products."+string(equal.Field)+" = ?")
+			args = append(args, value(equal.Field))
+		}
+		op := ">"
+		if sort.Descending {
+			op = "<"
+		}
+		terms = append(terms, "products."+string(sort.Field)+" "+op+" ?")
+		args = append(args, value(sort.Field))
+		alternatives = append(alternatives, "("+strings.Join(terms, " AND ")+")")
+	}
+	return "(" + strings.Join(alternatives, " OR ") + ")", args
 }
 
+// FetchProductByID retrieves a product with its breadcrumbs, options and variants.
 func (db *DB) FetchProductByID(id uint) (model.Product, error) {
 	var product model.Product
-	if err := db.client.First(&product, id).Error; err != nil {
+	err := db.client.
+		Preload("Options", func(tx *gorm.DB) *gorm.DB { return tx.Order("position, id") }).
+		Preload("Options.Values", func(tx *gorm.DB) *gorm.DB { return tx.Order("position, id") }).
+		Preload("Variants", func(tx *gorm.DB) *gorm.DB { return tx.Order("id") }).
+		Preload("Variants.Options", optionOrder).
+		Preload("Images", func(tx *gorm.DB) *gorm.DB { return tx.Order("position, id") }).
+		First(&product, id).Error
+	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return model.Product{}, fmt.Errorf("product not found: %w", model.ErrInvalidUserInput)
 		}
 		return product, fmt.Errorf("error fetching products: %w", err)
 	}
-	return product, nil
+	products := []model.Product{product}
+	if err := loadBreadcrumbs(db.client, products); err != nil {
+		return model.Product{}, err
+	}
+	return products[0], nil
 }
 
 func (db *DB) CreateProduct(product model.Product) (uint, error) {
-	if err := db.client.Create(&product).Error; err != nil {
+	if err := db.client.Omit(clause.Associations).Create(&product).Error; err != nil {
 		return 0, fmt.Errorf("failed to create product: %w", err)
 	}
 	return product.ID, nil
 }
 
+// UpdateProduct saves product. The stock of a product with variants stays the sum of the stock of its variants.
 func (db *DB) UpdateProduct(product model.Product) error {
-	if err := db.client.Save(&product).Error; err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return fmt.Errorf("product not found: %w", model.ErrInvalidUserInput)
+	return db.client.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit(clause.Associations).Save(&product).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("product not found: %w", model.ErrInvalidUserInput)
+			}
+			return fmt.Errorf("failed to update product: %w", err)
 		}
-		return fmt.Errorf("failed to update product: %w", err)
-	}
-	return nil
+		return syncProductStock(tx, product.ID)
+	})
 }
 
-func (db *DB) UpdateOrderStatus(status model.OrderStatus, orderID uint) error {
-	var order model.Order
-	err := db.client.Model(&order).Where("id = ?", orderID).Update("status", status).Error
-	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return fmt.Errorf("order does not exist: %w", model.ErrInvalidUserInput)
+// UpdateOrderStatus moves an order to status.
+//
+// The change must be allowed by the order state machine (see model.OrderStatus.CanTransitionTo),
+// otherwise a *model.InvalidStatusTransitionError is returned.
+// Stock reserved by the order is returned to inventory the first time
+// the order enters a status that releases it (canceled, returned, refunded or failed).
+// The change is recorded in the order's status history as made by actorID.
+func (db *DB) UpdateOrderStatus(status model.OrderStatus, orderID, actorID uint, note string) error {
+	return db.client.Transaction(func(tx *gorm.DB) error {
+		var order model.Order
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&order, orderID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("order %d does not exist: %w", orderID, model.ErrNotFound)
+			}
+			return fmt.Errorf("error fetching order: %w", err)
 		}
-		return fmt.Errorf("failed to update order: %w", err)
-	}
-	return err
+
+		if !order.Status.CanTransitionTo(status) {
+			return &model.InvalidStatusTransitionError{
+				From:    order.Status,
+				To:      status,
+				Allowed: order.Status.NextStatuses(),
+			}
+		}
+
+		if releasesStock(status) && !releasesStock(order.Status) {
+			if err := restockOrder(tx, order.ID); err != nil {
+				return err
+			}
+		}
+
+		// Update copies the new status into order, so the previous one is kept aside for the history
+		from := order.Status
+		if err := tx.Model(&order).Update("status", status).Error; err != nil {
+			return fmt.Errorf("failed to update order: %w", err)
+		}
+		return recordStatusChange(tx, order.ID, from, status, actorID, note)
+	})
 }
 
-func (db *DB) DeleteProduct(id uint) error {
-	if err := db.client.Delete(&model.Product{}, id).Error; err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
+// DeleteProduct deletes a product and its images, returning the images so that the caller can delete their blobs.
+func (db *DB) DeleteProduct(id uint) ([]model.ProductImage, error) {
+	var images []model.ProductImage
+	err := db.client.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("product_id = ?", id).Clauses(clause.Returning{}).Delete(&images).Error; err != nil {
+			return fmt.Errorf("failed to delete product images: %w", err)
+		}
+		result := tx.Delete(&model.Product{}, id)
+		if result.Error != nil {
+			return fmt.Errorf("failed to delete product: %w", result.Error)
+		}
+		if result.RowsAffected == 0 {
 			return fmt.Errorf("product not found: %w", model.ErrInvalidUserInput)
 		}
-		return fmt.Errorf("failed to delete product: %w", err)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-
-	return nil
+	return images, nil
 }
 
 func (db *DB) FetchUserOrders(userID uint) ([]model.Order, error) {
 	var orders []model.Order
-	if err := db.client.Where("user_id = ?", userID).Find(&orders).Error; err != nil {
+	if err := db.client.Preload("Items").Where("user_id = ?", userID).Find(&orders).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) || errors.Is(err, gorm.ErrEmptySlice) {
 			return orders, nil
 		}
@@ -177,33 +411,192 @@ func (db *DB) FetchUserOrders(userID uint) ([]model.Order, error) {
 	return orders, nil
 }
 
-// FetchOrderByID retrieves a single order by its ID
-func (db *DB) FetchOrderByID(id uint) (model.Order, error) {
+// FetchOrderByID retrieves a single order by its ID if it is visible to actor.
+// Actors granted model.PermissionOrderReadAny can see every order.
+func (db *DB) FetchOrderByID(id uint, actor model.Actor) (model.Order, error) {
 	var order model.Order
-	if err := db.client.First(&order, id).Error; err != nil {
+	if err := db.client.Scopes(ownedBy(actor, model.PermissionOrderReadAny)).Preload("Items").First(&order, id).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return model.Order{}, fmt.Errorf("order not found: %w", model.ErrInvalidUserInput)
+			return model.Order{}, fmt.Errorf("order not found: %w", model.ErrNotFound)
 		}
 		return order, fmt.Errorf("error fetching order: %w", err)
 	}
 	return order, nil
 }
 
-func (db *DB) CancelOrder(id uint) error {
+// CancelOrder cancels a pending order owned by actor and returns its reserved stock to inventory.
+// Actors granted model.PermissionOrderCancelAny may cancel any order.
+func (db *DB) CancelOrder(id uint, actor model.Actor) error {
+	return db.client.Transaction(func(tx *gorm.DB) error {
+		var order model.Order
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Scopes(ownedBy(actor, model.PermissionOrderCancelAny)).First(&order, id).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("order not found: %w", model.ErrNotFound)
+			}
+			return fmt.Errorf("error fetching order: %w", err)
+		}
+
+		if order.Status != model.OrderStatusPending {
+			return fmt.Errorf("only pending orders can be cancelled: %w", model.ErrInvalidUserInput)
+		}
+
+		if err := restockOrder(tx, order.ID); err != nil {
+			return err
+		}
+
+		from := order.Status
+		if err := tx.Model(&order).Update("status", model.OrderStatusCanceled).Error; err != nil {
+			return fmt.Errorf("failed to cancel order: %w", err)
+		}
+		return recordStatusChange(tx, order.ID, from, model.OrderStatusCanceled, actor.UserID, "")
+	})
+}
+
+// CreateOrder places a new pending order for userID.
+//
+// Each item's price is snapshotted from the product's current price and the order total
+// is computed from those snapshots. Repeated product IDs are merged into a single line item.
+// Stock for every item is reserved in the same transaction that creates the order,
+// so the order is rejected as a whole if any product is out of stock.
+// The selected shipping and billing addresses are copied from the user's address book into the order.
+func (db *DB) CreateOrder(userID uint, items []model.OrderItemInput, addresses model.AddressSelection) (model.Order, error) {
 	var order model.Order
-	if err := db.client.First(&order, id).Error; err != nil {
+	err := db.client.Transaction(func(tx *gorm.DB) error {
+		var err error
+		order, err = createOrder(tx, userID, items, addresses)
 		return err
+	})
+	if err != nil {
+		return model.Order{}, err
+	}
+
+	return order, nil
+}
+
+// createOrder places an order within tx, as described by CreateOrder.
+func createOrder(tx *gorm.DB, userID uint, items []model.OrderItemInput, addresses model.AddressSelection) (model.Order, error) {
+	lines, err := mergeOrderItems(items)
+	if err != nil {
+		return model.Order{}, err
+	}
+
+	order := model.Order{
+		UserID: userID,
+		Status: model.OrderStatusPending,
+	}
+	order.ShippingAddress, order.BillingAddress, err = resolveOrderAddresses(tx, userID, addresses)
+	if err != nil {
+		return model.Order{}, err
+	}
+
+	locked, err := reserveStock(tx, lines)
+	if err != nil {
+		return model.Order{}, err
+	}
+	var variantIDs []uint
+	for _, line := range lines {
+		if line.VariantID != 0 {
+			variantIDs = append(variantIDs, line.VariantID)
+		}
+	}
+	variants, err := loadVariants(tx, variantIDs)
+	if err != nil {
+		return model.Order{}, err
+	}
+
+	for _, line := range lines {
+		product := locked.products[line.ProductID]
+		item := model.OrderItem{
+			ProductID: product.ID,
+			Quantity:  line.Quantity,
+			Price:     product.Price,
+		}
+		if line.VariantID != 0 {
+			variant := variants[line.VariantID]
+			item.VariantID = &variant.ID
+			item.SKU = variant.SKU
+			item.VariantLabel = variant.Label()
+			item.Price = variant.PriceOf(product)
+		}
+		order.Items = append(order.Items, item)
+		order.Total += item.Price * float64(line.Quantity)
+	}
+
+	if err := tx.Create(&order).Error; err != nil {
+		return model.Order{}, fmt.Errorf("failed to create order: %w", err)
+	}
+	if err := recordStatusChange(tx, order.ID, model.OrderStatusUnknown, order.Status, userID, ""); err != nil {
+		return model.Order{}, err
+	}
+	return order, nil
+}
+
+// mergeOrderItems validates items and merges lines referencing the same product and variant,
+// preserving the order in which they first appear.
+func mergeOrderItems(items []model.OrderItemInput) ([]model.OrderItemInput, error) {
+	if len(items) == 0 {
+		return nil, fmt.Errorf("order must contain at least one item: %w", model.ErrInvalidUserInput)
 	}
 
-	if order.Status != model.OrderStatusPending {
-		return errors.New("only pending orders can be cancelled")
+	type key struct{ productID, variantID uint }
+	index := make(map[key]int, len(items))
+	merged := make([]model.OrderItemInput, 0, len(items))
+	for _, item := range items {
+		if item.Quantity <= 0 {
+			return nil, fmt.Errorf("quantity for product %d must be positive: %w", item.ProductID, model.ErrInvalidUserInput)
+		}
+		k := key{item.ProductID, item.VariantID}
+		if i, ok := index[k]; ok {
+			merged[i].Quantity += item.Quantity
+			continue
+		}
+		index[k] = len(merged)
+		merged = append(merged, item)
 	}
+	return merged, nil
+}
 
-	order.Status = model.OrderStatusCanceled
-	return db.client.Save(&order).Error
+// FetchOrderStatusHistory returns the status timeline of an order visible to actor, oldest change first.
+func (db *DB) FetchOrderStatusHistory(orderID uint, actor model.Actor) ([]model.OrderStatusChange, error) {
+	var order model.Order
+	if err := db.client.Scopes(ownedBy(actor, model.PermissionOrderReadAny)).Select("id").First(&order, orderID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("order not found: %w", model.ErrNotFound)
+		}
+		return nil, fmt.Errorf("error fetching order: %w", err)
+	}
+
+	history := make([]model.OrderStatusChange, 0)
+	err := db.client.Where("order_id = ?", orderID).Order("created_at, id").Find(&history).Error
+	if err != nil {
+		return nil, fmt.Errorf("error fetching status history of order %d: %w", orderID, err)
+	}
+	return history, nil
+}
+
+// recordStatusChange appends a transition to the status history of an order.
+func recordStatusChange(tx *gorm.DB, orderID uint, from, to model.OrderStatus, actorID uint, note string) error {
+	change := model.OrderStatusChange{
+		OrderID:    orderID,
+		FromStatus: from,
+		ToStatus:   to,
+		ActorID:    actorID,
+		Note:       note,
+	}
+	if err := tx.Create(&change).Error; err != nil {
+		return fmt.Errorf("failed to record status change of order %d: %w", orderID, err)
+	}
+	return nil
 }
 
-func (db *DB) CreateOrder(order model.Order) (uint, error) {
-	err := db.client.Create(&order).Error
-	return order.ID, err
+// ownedBy restricts order queries to orders placed by actor,
+// unless actor has been granted the permission to act on any order.
+func ownedBy(actor model.Actor, anyOrder model.Permission) func(*gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		if actor.Can(anyOrder) {
+			return tx
+		}
+		return tx.Where("user_id = ?", actor.UserID)
+	}
 }
@@ -0,0 +1,63 @@
+package db
+
+import (
+	"fmt"
+	"instashop/api/model"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+// BeginIdempotentRequest claims the idempotency key of record for a new request.
+// If the key is already claimed within its scope, the existing record is returned with claimed set to false,
+// unless it was claimed more than lease ago for the same request and never completed: that request is assumed
+// to have crashed, and the key is claimed again.
+// Expired keys are purged first, so they can be claimed again.
+func (db *DB) BeginIdempotentRequest(record model.IdempotencyKey, lease time.Duration) (existing model.IdempotencyKey, claimed bool, err error) {
+	if err := db.client.Where("expires_at < ?", time.Now()).Delete(&model.IdempotencyKey{}).Error; err != nil {
+		return model.IdempotencyKey{}, false, fmt.Errorf("failed to purge expired idempotency keys: %w", err)
+	}
+
+	res := db.client.Clauses(clause.OnConflict{DoNothing: true}).Create(&record)
+	if res.Error != nil {
+		return model.IdempotencyKey{}, false, fmt.Errorf("failed to store idempotency key: %w", res.Error)
+	}
+	if res.RowsAffected == 1 {
+		return record, true, nil
+	}
+
+	res = db.client.Model(&model.IdempotencyKey{}).
+		Where("scope = ? AND key = ? AND fingerprint = ? AND response_status = 0 AND started_at < ?",
+			record.Scope, record.Key, record.Fingerprint, record.StartedAt.Add(-lease)).
+		Updates(map[string]interface{}{"started_at": record.StartedAt, "expires_at": record.ExpiresAt})
+	if res.Error != nil {
+		return model.IdempotencyKey{}, false, fmt.Errorf("failed to reclaim idempotency key: %w", res.Error)
+	}
+	claimed = res.RowsAffected == 1
+
+	if err := db.client.Where("scope = ? AND key = ?", record.Scope, record.Key).First(&existing).Error; err != nil {
+		return model.IdempotencyKey{}, false, fmt.Errorf("error fetching idempotency key: %w", err)
+	}
+	return existing, claimed, nil
+}
+
+// CompleteIdempotentRequest records the response of the request that claimed an idempotency key.
+func (db *DB) CompleteIdempotentRequest(id uint, status int, contentType string, body []byte) error {
+	err := db.client.Model(&model.IdempotencyKey{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"response_status":       status,
+		"response_content_type": contentType,
+		"response_body":         body,
+	}).Error
+	if err != nil {
+		return fmt.Errorf("failed to record idempotent response: %w", err)
+	}
+	return nil
+}
+
+// ReleaseIdempotencyKey forgets an idempotency key whose request failed, so that the request can be retried.
+func (db *DB) ReleaseIdempotencyKey(id uint) error {
+	if err := db.client.Delete(&model.IdempotencyKey{}, id).Error; err != nil {
+		return fmt.Errorf("failed to release idempotency key: %w", err)
+	}
+	return nil
+}
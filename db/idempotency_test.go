@@ -0,0 +1,46 @@
+package db
+
+import (
+	"fmt"
+	"instashop/api/model"
+	"testing"
+	"time"
+)
+
+func TestInProgressIdempotencyKeysAreReclaimedAfterTheirLease(t *testing.T) {
+	db := newTestDB(t)
+	const lease = time.Minute
+	started := time.Now().Add(-2 * lease)
+	record := model.IdempotencyKey{
+		Scope:       fmt.Sprintf("test:%d", time.Now().UnixNano()),
+		Key:         "key",
+		Fingerprint: "fingerprint",
+		StartedAt:   started,
+		ExpiresAt:   time.Now().Add(time.Hour),
+	}
+	first, claimed, err := db.BeginIdempotentRequest(record, lease)
+	if err != nil || !claimed {
+		t.Fatalf("first claim: claimed = %v, err = %v", claimed, err)
+	}
+
+	other := record
+	other.Fingerprint = "other"
+	other.StartedAt = time.Now()
+	if _, claimed, err := db.BeginIdempotentRequest(other, lease); err != nil || claimed {
+		t.Fatalf("claim for a different request: claimed = %v, err = %v, want false", claimed, err)
+	}
+
+	retry := record
+	retry.StartedAt = time.Now()
+	reclaimed, claimed, err := db.BeginIdempotentRequest(retry, lease)
+	if err != nil || !claimed {
+		t.Fatalf("claim after the lease: claimed = %v, err = %v, want true", claimed, err)
+	}
+	if reclaimed.ID != first.ID {
+		t.Errorf("reclaimed key %d, want %d", reclaimed.ID, first.ID)
+	}
+
+	if _, claimed, err := db.BeginIdempotentRequest(retry, lease); err != nil || claimed {
+		t.Fatalf("claim within the lease: claimed = %v, err = %v, want false", claimed, err)
+	}
+}
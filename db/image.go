@@ -0,0 +1,121 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"instashop/api/model"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// AddProductImage appends image to the end of the gallery of image.ProductID, filling in its ID and position.
+// Galleries are limited to model.MaxProductImages images.
+func (db *DB) AddProductImage(image *model.ProductImage) error {
+	return db.client.Transaction(func(tx *gorm.DB) error {
+		if err := lockProduct(tx, image.ProductID); err != nil {
+			return err
+		}
+
+		var count int64
+		if err := tx.Model(&model.ProductImage{}).Where("product_id = ?", image.ProductID).Count(&count).Error; err != nil {
+			return fmt.Errorf("error counting product images: %w", err)
+		}
+		if count >= model.MaxProductImages {
+			return fmt.Errorf("a product can have at most %d images: %w", model.MaxProductImages, model.ErrInvalidUserInput)
+		}
+
+		image.Position = int(count)
+		if err := tx.Create(image).Error; err != nil {
+			return fmt.Errorf("failed to create product image: %w", err)
+		}
+		return nil
+	})
+}
+
+// ReorderProductImages orders the gallery of a product as listed by imageIDs, which must list each of its images once.
+func (db *DB) ReorderProductImages(productID uint, imageIDs []uint) ([]model.ProductImage, error) {
+	var images []model.ProductImage
+	err := db.client.Transaction(func(tx *gorm.DB) error {
+		if err := lockProduct(tx, productID); err != nil {
+			return err
+		}
+		if err := tx.Where("product_id = ?", productID).Find(&images).Error; err != nil {
+			return fmt.Errorf("error fetching product images: %w", err)
+		}
+
+		positions := make(map[uint]int, len(imageIDs))
+		for i, id := range imageIDs {
+			if _, ok := positions[id]; ok {
+				return fmt.Errorf("image %d is listed twice: %w", id, model.ErrInvalidUserInput)
+			}
+			positions[id] = i
+		}
+		if len(positions) != len(images) {
+			return fmt.Errorf("every image of the product must be listed: %w", model.ErrInvalidUserInput)
+		}
+		for i, image := range images {
+			position, ok := positions[image.ID]
+			if !ok {
+				return fmt.Errorf("every image of the product must be listed: %w", model.ErrInvalidUserInput)
+			}
+			if err := tx.Model(&image).Update("position", position).Error; err != nil {
+				return fmt.Errorf("failed to reorder product images: %w", err)
+			}
+			images[i].Position = position
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ordered := make([]model.ProductImage, len(images))
+	for _, image := range images {
+		ordered[image.Position] = image
+	}
+	return ordered, nil
+}
+
+// DeleteProductImage removes an image from the gallery of a product, closing the gap in the positions of the others.
+// It returns the deleted image so that the caller can delete its blobs.
+func (db *DB) DeleteProductImage(productID, imageID uint) (model.ProductImage, error) {
+	var image model.ProductImage
+	err := db.client.Transaction(func(tx *gorm.DB) error {
+		if err := lockProduct(tx, productID); err != nil {
+			return err
+		}
+		if err := tx.Where("id = ? AND product_id = ?", imageID, productID).First(&image).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("image %d of product %d not found: %w", imageID, productID, model.ErrNotFound)
+			}
+			return fmt.Errorf("error fetching product image: %w", err)
+		}
+
+		if err := tx.Delete(&image).Error; err != nil {
+			return fmt.Errorf("failed to delete product image: %w", err)
+		}
+		err := tx.Model(&model.ProductImage{}).Where("product_id = ? AND position > ?", productID, image.Position).
+			Update("position", gorm.Expr("position - 1")).Error
+		if err != nil {
+			return fmt.Errorf("failed to reorder product images: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return model.ProductImage{}, err
+	}
+	return image, nil
+}
+
+// lockProduct locks a product for the rest of tx, serializing changes to its gallery.
+func lockProduct(tx *gorm.DB, productID uint) error {
+	var product model.Product
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").First(&product, productID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("product %d not found: %w", productID, model.ErrNotFound)
+		}
+		return fmt.Errorf("error fetching product: %w", err)
+	}
+	return nil
+}
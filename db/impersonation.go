@@ -0,0 +1,68 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"instashop/api/model"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// CreateImpersonation stores a new impersonation, generating its ID.
+func (db *DB) CreateImpersonation(imp *model.Impersonation) error {
+	id, err := newSessionID()
+	if err != nil {
+		return err
+	}
+	imp.ID = id
+
+	if err := db.client.Create(imp).Error; err != nil {
+		return fmt.Errorf("failed to create impersonation: %w", err)
+	}
+	return nil
+}
+
+// FetchImpersonation retrieves an impersonation by ID, whether or not it is still active.
+func (db *DB) FetchImpersonation(id string) (model.Impersonation, error) {
+	var imp model.Impersonation
+	if err := db.client.Where("id = ?", id).First(&imp).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return model.Impersonation{}, fmt.Errorf("impersonation not found: %w", model.ErrNotFound)
+		}
+		return model.Impersonation{}, fmt.Errorf("error fetching impersonation: %w", err)
+	}
+	return imp, nil
+}
+
+// EndImpersonation ends an impersonation before it expires, invalidating its token.
+func (db *DB) EndImpersonation(id string) error {
+	res := db.client.Model(&model.Impersonation{}).
+		Where("id = ? AND ended_at IS NULL", id).
+		Update("ended_at", time.Now())
+	if res.Error != nil {
+		return fmt.Errorf("failed to end impersonation: %w", res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("impersonation %s not found: %w", id, model.ErrNotFound)
+	}
+	return nil
+}
+
+// RecordAuditLogEntry appends an entry to the audit log.
+func (db *DB) RecordAuditLogEntry(entry model.AuditLogEntry) error {
+	if err := db.client.Create(&entry).Error; err != nil {
+		return fmt.Errorf("failed to record audit log entry: %w", err)
+	}
+	return nil
+}
+
+// FetchAuditLog returns the audit log of an impersonation in chronological order.
+func (db *DB) FetchAuditLog(impersonationID string) ([]model.AuditLogEntry, error) {
+	entries := make([]model.AuditLogEntry, 0)
+	err := db.client.Where("impersonation_id = ?", impersonationID).Order("id").Find(&entries).Error
+	if err != nil {
+		return nil, fmt.Errorf("error fetching audit log: %w", err)
+	}
+	return entries, nil
+}
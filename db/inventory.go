@@ -0,0 +1,148 @@
+package db
+
+import (
+	"fmt"
+	"instashop/api/model"
+	"sort"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// reservation holds the products and variants locked by reserveStock, keyed by id,
+// with quantities as they were before the reservation.
+type reservation struct {
+	products map[uint]model.Product
+	variants map[uint]model.ProductVariant
+}
+
+// reserveStock locks every product referenced by lines, along with its variants,
+// and decrements the stock of the ordered products and variants by the requested quantity.
+//
+// Rows are locked in ascending id order so that concurrent checkouts over overlapping products
+// cannot deadlock. Lines for products with variants must name one of the product's variants.
+// If any product or variant lacks enough stock, nothing is decremented and a
+// *model.OutOfStockError listing every offending line is returned.
+func reserveStock(tx *gorm.DB, lines []model.OrderItemInput) (reservation, error) {
+	ids := make([]uint, 0, len(lines))
+	for _, line := range lines {
+		ids = append(ids, line.ProductID)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var products []model.Product
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("id IN ?", ids).
+		Order("id").
+		Find(&products).Error
+	if err != nil {
+		return reservation{}, fmt.Errorf("error locking products: %w", err)
+	}
+	var variants []model.ProductVariant
+	err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("product_id IN ?", ids).
+		Order("id").
+		Find(&variants).Error
+	if err != nil {
+		return reservation{}, fmt.Errorf("error locking product variants: %w", err)
+	}
+
+	locked := reservation{
+		products: make(map[uint]model.Product, len(products)),
+		variants: make(map[uint]model.ProductVariant, len(variants)),
+	}
+	for _, product := range products {
+		locked.products[product.ID] = product
+	}
+	hasVariants := make(map[uint]bool)
+	for _, variant := range variants {
+		locked.variants[variant.ID] = variant
+		hasVariants[variant.ProductID] = true
+	}
+
+	var shortages []model.StockShortage
+	for _, line := range lines {
+		product, ok := locked.products[line.ProductID]
+		if !ok {
+			return reservation{}, fmt.Errorf("product %d not found: %w", line.ProductID, model.ErrInvalidUserInput)
+		}
+		shortage := model.StockShortage{ProductID: product.ID, Name: product.Name, Requested: line.Quantity, Available: product.Quantity}
+
+		switch {
+		case line.VariantID != 0:
+			variant, ok := locked.variants[line.VariantID]
+			if !ok || variant.ProductID != product.ID {
+				return reservation{}, fmt.Errorf("variant %d of product %d not found: %w", line.VariantID, product.ID, model.ErrInvalidUserInput)
+			}
+			shortage.VariantID, shortage.SKU, shortage.Available = variant.ID, variant.SKU, variant.Quantity
+		case hasVariants[product.ID]:
+			return reservation{}, fmt.Errorf("product %d is sold in variants, choose one: %w", product.ID, model.ErrInvalidUserInput)
+		}
+		if shortage.Available < line.Quantity {
+			shortages = append(shortages, shortage)
+		}
+	}
+	if len(shortages) > 0 {
+		return reservation{}, &model.OutOfStockError{Shortages: shortages}
+	}
+
+	for _, line := range lines {
+		if err := adjustStock(tx, line.ProductID, line.VariantID, -line.Quantity); err != nil {
+			return reservation{}, err
+		}
+	}
+
+	return locked, nil
+}
+
+// restockOrder returns the quantities of every item in order to the product inventory.
+// Soft-deleted products and variants are restocked too so that restoring them later yields accurate stock.
+func restockOrder(tx *gorm.DB, orderID uint) error {
+	var items []model.OrderItem
+	if err := tx.Where("order_id = ?", orderID).Order("product_id").Find(&items).Error; err != nil {
+		return fmt.Errorf("error fetching items of order %d: %w", orderID, err)
+	}
+
+	for _, item := range items {
+		var variantID uint
+		if item.VariantID != nil {
+			variantID = *item.VariantID
+		}
+		if err := adjustStock(tx, item.ProductID, variantID, item.Quantity); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// adjustStock adds delta to the stock of a product or, if variantID is not zero, of its variant.
+// The stock of a product with variants is then recomputed as the sum of the stock of its variants,
+// so that stock returned to a deleted variant does not count towards its product.
+func adjustStock(tx *gorm.DB, productID, variantID uint, delta int) error {
+	if variantID == 0 {
+		err := tx.Unscoped().Model(&model.Product{}).
+			Where("id = ?", productID).
+			Update("quantity", gorm.Expr("quantity + ?", delta)).Error
+		if err != nil {
+			return fmt.Errorf("failed to update stock of product %d: %w", productID, err)
+		}
+		return nil
+	}
+	err := tx.Unscoped().Model(&model.ProductVariant{}).
+		Where("id = ?", variantID).
+		Update("quantity", gorm.Expr("quantity + ?", delta)).Error
+	if err != nil {
+		return fmt.Errorf("failed to update stock of variant %d: %w", variantID, err)
+	}
+	return syncProductStock(tx, productID)
+}
+
+// releasesStock reports whether an order in the given status no longer holds its reserved stock.
+func releasesStock(status model.OrderStatus) bool {
+	switch status {
+	case model.OrderStatusCanceled, model.OrderStatusReturned, model.OrderStatusRefunded, model.OrderStatusFailed:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,98 @@
+package db
+
+import (
+	"fmt"
+	"instashop/api/model"
+	"testing"
+	"time"
+)
+
+// variantStock returns the stock of a product and of its variants, deleted or not, by SKU.
+func variantStock(t *testing.T, db *DB, productID uint) (int, map[string]int) {
+	t.Helper()
+	var product model.Product
+	if err := db.client.Unscoped().First(&product, productID).Error; err != nil {
+		t.Fatalf("fetching product: %v", err)
+	}
+	var variants []model.ProductVariant
+	if err := db.client.Unscoped().Where("product_id = ?", productID).Find(&variants).Error; err != nil {
+		t.Fatalf("fetching variants: %v", err)
+	}
+	stock := make(map[string]int, len(variants))
+	for _, v := range variants {
+		stock[v.SKU] = v.Quantity
+	}
+	return product.Quantity, stock
+}
+
+func TestRestockingADeletedVariantLeavesProductStockTheSumOfLiveVariants(t *testing.T) {
+	db := newTestDB(t)
+	userID := registerTestUser(t, db, "restock")
+	owner := model.Actor{UserID: userID}
+	productID, err := db.CreateProduct(model.Product{Name: "Restock test shirt", Price: 10})
+	if err != nil {
+		t.Fatalf("creating product: %v", err)
+	}
+
+	prefix := fmt.Sprintf("RESTOCK%d", time.Now().UnixNano())
+	product, err := db.GenerateVariants(productID, model.VariantMatrix{
+		SKUPrefix: prefix,
+		Options:   []model.VariantMatrixOption{{Name: "Size", Values: []string{"S", "M"}}},
+	})
+	if err != nil {
+		t.Fatalf("generating variants: %v", err)
+	}
+	ids := make(map[string]uint)
+	for _, v := range product.Variants {
+		v.Quantity = 5
+		if err := db.UpdateVariant(&v); err != nil {
+			t.Fatalf("stocking variant %s: %v", v.SKU, err)
+		}
+		ids[v.SKU] = v.ID
+	}
+	small, medium := prefix+"-S", prefix+"-M"
+
+	check := func(step string, wantProduct int, wantVariants map[string]int) {
+		t.Helper()
+		gotProduct, gotVariants := variantStock(t, db, productID)
+		if gotProduct != wantProduct {
+			t.Errorf("%s: product stock = %d, want %d", step, gotProduct, wantProduct)
+		}
+		for sku, want := range wantVariants {
+			if gotVariants[sku] != want {
+				t.Errorf("%s: stock of %s = %d, want %d", step, sku, gotVariants[sku], want)
+			}
+		}
+	}
+	check("stocked", 10, map[string]int{small: 5, medium: 5})
+
+	reserved, err := db.CreateOrder(userID, []model.OrderItemInput{{ProductID: productID, VariantID: ids[small], Quantity: 2}}, model.AddressSelection{})
+	if err != nil {
+		t.Fatalf("creating order: %v", err)
+	}
+	check("reserved", 8, map[string]int{small: 3, medium: 5})
+
+	canceled, err := db.CreateOrder(userID, []model.OrderItemInput{{ProductID: productID, VariantID: ids[medium], Quantity: 1}}, model.AddressSelection{})
+	if err != nil {
+		t.Fatalf("creating order: %v", err)
+	}
+	if err := db.CancelOrder(canceled.ID, owner); err != nil {
+		t.Fatalf("canceling order: %v", err)
+	}
+	check("canceled", 8, map[string]int{small: 3, medium: 5})
+
+	// dropping size S deletes its variant while an order still holds its stock
+	_, err = db.GenerateVariants(productID, model.VariantMatrix{
+		SKUPrefix: prefix,
+		Options:   []model.VariantMatrixOption{{Name: "Size", Values: []string{"M"}}},
+	})
+	if err != nil {
+		t.Fatalf("regenerating variants: %v", err)
+	}
+	check("variant deleted", 5, map[string]int{small: 3, medium: 5})
+
+	if err := db.CancelOrder(reserved.ID, owner); err != nil {
+		t.Fatalf("canceling order of the deleted variant: %v", err)
+	}
+	check("restocked", 5, map[string]int{small: 5, medium: 5})
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"instashop/api/model"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// FetchUserByID retrieves a user along with its roles.
+func (db *DB) FetchUserByID(id uint) (model.User, error) {
+	var user model.User
+	if err := db.client.Preload("Roles.Permissions").First(&user, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return model.User{}, fmt.Errorf("user not found: %w", model.ErrNotFound)
+		}
+		return model.User{}, fmt.Errorf("error fetching user: %w", err)
+	}
+	return user, nil
+}
+
+// SetMFASecret stores a pending TOTP secret for a user who has not enabled two-factor authentication yet.
+func (db *DB) SetMFASecret(userID uint, secret string) error {
+	res := db.client.Model(&model.User{}).
+		Where("id = ? AND mfa_enabled_at IS NULL", userID).
+		Update("mfa_secret", secret)
+	if res.Error != nil {
+		return fmt.Errorf("failed to store MFA secret: %w", res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("two-factor authentication already enabled: %w", model.ErrInvalidUserInput)
+	}
+	return nil
+}
+
+// EnableMFA turns on two-factor authentication with the pending secret of a user,
+// recording step as the last accepted TOTP step and replacing the user's recovery codes.
+func (db *DB) EnableMFA(userID uint, step int64, recoveryCodeHashes []string) error {
+	return db.client.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&model.User{}).
+			Where("id = ? AND mfa_enabled_at IS NULL AND mfa_secret <> ''", userID).
+			Updates(map[string]interface{}{"mfa_enabled_at": time.Now(), "mfa_last_step": step})
+		if res.Error != nil {
+			return fmt.Errorf("failed to enable MFA: %w", res.Error)
+		}
+		if res.RowsAffected == 0 {
+			return fmt.Errorf("no pending two-factor enrollment: %w", model.ErrInvalidUserInput)
+		}
+		return replaceRecoveryCodes(tx, userID, recoveryCodeHashes)
+	})
+}
+
+// DisableMFA turns off two-factor authentication for a user and deletes its recovery codes.
+func (db *DB) DisableMFA(userID uint) error {
+	return db.client.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&model.User{}).Where("id = ?", userID).
+			Updates(map[string]interface{}{"mfa_secret": "", "mfa_enabled_at": nil, "mfa_last_step": 0}).Error
+		if err != nil {
+			return fmt.Errorf("failed to disable MFA: %w", err)
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&model.RecoveryCode{}).Error; err != nil {
+			return fmt.Errorf("failed to delete recovery codes: %w", err)
+		}
+		return nil
+	})
+}
+
+// ConsumeMFAStep records step as the last accepted TOTP step of a user.
+// It reports false if a code from the same or a later step has already been accepted.
+func (db *DB) ConsumeMFAStep(userID uint, step int64) (bool, error) {
+	res := db.client.Model(&model.User{}).
+		Where("id = ? AND mfa_last_step < ?", userID, step).
+		Update("mfa_last_step", step)
+	if res.Error != nil {
+		return false, fmt.Errorf("failed to record MFA step: %w", res.Error)
+	}
+	return res.RowsAffected > 0, nil
+}
+
+// UseRecoveryCode marks an unused recovery code of a user as used.
+func (db *DB) UseRecoveryCode(userID uint, codeHash string) error {
+	res := db.client.Model(&model.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, codeHash).
+		Update("used_at", time.Now())
+	if res.Error != nil {
+		return fmt.Errorf("failed to use recovery code: %w", res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("invalid recovery code: %w", model.ErrInvalidUserInput)
+	}
+	return nil
+}
+
+// ReplaceRecoveryCodes discards the recovery codes of a user and stores new ones.
+func (db *DB) ReplaceRecoveryCodes(userID uint, codeHashes []string) error {
+	return db.client.Transaction(func(tx *gorm.DB) error {
+		return replaceRecoveryCodes(tx, userID, codeHashes)
+	})
+}
+
+func replaceRecoveryCodes(tx *gorm.DB, userID uint, codeHashes []string) error {
+	if err := tx.Where("user_id = ?", userID).Delete(&model.RecoveryCode{}).Error; err != nil {
+		return fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+
+	codes := make([]model.RecoveryCode, 0, len(codeHashes))
+	for _, hash := range codeHashes {
+		codes = append(codes, model.RecoveryCode{UserID: userID, CodeHash: hash})
+	}
+	if err := tx.Create(&codes).Error; err != nil {
+		return fmt.Errorf("failed to store recovery codes: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package db
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// migrations holds the schema changes AutoMigrate cannot express, such as extensions, generated columns
+// and specialised indexes. Files are applied once each, in the order of their names.
+//
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// migrationsLockID identifies the advisory lock serialising migrations between instances starting concurrently.
+const migrationsLockID = 7295031
+
+// applyMigrations applies the migrations not yet recorded in the schema_migrations table.
+// Each migration runs in its own transaction along with its record, so a failed migration can be retried.
+// It runs after AutoMigrate, since migrations alter the tables AutoMigrate creates.
+func applyMigrations(db *gorm.DB) error {
+	err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version varchar(255) PRIMARY KEY,
+		applied_at timestamptz NOT NULL DEFAULT now()
+	)`).Error
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	names, err := fs.Glob(migrations, "migrations/*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		version := strings.TrimSuffix(strings.TrimPrefix(name, "migrations/"), ".sql")
+		script, err := migrations.ReadFile(name)
+		if err != nil {
+			return err
+		}
+
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", migrationsLockID).Error; err != nil {
+				return fmt.Errorf("failed to lock migrations: %w", err)
+			}
+			var applied int64
+			if err := tx.Table("schema_migrations").Where("version = ?", version).Count(&applied).Error; err != nil {
+				return fmt.Errorf("error checking migration: %w", err)
+			}
+			if applied > 0 {
+				return nil
+			}
+
+			if err := tx.Exec(string(script)).Error; err != nil {
+				return err
+			}
+			return tx.Exec("INSERT INTO schema_migrations (version) VALUES (?)", version).Error
+		})
+		if err != nil {
+			return fmt.Errorf("failed to apply migration %s: %w", version, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+-- Full-text search over the product catalog.
+--
+-- search_vector is a generated column, so PostgreSQL keeps it and its index up to date
+-- whenever a product's name or description changes. Names weigh more than descriptions in rankings.
+-- The trigram index on names makes searches tolerant to typos.
+
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+ALTER TABLE products ADD COLUMN IF NOT EXISTS search_vector tsvector
+    GENERATED ALWAYS AS (
+        setweight(to_tsvector('english', coalesce(name, '')), 'A') ||
+        setweight(to_tsvector('english', coalesce(description, '')), 'B')
+    ) STORED;
+
+CREATE INDEX IF NOT EXISTS idx_products_search_vector ON products USING GIN (search_vector);
+CREATE INDEX IF NOT EXISTS idx_products_name_trgm ON products USING GIN (lower(name) gin_trgm_ops);
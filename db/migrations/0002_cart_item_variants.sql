@@ -0,0 +1,4 @@
+-- Cart items are unique per product and variant, replacing the unique index per product
+-- that AutoMigrate created before variants existed.
+
+DROP INDEX IF EXISTS idx_cart_product;
@@ -0,0 +1,99 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"instashop/api/model"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// CreateOIDCAuthRequest stores a pending sign-in at an external provider.
+// Expired requests are purged on the way.
+func (db *DB) CreateOIDCAuthRequest(req model.OIDCAuthRequest) error {
+	if err := db.client.Where("expires_at < ?", time.Now()).Delete(&model.OIDCAuthRequest{}).Error; err != nil {
+		return fmt.Errorf("failed to purge expired sign-in requests: %w", err)
+	}
+	if err := db.client.Create(&req).Error; err != nil {
+		return fmt.Errorf("failed to create sign-in request: %w", err)
+	}
+	return nil
+}
+
+// ConsumeOIDCAuthRequest deletes and returns the pending sign-in at provider identified by stateHash.
+// Unknown, expired and already consumed requests yield model.ErrInvalidUserInput.
+func (db *DB) ConsumeOIDCAuthRequest(provider, stateHash string) (model.OIDCAuthRequest, error) {
+	var reqs []model.OIDCAuthRequest
+	err := db.client.Clauses(clause.Returning{}).
+		Where("state_hash = ? AND provider = ?", stateHash, provider).
+		Delete(&reqs).Error
+	if err != nil {
+		return model.OIDCAuthRequest{}, fmt.Errorf("failed to consume sign-in request: %w", err)
+	}
+	if len(reqs) == 0 || time.Now().After(reqs[0].ExpiresAt) {
+		return model.OIDCAuthRequest{}, fmt.Errorf("invalid or expired sign-in request: %w", model.ErrInvalidUserInput)
+	}
+	return reqs[0], nil
+}
+
+// SignInWithExternalIdentity returns the user linked to the identity subject at provider.
+//
+// An identity that is not linked yet is linked to the user registered with email, which must have been verified
+// by the provider, or to a new user otherwise. Linking marks the user's email as verified; if it was not verified
+// before, the user's password is cleared and their sessions revoked, since whoever registered the unverified
+// account may not own the address.
+func (db *DB) SignInWithExternalIdentity(provider, subject, email string) (model.User, error) {
+	var userID uint
+	err := db.client.Transaction(func(tx *gorm.DB) error {
+		var identity model.ExternalIdentity
+		err := tx.Where("provider = ? AND subject = ?", provider, subject).First(&identity).Error
+		if err == nil {
+			userID = identity.UserID
+			return nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("error fetching external identity: %w", err)
+		}
+
+		if email == "" {
+			return fmt.Errorf("external identity has no email: %w", model.ErrInvalidUserInput)
+		}
+
+		var user model.User
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("LOWER(email) = LOWER(?)", email).First(&user).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			now := time.Now()
+			// an empty password never matches a bcrypt hash; the user can set one with a password reset
+			user = model.User{Email: email, EmailVerifiedAt: &now}
+			if err := tx.Create(&user).Error; err != nil {
+				return fmt.Errorf("failed to create user: %w", err)
+			}
+		case err != nil:
+			return fmt.Errorf("error fetching user: %w", err)
+		case user.EmailVerifiedAt == nil:
+			now := time.Now()
+			err := tx.Model(&user).Updates(map[string]interface{}{"email_verified_at": now, "password": "", "password_changed_at": now}).Error
+			if err != nil {
+				return fmt.Errorf("failed to verify email: %w", err)
+			}
+			if err := revokeSessions(tx.Where("user_id = ?", user.ID), now); err != nil {
+				return err
+			}
+		}
+
+		identity = model.ExternalIdentity{UserID: user.ID, Provider: provider, Subject: subject, Email: email}
+		if err := tx.Create(&identity).Error; err != nil {
+			return fmt.Errorf("failed to link external identity: %w", err)
+		}
+		userID = user.ID
+		return nil
+	})
+	if err != nil {
+		return model.User{}, err
+	}
+
+	return db.FetchUserByID(userID)
+}
@@ -0,0 +1,62 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"instashop/api/model"
+	"testing"
+	"time"
+)
+
+func TestOIDCAuthRequestsAreConsumedOnce(t *testing.T) {
+	db := newTestDB(t)
+	stateHash := fmt.Sprintf("%064d", time.Now().UnixNano())
+	err := db.CreateOIDCAuthRequest(model.OIDCAuthRequest{
+		StateHash:    stateHash,
+		Provider:     "fake",
+		Nonce:        "nonce",
+		CodeVerifier: "verifier",
+		ExpiresAt:    time.Now().Add(time.Minute),
+	})
+	if err != nil {
+		t.Fatalf("creating sign-in request: %v", err)
+	}
+
+	if _, err := db.ConsumeOIDCAuthRequest("other", stateHash); !errors.Is(err, model.ErrInvalidUserInput) {
+		t.Errorf("consuming at another provider: err = %v, want model.ErrInvalidUserInput", err)
+	}
+	req, err := db.ConsumeOIDCAuthRequest("fake", stateHash)
+	if err != nil || req.CodeVerifier != "verifier" || req.Nonce != "nonce" {
+		t.Fatalf("consuming: request = %+v, err = %v", req, err)
+	}
+	if _, err := db.ConsumeOIDCAuthRequest("fake", stateHash); !errors.Is(err, model.ErrInvalidUserInput) {
+		t.Errorf("consuming again: err = %v, want model.ErrInvalidUserInput", err)
+	}
+}
+
+func TestExternalIdentitiesAreLinkedByEmail(t *testing.T) {
+	db := newTestDB(t)
+	email := fmt.Sprintf("linked-%d@example.com", time.Now().UnixNano())
+	userID, err := db.Register(email, "password123")
+	if err != nil {
+		t.Fatalf("registering: %v", err)
+	}
+	subject := fmt.Sprintf("subject-%d", time.Now().UnixNano())
+
+	user, err := db.SignInWithExternalIdentity("fake", subject, email)
+	if err != nil {
+		t.Fatalf("signing in: %v", err)
+	}
+	if user.ID != userID {
+		t.Fatalf("signed in as user %d, want the registered user %d", user.ID, userID)
+	}
+	// the unverified account may have been registered by someone else, who must not keep access to it
+	if user.EmailVerifiedAt == nil || user.Password != "" {
+		t.Errorf("linked user has email_verified_at %v and a password set, want verified without a password", user.EmailVerifiedAt)
+	}
+
+	again, err := db.SignInWithExternalIdentity("fake", subject, "changed-"+email)
+	if err != nil || again.ID != userID {
+		t.Errorf("signing in again: user %d, err = %v, want user %d", again.ID, err, userID)
+	}
+}
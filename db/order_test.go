@@ -0,0 +1,84 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"instashop/api/model"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestDB connects to the PostgreSQL database of TEST_DSN, skipping the test when it is not set.
+// Tests create their own users and products, so they can share a database.
+func newTestDB(t *testing.T) *DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DSN is not set")
+	}
+	db, err := NewDB(dsn)
+	if err != nil {
+		t.Fatalf("connecting to test database: %v", err)
+	}
+	return db
+}
+
+// registerTestUser registers a user with a unique email and an address to ship orders to.
+func registerTestUser(t *testing.T, db *DB, name string) uint {
+	t.Helper()
+	id, err := db.Register(fmt.Sprintf("%s-%d@example.com", name, time.Now().UnixNano()), "password123")
+	if err != nil {
+		t.Fatalf("registering %s: %v", name, err)
+	}
+	address := model.Address{UserID: id, PostalAddress: model.PostalAddress{FullName: name, Line1: "1 Test Street", City: "Lagos", Country: "NG"}}
+	if err := db.CreateAddress(&address); err != nil {
+		t.Fatalf("creating address of %s: %v", name, err)
+	}
+	return id
+}
+
+func TestOrdersAreScopedToTheirOwner(t *testing.T) {
+	db := newTestDB(t)
+	userA := registerTestUser(t, db, "a")
+	userB := registerTestUser(t, db, "b")
+	productID, err := db.CreateProduct(model.Product{Name: "Scoped order test product", Price: 10, Quantity: 5})
+	if err != nil {
+		t.Fatalf("creating product: %v", err)
+	}
+	order, err := db.CreateOrder(userA, []model.OrderItemInput{{ProductID: productID, Quantity: 1}}, model.AddressSelection{})
+	if err != nil {
+		t.Fatalf("creating order: %v", err)
+	}
+
+	other := model.Actor{UserID: userB}
+	if _, err := db.FetchOrderByID(order.ID, other); !errors.Is(err, model.ErrNotFound) {
+		t.Errorf("FetchOrderByID by another user: err = %v, want model.ErrNotFound", err)
+	}
+	if _, err := db.FetchOrderStatusHistory(order.ID, other); !errors.Is(err, model.ErrNotFound) {
+		t.Errorf("FetchOrderStatusHistory by another user: err = %v, want model.ErrNotFound", err)
+	}
+	if err := db.CancelOrder(order.ID, other); !errors.Is(err, model.ErrNotFound) {
+		t.Errorf("CancelOrder by another user: err = %v, want model.ErrNotFound", err)
+	}
+
+	owner := model.Actor{UserID: userA}
+	fetched, err := db.FetchOrderByID(order.ID, owner)
+	if err != nil {
+		t.Fatalf("FetchOrderByID by owner: %v", err)
+	}
+	if fetched.Status != model.OrderStatusPending {
+		t.Errorf("order status = %d after cancellation by another user, want %d", fetched.Status, model.OrderStatusPending)
+	}
+
+	staff := model.Actor{UserID: userB, Permissions: []model.Permission{model.PermissionOrderReadAny}}
+	if _, err := db.FetchOrderByID(order.ID, staff); err != nil {
+		t.Errorf("FetchOrderByID with %s: %v", model.PermissionOrderReadAny, err)
+	}
+	if _, err := db.FetchOrderStatusHistory(order.ID, staff); err != nil {
+		t.Errorf("FetchOrderStatusHistory with %s: %v", model.PermissionOrderReadAny, err)
+	}
+	if err := db.CancelOrder(order.ID, staff); !errors.Is(err, model.ErrNotFound) {
+		t.Errorf("CancelOrder with only %s: err = %v, want model.ErrNotFound", model.PermissionOrderReadAny, err)
+	}
+}
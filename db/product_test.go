@@ -0,0 +1,73 @@
+package db
+
+import (
+	"fmt"
+	"instashop/api/model"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestProductKeysetPagesHaveNoGapsOrDuplicates(t *testing.T) {
+	db := newTestDB(t)
+	prefix := fmt.Sprintf("keyset-%d-", time.Now().UnixNano())
+
+	// duplicate prices and names, so that positions are only unique with the ID
+	var products []model.Product
+	for _, p := range []struct {
+		name  string
+		price float64
+	}{
+		{"b", 5}, {"a", 5}, {"b", 5}, {"a", 3}, {"c", 8}, {"a", 5}, {"a", 3}, {"b", 8},
+	} {
+		product := model.Product{Name: prefix + p.name, Price: p.price, Quantity: 1}
+		id, err := db.CreateProduct(product)
+		if err != nil {
+			t.Fatalf("creating product: %v", err)
+		}
+		product.ID = id
+		products = append(products, product)
+	}
+	sort.Slice(products, func(i, j int) bool {
+		a, b := products[i], products[j]
+		if a.Price != b.Price {
+			return a.Price > b.Price
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.ID < b.ID
+	})
+
+	sorts, err := model.ParseProductSorts("-price,name")
+	if err != nil {
+		t.Fatalf("parsing sort: %v", err)
+	}
+	query := model.ProductQuery{ProductFilter: model.ProductFilter{NamePrefix: prefix}, Sort: sorts, Limit: 3}
+	var got []uint
+	for pages := 0; ; pages++ {
+		if pages > len(products) {
+			t.Fatalf("paging did not end, got %v", got)
+		}
+		page, err := db.ListProducts(query)
+		if err != nil {
+			t.Fatalf("listing products: %v", err)
+		}
+		for _, p := range page.Products {
+			got = append(got, p.ID)
+		}
+		if page.Next == nil {
+			break
+		}
+		query.After = page.Next
+	}
+
+	if len(got) != len(products) {
+		t.Fatalf("paged through %d products %v, want %d", len(got), got, len(products))
+	}
+	for i, p := range products {
+		if got[i] != p.ID {
+			t.Fatalf("paged through %v, want product %d at position %d", got, p.ID, i)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"instashop/api/model"
+	"sort"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// seedRoles creates the built-in roles and synchronises their permission sets with model.BuiltinRoles.
+func seedRoles(db *gorm.DB) error {
+	names := make([]string, 0, len(model.BuiltinRoles))
+	for name := range model.BuiltinRoles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, name := range names {
+			role := model.Role{Name: name}
+			if err := tx.Where(model.Role{Name: name}).FirstOrCreate(&role).Error; err != nil {
+				return fmt.Errorf("failed to seed role %s: %w", name, err)
+			}
+
+			if err := tx.Where("role_id = ?", role.ID).Delete(&model.RolePermission{}).Error; err != nil {
+				return fmt.Errorf("failed to reset permissions of role %s: %w", name, err)
+			}
+			perms := make([]model.RolePermission, 0, len(model.BuiltinRoles[name]))
+			for _, p := range model.BuiltinRoles[name] {
+				perms = append(perms, model.RolePermission{RoleID: role.ID, Permission: p})
+			}
+			if err := tx.Create(&perms).Error; err != nil {
+				return fmt.Errorf("failed to seed permissions of role %s: %w", name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// migrateAdminFlag grants the admin role to every user flagged with the legacy users.is_admin column
+// and then drops the column.
+func migrateAdminFlag(db *gorm.DB) error {
+	if !db.Migrator().HasColumn(&model.User{}, "is_admin") {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec(`
+			INSERT INTO user_roles (user_id, role_id)
+			SELECT users.id, roles.id FROM users, roles
+			WHERE users.is_admin AND roles.name = ?
+			ON CONFLICT DO NOTHING`, model.RoleAdmin).Error
+		if err != nil {
+			return fmt.Errorf("failed to migrate admin users: %w", err)
+		}
+		if err := tx.Migrator().DropColumn(&model.User{}, "is_admin"); err != nil {
+			return fmt.Errorf("failed to drop users.is_admin: %w", err)
+		}
+		return nil
+	})
+}
+
+// ListRoles returns every role along with its permissions.
+func (db *DB) ListRoles() ([]model.Role, error) {
+	roles := make([]model.Role, 0)
+	if err := db.client.Preload("Permissions").Order("name").Find(&roles).Error; err != nil {
+		return nil, fmt.Errorf("error fetching roles: %w", err)
+	}
+	return roles, nil
+}
+
+// SetUserRoles replaces the roles granted to a user with the roles named in roles.
+// Removing the admin role from the last administrator is rejected.
+func (db *DB) SetUserRoles(userID uint, roles []string) (model.User, error) {
+	var user model.User
+	err := db.client.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, userID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("user %d not found: %w", userID, model.ErrNotFound)
+			}
+			return fmt.Errorf("error fetching user: %w", err)
+		}
+
+		granted := make([]model.Role, 0, len(roles))
+		if len(roles) > 0 {
+			if err := tx.Where("name IN ?", roles).Find(&granted).Error; err != nil {
+				return fmt.Errorf("error fetching roles: %w", err)
+			}
+		}
+		if unknown := unknownRoles(roles, granted); len(unknown) > 0 {
+			return fmt.Errorf("unknown roles %v: %w", unknown, model.ErrInvalidUserInput)
+		}
+
+		if err := tx.Model(&user).Association("Roles").Replace(granted); err != nil {
+			return fmt.Errorf("failed to update user roles: %w", err)
+		}
+		if err := ensureAdminRemains(tx); err != nil {
+			return err
+		}
+		return tx.Preload("Roles.Permissions").First(&user, userID).Error
+	})
+	if err != nil {
+		return model.User{}, err
+	}
+	return user, nil
+}
+
+// unknownRoles returns the names in requested that do not match any of found.
+func unknownRoles(requested []string, found []model.Role) []string {
+	known := make(map[string]bool, len(found))
+	for _, role := range found {
+		known[role.Name] = true
+	}
+	var unknown []string
+	for _, name := range requested {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	return unknown
+}
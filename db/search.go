@@ -0,0 +1,114 @@
+package db
+
+import (
+	"fmt"
+	"html"
+	"instashop/api/model"
+	"strings"
+	"unicode"
+
+	"gorm.io/gorm"
+)
+
+const (
+	defaultSearchResultsPerPage = 20
+	maxSearchResultsPerPage     = 100
+
+	maxSearchTerms = 10
+
+	// searchSimilarityThreshold is the minimum trigram word similarity between the search and a product name
+	// for the product to match despite typos.
+	searchSimilarityThreshold = 0.4
+
+	// highlightStart and highlightStop delimit matches in ts_headline snippets.
+	// They are characters of the Unicode private use area, so that they cannot clash with product text,
+	// and are replaced by <mark> elements once the snippet is HTML-escaped.
+	highlightStart = "\uE000"
+	highlightStop  = "\uE001"
+)
+
+// SearchProducts returns the page of products matching search, best matches first.
+//
+// Products match when their name or description contain every search term, or a word starting with it,
+// or when their name is similar to the search, to tolerate typos.
+// Matches in names rank above matches in descriptions.
+func (db *DB) SearchProducts(search model.ProductSearch) ([]model.ProductSearchResult, error) {
+	if err := search.Validate(); err != nil {
+		return nil, err
+	}
+	terms := searchTerms(search.Query)
+	if len(terms) == 0 {
+		return nil, fmt.Errorf("search has no terms: %w", model.ErrInvalidUserInput)
+	}
+	if len(terms) > maxSearchTerms {
+		return nil, fmt.Errorf("search has more than %d terms: %w", maxSearchTerms, model.ErrInvalidUserInput)
+	}
+
+	// every term matches as a prefix, e.g. "lap" matches "laptop"
+	prefixes := make([]string, len(terms))
+	for i, term := range terms {
+		prefixes[i] = term + ":*"
+	}
+	tsQuery := strings.Join(prefixes, " & ")
+	text := strings.Join(terms, " ")
+
+	page, perPage := search.Page, search.PerPage
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 {
+		perPage = defaultSearchResultsPerPage
+	}
+	if perPage > maxSearchResultsPerPage {
+		perPage = maxSearchResultsPerPage
+	}
+
+	headline := fmt.Sprintf("StartSel=%s, StopSel=%s", highlightStart, highlightStop)
+	results := make([]model.ProductSearchResult, 0)
+	err := db.client.Transaction(func(tx *gorm.DB) error {
+		// applies to the <% operator below, which uses the trigram index
+		err := tx.Exec(fmt.Sprintf("SET LOCAL pg_trgm.word_similarity_threshold = %g", searchSimilarityThreshold)).Error
+		if err != nil {
+			return fmt.Errorf("failed to set similarity threshold: %w", err)
+		}
+
+		q := applyProductFilter(tx.Model(&model.Product{}), search.ProductFilter).
+			Joins("CROSS JOIN to_tsquery('english', ?) AS query", tsQuery).
+			Select(`products.*,
+				ts_rank(products.search_vector, query) + word_similarity(?, lower(products.name)) AS rank,
+				ts_headline('english', products.name, query, ?) AS highlight_name,
+				ts_headline('english', products.description, query, ?) AS highlight_description`,
+				text, headline+", HighlightAll=true", headline+", MaxWords=35, MinWords=15").
+			Where("products.search_vector @@ query OR ? <% lower(products.name)", text).
+			Order("rank DESC").Order("products.id").
+			Offset((page - 1) * perPage).Limit(perPage)
+		if err := q.Scan(&results).Error; err != nil {
+			return fmt.Errorf("error searching products: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range results {
+		results[i].Highlights.Name = markHighlights(results[i].Highlights.Name)
+		results[i].Highlights.Description = markHighlights(results[i].Highlights.Description)
+	}
+	return results, nil
+}
+
+// searchTerms splits a search into lower case words of letters and digits,
+// leaving out the operators of the tsquery syntax.
+func searchTerms(search string) []string {
+	return strings.FieldsFunc(strings.ToLower(search), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// markHighlights HTML-escapes a ts_headline snippet and encloses its matches in <mark> elements.
+func markHighlights(snippet string) string {
+	snippet = html.EscapeString(snippet)
+	snippet = strings.ReplaceAll(snippet, highlightStart, "<mark>")
+	return strings.ReplaceAll(snippet, highlightStop, "</mark>")
+}
@@ -0,0 +1,102 @@
+package db
+
+import (
+	"fmt"
+	"instashop/api/model"
+	"strings"
+	"testing"
+	"time"
+)
+
+// searchTestProducts creates products whose names start with a unique prefix, returned to narrow searches to them.
+func searchTestProducts(t *testing.T, db *DB, products map[string]*model.Product) string {
+	t.Helper()
+	prefix := fmt.Sprintf("srch%d", time.Now().UnixNano())
+	for _, product := range products {
+		product.Name = prefix + " " + product.Name
+		product.Price, product.Quantity = 10, 1
+		id, err := db.CreateProduct(*product)
+		if err != nil {
+			t.Fatalf("creating product %s: %v", product.Name, err)
+		}
+		product.ID = id
+	}
+	return prefix
+}
+
+// resultIDs returns the IDs of results, in order.
+func resultIDs(results []model.ProductSearchResult) []uint {
+	ids := make([]uint, 0, len(results))
+	for _, r := range results {
+		ids = append(ids, r.ID)
+	}
+	return ids
+}
+
+func indexOf(ids []uint, id uint) int {
+	for i, v := range ids {
+		if v == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestSearchProducts(t *testing.T) {
+	db := newTestDB(t)
+	sleeve := &model.Product{Name: "Laptop sleeve", Description: "Padded and water resistant."}
+	lamp := &model.Product{Name: "Desk lamp", Description: "Pairs well with a laptop & <b>tidy</b> desks."}
+	keyboard := &model.Product{Name: "Mechanical keyboard", Description: "Tactile switches."}
+	prefix := searchTestProducts(t, db, map[string]*model.Product{"sleeve": sleeve, "lamp": lamp, "keyboard": keyboard})
+	search := func(query string) []model.ProductSearchResult {
+		t.Helper()
+		results, err := db.SearchProducts(model.ProductSearch{ProductFilter: model.ProductFilter{NamePrefix: prefix}, Query: query})
+		if err != nil {
+			t.Fatalf("searching %q: %v", query, err)
+		}
+		return results
+	}
+
+	t.Run("prefixes match and names rank above descriptions", func(t *testing.T) {
+		ids := resultIDs(search("lap"))
+		inName, inDescription := indexOf(ids, sleeve.ID), indexOf(ids, lamp.ID)
+		if inName < 0 || inDescription < 0 {
+			t.Fatalf("results %v, want the sleeve %d and the lamp %d", ids, sleeve.ID, lamp.ID)
+		}
+		if inName > inDescription {
+			t.Errorf("results %v, want the sleeve %d, matching by name, first", ids, sleeve.ID)
+		}
+		if indexOf(ids, keyboard.ID) >= 0 {
+			t.Errorf("results %v include the keyboard %d", ids, keyboard.ID)
+		}
+	})
+
+	t.Run("names match despite typos", func(t *testing.T) {
+		if ids := resultIDs(search("keybord")); len(ids) != 1 || ids[0] != keyboard.ID {
+			t.Errorf("results %v, want only the keyboard %d", ids, keyboard.ID)
+		}
+	})
+
+	t.Run("highlights are HTML-escaped", func(t *testing.T) {
+		results := search("laptop")
+		for _, r := range results {
+			switch r.ID {
+			case sleeve.ID:
+				if !strings.Contains(r.Highlights.Name, "<mark>Laptop</mark>") {
+					t.Errorf("name highlight = %q, want Laptop marked", r.Highlights.Name)
+				}
+			case lamp.ID:
+				description := r.Highlights.Description
+				if !strings.Contains(description, "<mark>laptop</mark>") {
+					t.Errorf("description highlight = %q, want laptop marked", description)
+				}
+				if !strings.Contains(description, "&amp; &lt;b&gt;tidy&lt;/b&gt;") || strings.Contains(description, "<b>") {
+					t.Errorf("description highlight = %q, want the description HTML-escaped", description)
+				}
+			}
+		}
+		if len(results) != 2 {
+			t.Errorf("results %v, want the sleeve and the lamp", resultIDs(results))
+		}
+	})
+}
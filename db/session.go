@@ -0,0 +1,141 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"instashop/api/model"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// CreateSession starts a new login session for userID, issuing its first refresh token.
+func (db *DB) CreateSession(userID uint, refreshTokenHash string, expiresAt time.Time) (string, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return "", err
+	}
+
+	err = db.client.Transaction(func(tx *gorm.DB) error {
+		session := model.Session{ID: id, UserID: userID}
+		if err := tx.Create(&session).Error; err != nil {
+			return fmt.Errorf("failed to create session: %w", err)
+		}
+
+		token := model.RefreshToken{SessionID: id, TokenHash: refreshTokenHash, ExpiresAt: expiresAt}
+		if err := tx.Create(&token).Error; err != nil {
+			return fmt.Errorf("failed to create refresh token: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// RotateRefreshToken exchanges the refresh token identified by oldHash for a new one identified by newHash.
+//
+// Presenting a refresh token that has already been rotated is treated as token theft:
+// the whole session is revoked and model.ErrRefreshTokenReused is returned.
+// It returns the user owning the session and the session id.
+func (db *DB) RotateRefreshToken(oldHash, newHash string, expiresAt time.Time) (model.User, string, error) {
+	var (
+		user    model.User
+		session model.Session
+		reused  bool
+	)
+	err := db.client.Transaction(func(tx *gorm.DB) error {
+		var token model.RefreshToken
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("token_hash = ?", oldHash).First(&token).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("invalid refresh token: %w", model.ErrInvalidUserInput)
+			}
+			return fmt.Errorf("error fetching refresh token: %w", err)
+		}
+
+		if err := tx.First(&session, "id = ?", token.SessionID).Error; err != nil {
+			return fmt.Errorf("error fetching session: %w", err)
+		}
+		if session.RevokedAt != nil {
+			return fmt.Errorf("session revoked: %w", model.ErrInvalidUserInput)
+		}
+
+		now := time.Now()
+		if token.UsedAt != nil {
+			// the revocation must be committed, so the reuse error is reported after the transaction
+			reused = true
+			return revokeSessions(tx.Where("id = ?", session.ID), now)
+		}
+		if now.After(token.ExpiresAt) {
+			return fmt.Errorf("refresh token expired: %w", model.ErrInvalidUserInput)
+		}
+
+		if err := tx.Model(&token).Update("used_at", now).Error; err != nil {
+			return fmt.Errorf("failed to mark refresh token as used: %w", err)
+		}
+		next := model.RefreshToken{SessionID: session.ID, TokenHash: newHash, ExpiresAt: expiresAt}
+		if err := tx.Create(&next).Error; err != nil {
+			return fmt.Errorf("failed to create refresh token: %w", err)
+		}
+
+		if err := tx.Preload("Roles.Permissions").First(&user, session.UserID).Error; err != nil {
+			return fmt.Errorf("error fetching session user: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return model.User{}, "", err
+	}
+	if reused {
+		return model.User{}, "", model.ErrRefreshTokenReused
+	}
+	return user, session.ID, nil
+}
+
+// RevokeSession revokes a single session belonging to userID.
+func (db *DB) RevokeSession(sessionID string, userID uint) error {
+	return revokeSessions(db.client.Where("id = ? AND user_id = ?", sessionID, userID), time.Now())
+}
+
+// RevokeAllSessions revokes every session of userID, logging the user out of all devices.
+func (db *DB) RevokeAllSessions(userID uint) error {
+	return revokeSessions(db.client.Where("user_id = ?", userID), time.Now())
+}
+
+// IsSessionActive reports whether the session exists and has not been revoked,
+// and its user has been neither disabled nor deleted.
+func (db *DB) IsSessionActive(sessionID string) (bool, error) {
+	var count int64
+	err := db.client.Model(&model.Session{}).
+		Joins("JOIN users ON users.id = sessions.user_id").
+		Where("sessions.id = ? AND sessions.revoked_at IS NULL", sessionID).
+		Where("users.disabled_at IS NULL AND users.deleted_at IS NULL").
+		Count(&count).Error
+	if err != nil {
+		return false, fmt.Errorf("error checking session: %w", err)
+	}
+	return count > 0, nil
+}
+
+// revokeSessions marks the sessions matched by tx as revoked at the given time.
+// Sessions that are already revoked keep their original revocation time.
+func revokeSessions(tx *gorm.DB, at time.Time) error {
+	err := tx.Model(&model.Session{}).Where("revoked_at IS NULL").Update("revoked_at", at).Error
+	if err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
+	}
+	return nil
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate session id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,86 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"instashop/api/model"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// FetchLoginLockout returns the time until which any of keys is locked out.
+// The zero time is returned if none of them is locked.
+func (db *DB) FetchLoginLockout(keys ...string) (time.Time, error) {
+	var throttles []model.LoginThrottle
+	err := db.client.Where("key IN ? AND locked_until > ?", keys, time.Now()).Find(&throttles).Error
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error fetching login throttles: %w", err)
+	}
+
+	var until time.Time
+	for _, t := range throttles {
+		if t.LockedUntil.After(until) {
+			until = *t.LockedUntil
+		}
+	}
+	return until, nil
+}
+
+// RecordFailedLogin counts a failed login attempt against key and locks the key out as dictated by policy.
+// It returns the time until which the key is locked, which is the zero time if it is not.
+func (db *DB) RecordFailedLogin(key string, policy model.LoginThrottlePolicy) (time.Time, error) {
+	var lockedUntil time.Time
+	err := db.client.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+
+		// make sure the row exists so that it can be locked
+		err := tx.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&model.LoginThrottle{Key: key, LastFailureAt: now}).Error
+		if err != nil {
+			return fmt.Errorf("failed to create login throttle: %w", err)
+		}
+
+		var throttle model.LoginThrottle
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&throttle, "key = ?", key).Error; err != nil {
+			return fmt.Errorf("error fetching login throttle: %w", err)
+		}
+
+		if now.Sub(throttle.LastFailureAt) > policy.ResetAfter {
+			throttle.Failures = 0
+		}
+		throttle.Failures++
+		throttle.LastFailureAt = now
+		if lockout := policy.LockoutFor(throttle.Failures); lockout > 0 {
+			lockedUntil = now.Add(lockout)
+			throttle.LockedUntil = &lockedUntil
+		}
+
+		if err := tx.Save(&throttle).Error; err != nil {
+			return fmt.Errorf("failed to update login throttle: %w", err)
+		}
+		return nil
+	})
+	return lockedUntil, err
+}
+
+// ResetLoginFailures clears the failed attempts and any lockout of key.
+func (db *DB) ResetLoginFailures(key string) error {
+	if err := db.client.Delete(&model.LoginThrottle{}, "key = ?", key).Error; err != nil {
+		return fmt.Errorf("failed to reset login throttle: %w", err)
+	}
+	return nil
+}
+
+// FetchUserEmail returns the email address of a user.
+func (db *DB) FetchUserEmail(userID uint) (string, error) {
+	var user model.User
+	if err := db.client.Select("email").First(&user, userID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", fmt.Errorf("user %d not found: %w", userID, model.ErrNotFound)
+		}
+		return "", fmt.Errorf("error fetching user: %w", err)
+	}
+	return user.Email, nil
+}
@@ -0,0 +1,113 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"instashop/api/model"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// FetchUserByEmail retrieves the user registered with email.
+func (db *DB) FetchUserByEmail(email string) (model.User, error) {
+	var user model.User
+	if err := db.client.Where("email = ?", email).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return model.User{}, fmt.Errorf("user not found: %w", model.ErrNotFound)
+		}
+		return model.User{}, fmt.Errorf("error fetching user: %w", err)
+	}
+	return user, nil
+}
+
+// CreateUserToken stores the hash of a single-use token issued to userID for purpose.
+// Earlier unused tokens issued for the same purpose are invalidated.
+func (db *DB) CreateUserToken(userID uint, purpose model.TokenPurpose, tokenHash string, expiresAt time.Time) error {
+	return db.client.Transaction(func(tx *gorm.DB) error {
+		return createUserToken(tx, userID, purpose, tokenHash, expiresAt)
+	})
+}
+
+func createUserToken(tx *gorm.DB, userID uint, purpose model.TokenPurpose, tokenHash string, expiresAt time.Time) error {
+	err := tx.Model(&model.UserToken{}).
+		Where("user_id = ? AND purpose = ? AND used_at IS NULL", userID, purpose).
+		Update("used_at", time.Now()).Error
+	if err != nil {
+		return fmt.Errorf("failed to invalidate previous tokens: %w", err)
+	}
+
+	token := model.UserToken{UserID: userID, Purpose: purpose, TokenHash: tokenHash, ExpiresAt: expiresAt}
+	if err := tx.Create(&token).Error; err != nil {
+		return fmt.Errorf("failed to create token: %w", err)
+	}
+	return nil
+}
+
+// VerifyEmail consumes an email verification token and marks the owner's email address as verified.
+func (db *DB) VerifyEmail(tokenHash string) error {
+	return db.client.Transaction(func(tx *gorm.DB) error {
+		token, err := consumeUserToken(tx, model.TokenPurposeVerifyEmail, tokenHash)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Model(&model.User{}).
+			Where("id = ? AND email_verified_at IS NULL", token.UserID).
+			Update("email_verified_at", time.Now()).Error
+		if err != nil {
+			return fmt.Errorf("failed to verify email: %w", err)
+		}
+		return nil
+	})
+}
+
+// ResetPassword consumes a password reset token, sets the owner's password to newPassword
+// and revokes every session of the owner.
+func (db *DB) ResetPassword(tokenHash, newPassword string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to generate hash from password: %w", err)
+	}
+
+	return db.client.Transaction(func(tx *gorm.DB) error {
+		token, err := consumeUserToken(tx, model.TokenPurposeResetPassword, tokenHash)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		err = tx.Model(&model.User{}).Where("id = ?", token.UserID).
+			Updates(map[string]interface{}{"password": string(hashedPassword), "password_changed_at": now}).Error
+		if err != nil {
+			return fmt.Errorf("failed to reset password: %w", err)
+		}
+		return revokeSessions(tx.Where("user_id = ?", token.UserID), now)
+	})
+}
+
+// consumeUserToken marks the unused, unexpired token identified by tokenHash as used.
+func consumeUserToken(tx *gorm.DB, purpose model.TokenPurpose, tokenHash string) (model.UserToken, error) {
+	var token model.UserToken
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("token_hash = ? AND purpose = ?", tokenHash, purpose).
+		First(&token).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return token, fmt.Errorf("invalid token: %w", model.ErrInvalidUserInput)
+		}
+		return token, fmt.Errorf("error fetching token: %w", err)
+	}
+
+	now := time.Now()
+	if token.UsedAt != nil || now.After(token.ExpiresAt) {
+		return token, fmt.Errorf("token expired or already used: %w", model.ErrInvalidUserInput)
+	}
+
+	if err := tx.Model(&token).Update("used_at", now).Error; err != nil {
+		return token, fmt.Errorf("failed to consume token: %w", err)
+	}
+	return token, nil
+}
@@ -0,0 +1,226 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"instashop/api/model"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	defaultUsersPerPage = 20
+	maxUsersPerPage     = 100
+)
+
+// ListUsers returns the page of users matching filter, oldest first, and the number of matching users.
+func (db *DB) ListUsers(filter model.UserFilter) ([]model.User, int64, error) {
+	query := db.client.Model(&model.User{})
+	if filter.Email != "" {
+		query = query.Where("LOWER(users.email) LIKE ?", "%"+escapeLike(strings.ToLower(filter.Email))+"%")
+	}
+	if filter.Role != "" {
+		query = query.Where("EXISTS (SELECT 1 FROM user_roles JOIN roles ON roles.id = user_roles.role_id "+
+			"WHERE user_roles.user_id = users.id AND roles.name = ?)", filter.Role)
+	}
+	if filter.CreatedAfter != nil {
+		query = query.Where("users.created_at >= ?", *filter.CreatedAfter)
+	}
+	if filter.CreatedBefore != nil {
+		query = query.Where("users.created_at < ?", *filter.CreatedBefore)
+	}
+	if filter.Disabled != nil {
+		if *filter.Disabled {
+			query = query.Where("users.disabled_at IS NOT NULL")
+		} else {
+			query = query.Where("users.disabled_at IS NULL")
+		}
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, fmt.Errorf("error counting users: %w", err)
+	}
+
+	page, perPage := filter.Page, filter.PerPage
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 {
+		perPage = defaultUsersPerPage
+	}
+	if perPage > maxUsersPerPage {
+		perPage = maxUsersPerPage
+	}
+
+	users := make([]model.User, 0)
+	err := query.Preload("Roles.Permissions").Order("users.id").
+		Offset((page - 1) * perPage).Limit(perPage).
+		Find(&users).Error
+	if err != nil {
+		return nil, 0, fmt.Errorf("error fetching users: %w", err)
+	}
+	return users, total, nil
+}
+
+// DisableUser disables the account of userID.
+// Every session of the user ends, as does every impersonation of or by the user,
+// and the user's API keys stop working until re-enabled.
+// Disabling the last enabled administrator is rejected.
+func (db *DB) DisableUser(userID uint) error {
+	return db.client.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		res := tx.Model(&model.User{}).Where("id = ? AND disabled_at IS NULL", userID).Update("disabled_at", now)
+		if res.Error != nil {
+			return fmt.Errorf("failed to disable user: %w", res.Error)
+		}
+		if res.RowsAffected == 0 {
+			if _, err := fetchUser(tx, userID); err != nil {
+				return err
+			}
+			return nil // already disabled
+		}
+		if err := ensureAdminRemains(tx); err != nil {
+			return err
+		}
+
+		if err := revokeSessions(tx.Where("user_id = ?", userID), now); err != nil {
+			return err
+		}
+		err := tx.Model(&model.Impersonation{}).
+			Where("(user_id = ? OR actor_id = ?) AND ended_at IS NULL", userID, userID).
+			Update("ended_at", now).Error
+		if err != nil {
+			return fmt.Errorf("failed to end impersonations: %w", err)
+		}
+		return nil
+	})
+}
+
+// EnableUser re-enables a disabled account. The user has to log in again.
+func (db *DB) EnableUser(userID uint) error {
+	res := db.client.Model(&model.User{}).Where("id = ?", userID).Update("disabled_at", nil)
+	if res.Error != nil {
+		return fmt.Errorf("failed to enable user: %w", res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("user %d not found: %w", userID, model.ErrNotFound)
+	}
+	return nil
+}
+
+// GrantRole grants the role named role to userID, if not already granted.
+func (db *DB) GrantRole(userID uint, role string) (model.User, error) {
+	return db.changeUserRole(userID, role, func(tx *gorm.DB, user *model.User, r *model.Role) error {
+		return tx.Model(user).Association("Roles").Append(r)
+	})
+}
+
+// RevokeRole revokes the role named role from userID.
+// Revoking the admin role from the last administrator is rejected, so the system is never left without one.
+func (db *DB) RevokeRole(userID uint, role string) (model.User, error) {
+	return db.changeUserRole(userID, role, func(tx *gorm.DB, user *model.User, r *model.Role) error {
+		return tx.Model(user).Association("Roles").Delete(r)
+	})
+}
+
+func (db *DB) changeUserRole(userID uint, role string, change func(tx *gorm.DB, user *model.User, r *model.Role) error) (model.User, error) {
+	var user model.User
+	err := db.client.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if user, err = fetchUser(tx, userID); err != nil {
+			return err
+		}
+
+		var r model.Role
+		if err := tx.Where("name = ?", role).First(&r).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("role %q not found: %w", role, model.ErrNotFound)
+			}
+			return fmt.Errorf("error fetching role: %w", err)
+		}
+
+		if err := change(tx, &user, &r); err != nil {
+			return fmt.Errorf("failed to update user roles: %w", err)
+		}
+		if err := ensureAdminRemains(tx); err != nil {
+			return err
+		}
+		return tx.Preload("Roles.Permissions").First(&user, userID).Error
+	})
+	if err != nil {
+		return model.User{}, err
+	}
+	return user, nil
+}
+
+// ForcePasswordReset invalidates the password of userID and revokes all of the user's sessions,
+// so that the account can only be used again after a password reset.
+func (db *DB) ForcePasswordReset(userID uint) (model.User, error) {
+	var user model.User
+	err := db.client.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if user, err = fetchUser(tx, userID); err != nil {
+			return err
+		}
+
+		// an empty password never matches a bcrypt hash
+		now := time.Now()
+		if err := tx.Model(&user).Updates(map[string]interface{}{"password": "", "password_changed_at": now}).Error; err != nil {
+			return fmt.Errorf("failed to invalidate password: %w", err)
+		}
+		return revokeSessions(tx.Where("user_id = ?", userID), now)
+	})
+	if err != nil {
+		return model.User{}, err
+	}
+	return user, nil
+}
+
+// fetchUser locks and returns the user row of userID.
+func fetchUser(tx *gorm.DB, userID uint) (model.User, error) {
+	var user model.User
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, userID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return model.User{}, fmt.Errorf("user %d not found: %w", userID, model.ErrNotFound)
+		}
+		return model.User{}, fmt.Errorf("error fetching user: %w", err)
+	}
+	return user, nil
+}
+
+// adminsLockID identifies the advisory lock serialising changes that may remove the last administrator.
+const adminsLockID = 7295032
+
+// ensureAdminRemains fails if no enabled user holds the admin role.
+//
+// It takes a transaction-level advisory lock before counting, so that transactions removing different
+// administrators concurrently are serialised: each counts after the previous one has committed,
+// and cannot both see the other's administrator still in place.
+func ensureAdminRemains(tx *gorm.DB) error {
+	if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", adminsLockID).Error; err != nil {
+		return fmt.Errorf("failed to lock administrators: %w", err)
+	}
+
+	var count int64
+	err := tx.Model(&model.User{}).
+		Joins("JOIN user_roles ON user_roles.user_id = users.id").
+		Joins("JOIN roles ON roles.id = user_roles.role_id").
+		Where("roles.name = ? AND users.disabled_at IS NULL", model.RoleAdmin).
+		Count(&count).Error
+	if err != nil {
+		return fmt.Errorf("error counting admins: %w", err)
+	}
+	if count == 0 {
+		return fmt.Errorf("at least one administrator is required: %w", model.ErrInvalidUserInput)
+	}
+	return nil
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -0,0 +1,293 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"instashop/api/model"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// GenerateVariants sets the options of a product to those of matrix and generates one variant
+// per combination of their values.
+//
+// Variants of combinations that remain keep their SKU, price and stock; new combinations get a variant
+// without stock, priced at the product price. Variants of combinations that no longer exist, for example
+// after an option or value is removed, are deleted. Removing every option makes the product a simple product again.
+func (db *DB) GenerateVariants(productID uint, matrix model.VariantMatrix) (model.Product, error) {
+	if err := matrix.Validate(); err != nil {
+		return model.Product{}, err
+	}
+	if matrix.SKUPrefix == "" {
+		matrix.SKUPrefix = "P" + strconv.FormatUint(uint64(productID), 10)
+	}
+
+	err := db.client.Transaction(func(tx *gorm.DB) error {
+		var product model.Product
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&product, productID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("product %d not found: %w", productID, model.ErrNotFound)
+			}
+			return fmt.Errorf("error fetching product: %w", err)
+		}
+
+		options, err := setProductOptions(tx, productID, matrix.Options)
+		if err != nil {
+			return err
+		}
+
+		var variants []model.ProductVariant
+		if err := tx.Preload("Options").Where("product_id = ?", productID).Find(&variants).Error; err != nil {
+			return fmt.Errorf("error fetching product variants: %w", err)
+		}
+		existing := make(map[string]model.ProductVariant, len(variants))
+		for _, v := range variants {
+			existing[combinationKey(v.Options)] = v
+		}
+
+		for _, combination := range combinations(options) {
+			key := combinationKey(combination)
+			if _, ok := existing[key]; ok {
+				delete(existing, key)
+				continue
+			}
+			variant := model.ProductVariant{
+				ProductID: productID,
+				SKU:       variantSKU(matrix.SKUPrefix, combination),
+				Options:   combination,
+			}
+			var count int64
+			if err := tx.Model(&model.ProductVariant{}).Where("sku = ?", variant.SKU).Count(&count).Error; err != nil {
+				return fmt.Errorf("error checking SKU: %w", err)
+			}
+			if count > 0 {
+				return fmt.Errorf("SKU %s is already used, choose another sku_prefix: %w", variant.SKU, model.ErrInvalidUserInput)
+			}
+			if err := tx.Omit("Options.*").Create(&variant).Error; err != nil {
+				return fmt.Errorf("failed to create variant %s: %w", variant.SKU, err)
+			}
+		}
+
+		// the variants left are those of combinations that no longer exist
+		for _, v := range existing {
+			if err := tx.Delete(&v).Error; err != nil {
+				return fmt.Errorf("failed to delete variant %s: %w", v.SKU, err)
+			}
+		}
+		if err := deleteUnusedOptions(tx, productID, options); err != nil {
+			return err
+		}
+		return syncProductStock(tx, productID)
+	})
+	if err != nil {
+		return model.Product{}, err
+	}
+	return db.FetchProductByID(productID)
+}
+
+// UpdateVariant changes the SKU, price override and stock of a variant of variant.ProductID.
+func (db *DB) UpdateVariant(variant *model.ProductVariant) error {
+	variant.SKU = strings.TrimSpace(variant.SKU)
+	if variant.SKU == "" || len(variant.SKU) > 64 {
+		return fmt.Errorf("sku must have between 1 and 64 characters: %w", model.ErrInvalidUserInput)
+	}
+	if variant.Quantity < 0 {
+		return fmt.Errorf("quantity must not be negative: %w", model.ErrInvalidUserInput)
+	}
+	if variant.Price != nil && *variant.Price < 0 {
+		return fmt.Errorf("price must not be negative: %w", model.ErrInvalidUserInput)
+	}
+
+	return db.client.Transaction(func(tx *gorm.DB) error {
+		var existing model.ProductVariant
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND product_id = ?", variant.ID, variant.ProductID).
+			First(&existing).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("variant %d not found: %w", variant.ID, model.ErrNotFound)
+			}
+			return fmt.Errorf("error fetching variant: %w", err)
+		}
+
+		var count int64
+		err = tx.Model(&model.ProductVariant{}).Where("sku = ? AND id <> ?", variant.SKU, variant.ID).Count(&count).Error
+		if err != nil {
+			return fmt.Errorf("error checking SKU: %w", err)
+		}
+		if count > 0 {
+			return fmt.Errorf("SKU %s is already used: %w", variant.SKU, model.ErrInvalidUserInput)
+		}
+
+		err = tx.Model(&existing).Updates(map[string]interface{}{
+			"sku":      variant.SKU,
+			"price":    variant.Price,
+			"quantity": variant.Quantity,
+		}).Error
+		if err != nil {
+			return fmt.Errorf("failed to update variant: %w", err)
+		}
+		if err := syncProductStock(tx, variant.ProductID); err != nil {
+			return err
+		}
+
+		variants, err := loadVariants(tx, []uint{variant.ID})
+		if err != nil {
+			return err
+		}
+		*variant = variants[variant.ID]
+		return nil
+	})
+}
+
+// setProductOptions creates or updates the options of a product and their values to match options,
+// returning them in order. Options and values are matched by name, case-insensitively.
+// Options and values no longer listed are left for deleteUnusedOptions, once no variant uses them.
+func setProductOptions(tx *gorm.DB, productID uint, options []model.VariantMatrixOption) ([]model.ProductOption, error) {
+	var existing []model.ProductOption
+	if err := tx.Preload("Values").Where("product_id = ?", productID).Find(&existing).Error; err != nil {
+		return nil, fmt.Errorf("error fetching product options: %w", err)
+	}
+	byName := make(map[string]model.ProductOption, len(existing))
+	for _, o := range existing {
+		byName[strings.ToLower(o.Name)] = o
+	}
+
+	result := make([]model.ProductOption, 0, len(options))
+	for i, spec := range options {
+		option, ok := byName[strings.ToLower(spec.Name)]
+		if !ok {
+			option = model.ProductOption{ProductID: productID}
+		}
+		option.Name, option.Position = spec.Name, i
+		if err := tx.Omit(clause.Associations).Save(&option).Error; err != nil {
+			return nil, fmt.Errorf("failed to save option %q: %w", spec.Name, err)
+		}
+
+		values := make(map[string]model.ProductOptionValue, len(option.Values))
+		for _, v := range option.Values {
+			values[strings.ToLower(v.Value)] = v
+		}
+		option.Values = make([]model.ProductOptionValue, 0, len(spec.Values))
+		for j, name := range spec.Values {
+			value, ok := values[strings.ToLower(name)]
+			if !ok {
+				value = model.ProductOptionValue{OptionID: option.ID}
+			}
+			value.Value, value.Position = name, j
+			if err := tx.Save(&value).Error; err != nil {
+				return nil, fmt.Errorf("failed to save value %q of option %q: %w", name, spec.Name, err)
+			}
+			option.Values = append(option.Values, value)
+		}
+		result = append(result, option)
+	}
+	return result, nil
+}
+
+// deleteUnusedOptions deletes the options and values of a product that are not in options.
+// The links of deleted variants to the deleted values are removed along with them.
+func deleteUnusedOptions(tx *gorm.DB, productID uint, options []model.ProductOption) error {
+	optionIDs := []uint{0}
+	valueIDs := []uint{0}
+	for _, o := range options {
+		optionIDs = append(optionIDs, o.ID)
+		for _, v := range o.Values {
+			valueIDs = append(valueIDs, v.ID)
+		}
+	}
+
+	err := tx.Where("option_id IN (SELECT id FROM product_options WHERE product_id = ?) AND id NOT IN ?", productID, valueIDs).
+		Delete(&model.ProductOptionValue{}).Error
+	if err != nil {
+		return fmt.Errorf("failed to delete option values: %w", err)
+	}
+	if err := tx.Where("product_id = ? AND id NOT IN ?", productID, optionIDs).Delete(&model.ProductOption{}).Error; err != nil {
+		return fmt.Errorf("failed to delete options: %w", err)
+	}
+	return nil
+}
+
+// combinations returns every combination of one value per option, in option order.
+func combinations(options []model.ProductOption) [][]model.ProductOptionValue {
+	if len(options) == 0 {
+		return nil
+	}
+	result := [][]model.ProductOptionValue{{}}
+	for _, o := range options {
+		next := make([][]model.ProductOptionValue, 0, len(result)*len(o.Values))
+		for _, prefix := range result {
+			for _, v := range o.Values {
+				combination := append(append(make([]model.ProductOptionValue, 0, len(prefix)+1), prefix...), v)
+				next = append(next, combination)
+			}
+		}
+		result = next
+	}
+	return result
+}
+
+// combinationKey identifies a combination of option values regardless of their order.
+func combinationKey(values []model.ProductOptionValue) string {
+	ids := make([]string, len(values))
+	for i, v := range values {
+		ids[i] = strconv.FormatUint(uint64(v.ID), 10)
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+// variantSKU derives the SKU of a variant from prefix and its option values, e.g. TSHIRT-M-RED.
+func variantSKU(prefix string, values []model.ProductOptionValue) string {
+	parts := []string{prefix}
+	for _, v := range values {
+		part := strings.ToUpper(model.Slugify(v.Value))
+		if part == "" {
+			part = strconv.FormatUint(uint64(v.ID), 10)
+		}
+		parts = append(parts, part)
+	}
+	sku := strings.Join(parts, "-")
+	if len(sku) > 64 {
+		sku = sku[:64]
+	}
+	return sku
+}
+
+// syncProductStock sets the stock of a product with variants to the sum of the stock of its variants.
+func syncProductStock(tx *gorm.DB, productID uint) error {
+	err := tx.Exec(`UPDATE products SET quantity = (
+		SELECT COALESCE(SUM(quantity), 0) FROM product_variants WHERE product_id = products.id AND deleted_at IS NULL
+	) WHERE id = ? AND EXISTS (SELECT 1 FROM product_variants WHERE product_id = products.id AND deleted_at IS NULL)`, productID).Error
+	if err != nil {
+		return fmt.Errorf("failed to update stock of product %d: %w", productID, err)
+	}
+	return nil
+}
+
+// loadVariants returns the variants of ids, by id, with their option values in option order.
+func loadVariants(tx *gorm.DB, ids []uint) (map[uint]model.ProductVariant, error) {
+	variants := make(map[uint]model.ProductVariant, len(ids))
+	if len(ids) == 0 {
+		return variants, nil
+	}
+
+	var found []model.ProductVariant
+	if err := tx.Preload("Options", optionOrder).Where("id IN ?", ids).Find(&found).Error; err != nil {
+		return nil, fmt.Errorf("error fetching product variants: %w", err)
+	}
+	for _, v := range found {
+		variants[v.ID] = v
+	}
+	return variants, nil
+}
+
+// optionOrder sorts the option values of variants in option order.
+func optionOrder(tx *gorm.DB) *gorm.DB {
+	return tx.Joins("JOIN product_options ON product_options.id = product_option_values.option_id").
+		Order("product_options.position, product_options.id")
+}
@@ -0,0 +1,47 @@
+package mail
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"time"
+)
+
+// SMTPMailer sends emails through an SMTP server.
+type SMTPMailer struct {
+	addr     string
+	from     string
+	envelope string // bare address of from, used for the SMTP MAIL command
+	auth     smtp.Auth
+}
+
+// NewSMTPMailer creates a mailer relaying through the SMTP server at addr (host:port).
+// Authentication is skipped when username is empty.
+func NewSMTPMailer(addr, username, password, from string) (*SMTPMailer, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP address: %w", err)
+	}
+
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender address: %w", err)
+	}
+
+	m := &SMTPMailer{addr: addr, from: from, envelope: sender.Address}
+	if username != "" {
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m, nil
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	if err := validateRecipient(msg.To); err != nil {
+		return err
+	}
+	if err := smtp.SendMail(m.addr, m.auth, m.envelope, []string{msg.To}, format(m.from, msg, time.Now())); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	return nil
+}
@@ -4,11 +4,16 @@ import (
 	"context"
 	"errors"
 	"instashop/api"
+	v1 "instashop/api/v1"
+	"instashop/blob"
 	"instashop/db"
+	"instashop/mail"
+	"instashop/oidc"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -19,11 +24,48 @@ func main() {
 }
 
 func run(ctx context.Context) {
-	repo, err := db.NewDB(os.Getenv("DSN"))
+	var opts []db.Option
+	if os.Getenv("REQUIRE_EMAIL_VERIFICATION") == "true" {
+		opts = append(opts, db.WithVerifiedEmailRequired())
+	}
+	repo, err := db.NewDB(os.Getenv("DSN"), opts...)
+	if err != nil {
+		panic(err)
+	}
+	keys, err := loadKeySet()
+	if err != nil {
+		panic(err)
+	}
+	mailer, err := newMailer()
+	if err != nil {
+		panic(err)
+	}
+	oidcProviders, err := oidc.LoadProviders(ctx, os.Getenv("OIDC_PROVIDERS_FILE"))
+	if err != nil {
+		panic(err)
+	}
+	idempotencyKeyTTL, err := time.ParseDuration(getenv("IDEMPOTENCY_KEY_TTL", "24h"))
+	if err != nil {
+		panic(err)
+	}
+	blobs, err := newBlobStore()
 	if err != nil {
 		panic(err)
 	}
-	srv := api.NewServer(repo)
+	maxImageSize, err := strconv.ParseInt(getenv("MAX_IMAGE_SIZE", "10485760"), 10, 64)
+	if err != nil {
+		panic(err)
+	}
+	srv := api.NewServer(repo, v1.Config{
+		Keys:              keys,
+		Mailer:            mailer,
+		AppURL:            getenv("APP_URL", "http://localhost:15001"),
+		RequireStaffMFA:   os.Getenv("REQUIRE_STAFF_MFA") == "true",
+		OIDCProviders:     oidcProviders,
+		IdempotencyKeyTTL: idempotencyKeyTTL,
+		Blobs:             blobs,
+		MaxImageSize:      maxImageSize,
+	})
 
 	httpServer := &http.Server{
 		Addr:    net.JoinHostPort("127.0.0.1", "15001"),
@@ -49,3 +91,49 @@ func run(ctx context.Context) {
 	}()
 	wg.Wait()
 }
+
+// loadKeySet loads the key set signing tokens from JWT_KEYS_FILE.
+// Only development environments (APP_ENV=development) may run without one, using the public development secret.
+func loadKeySet() (*v1.KeySet, error) {
+	path := os.Getenv("JWT_KEYS_FILE")
+	if path == "" {
+		if os.Getenv("APP_ENV") == "development" {
+			return v1.DevelopmentKeySet(), nil
+		}
+		return nil, errors.New("JWT_KEYS_FILE is required unless APP_ENV=development")
+	}
+	return v1.LoadKeySet(path)
+}
+
+// newMailer creates an SMTP mailer if SMTP_ADDR is set,
+// otherwise emails are dropped as files into MAIL_DROP_DIR for local development.
+func newMailer() (v1.Mailer, error) {
+	from := getenv("MAIL_FROM", "InstaShop <no-reply@instashop.com>")
+	if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+		return mail.NewSMTPMailer(addr, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), from)
+	}
+	return mail.NewFileMailer(getenv("MAIL_DROP_DIR", "mail-drop"), from)
+}
+
+// newBlobStore creates a store keeping blobs in the S3 bucket S3_BUCKET if it is set,
+// otherwise blobs are kept in MEDIA_DIR and served by the API under /media.
+func newBlobStore() (v1.BlobStore, error) {
+	if bucket := os.Getenv("S3_BUCKET"); bucket != "" {
+		return blob.NewS3Store(blob.S3Config{
+			Endpoint:        getenv("S3_ENDPOINT", "https://s3.amazonaws.com"),
+			Region:          os.Getenv("S3_REGION"),
+			Bucket:          bucket,
+			AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+			PublicURL:       os.Getenv("S3_PUBLIC_URL"),
+		})
+	}
+	return blob.NewFileStore(getenv("MEDIA_DIR", "media"), "/media")
+}
+
+func getenv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,229 @@
+// Package oidc implements the OpenID Connect authorization code flow with PKCE (RFC 7636),
+// used to sign users in with external identity providers.
+//
+// Providers are configured from their discovery document, published at
+// <issuer>/.well-known/openid-configuration, so only the issuer and client credentials need to be known.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrInvalidIDToken is returned when the ID token of a provider fails verification.
+var ErrInvalidIDToken = errors.New("invalid ID token")
+
+// Config configures a single identity provider.
+type Config struct {
+	// Name identifies the provider in API routes, e.g. "google".
+	Name         string   `json:"name"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURL  string   `json:"redirect_url"`
+	Scopes       []string `json:"scopes"` // defaults to openid, email and profile
+}
+
+// metadata is the subset of the discovery document used by a Provider.
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Identity is the identity of a user asserted by a provider.
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+// Provider is an identity provider configured from its discovery document.
+type Provider struct {
+	config   Config
+	metadata metadata
+	client   *http.Client
+	keys     *keyCache
+}
+
+// LoadProviders reads a JSON array of provider configurations from path and discovers each provider.
+// An empty path configures no providers.
+func LoadProviders(ctx context.Context, path string) ([]*Provider, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OIDC providers: %w", err)
+	}
+	var configs []Config
+	if err := json.Unmarshal(raw, &configs); err != nil {
+		return nil, fmt.Errorf("failed to parse OIDC providers: %w", err)
+	}
+
+	providers := make([]*Provider, 0, len(configs))
+	for _, cfg := range configs {
+		p, err := Discover(ctx, cfg, nil)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, p)
+	}
+	return providers, nil
+}
+
+// Discover configures a provider from the discovery document of cfg.Issuer.
+// A nil client uses a client with a 10 second timeout.
+func Discover(ctx context.Context, cfg Config, client *http.Client) (*Provider, error) {
+	if cfg.Name == "" || cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, fmt.Errorf("OIDC provider %q: name, issuer, client_id and redirect_url are required", cfg.Name)
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	discoveryURL := strings.TrimSuffix(cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	var md metadata
+	if err := getJSON(ctx, client, discoveryURL, &md); err != nil {
+		return nil, fmt.Errorf("OIDC provider %q: discovery failed: %w", cfg.Name, err)
+	}
+	// the issuer must match exactly, or tokens of another issuer could be accepted (OpenID Connect Discovery 1.0 §4.3)
+	if md.Issuer != cfg.Issuer {
+		return nil, fmt.Errorf("OIDC provider %q: discovery document issuer %q does not match %q", cfg.Name, md.Issuer, cfg.Issuer)
+	}
+	if md.AuthorizationEndpoint == "" || md.TokenEndpoint == "" || md.JWKSURI == "" {
+		return nil, fmt.Errorf("OIDC provider %q: discovery document is missing endpoints", cfg.Name)
+	}
+
+	return &Provider{
+		config:   cfg,
+		metadata: md,
+		client:   client,
+		keys:     &keyCache{uri: md.JWKSURI, client: client},
+	}, nil
+}
+
+// Name returns the name of the provider.
+func (p *Provider) Name() string {
+	return p.config.Name
+}
+
+// AuthCodeURL returns the URL of the provider's authorization endpoint to which the user is sent to sign in.
+// codeChallenge is the S256 challenge of the PKCE code verifier later passed to Exchange.
+func (p *Provider) AuthCodeURL(state, nonce, codeChallenge string) string {
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {strings.Join(p.config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {codeChallenge},
+		"code_challenge_method": {"S256"},
+	}
+
+	sep := "?"
+	if strings.Contains(p.metadata.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return p.metadata.AuthorizationEndpoint + sep + q.Encode()
+}
+
+// Exchange redeems an authorization code at the provider's token endpoint
+// and returns the identity asserted by the verified ID token.
+// nonce must be the nonce passed to AuthCodeURL.
+func (p *Provider) Exchange(ctx context.Context, code, codeVerifier, nonce string) (Identity, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"client_id":     {p.config.ClientID},
+		"code_verifier": {codeVerifier},
+	}
+	if p.config.ClientSecret != "" {
+		form.Set("client_secret", p.config.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Identity{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return Identity{}, fmt.Errorf("token request failed: %w", err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return Identity{}, fmt.Errorf("failed to read token response: %w", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return Identity{}, fmt.Errorf("token request failed with status %d: %s", res.StatusCode, body)
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return Identity{}, fmt.Errorf("failed to parse token response: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return Identity{}, fmt.Errorf("token response has no ID token: %w", ErrInvalidIDToken)
+	}
+
+	return p.verifyIDToken(ctx, tokens.IDToken, nonce)
+}
+
+// GenerateCodeVerifier returns a random PKCE code verifier.
+func GenerateCodeVerifier() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate code verifier: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CodeChallenge returns the S256 PKCE code challenge of verifier.
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: unexpected status %d", url, res.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(v)
+}
@@ -0,0 +1,215 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/golang-jwt/jwt/v4"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeProvider is an identity provider serving a discovery document, a JWKS and a token endpoint.
+// The token endpoint issues an ID token with claims, signed with the key of signingKeyID.
+type fakeProvider struct {
+	*httptest.Server
+
+	mu           sync.Mutex
+	keys         map[string]*rsa.PrivateKey // published in the JWKS
+	signingKeyID string
+	claims       jwt.MapClaims
+	tokenForm    url.Values // of the last token request
+	jwksFetches  int
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	t.Helper()
+	p := &fakeProvider{keys: make(map[string]*rsa.PrivateKey)}
+	p.Server = httptest.NewServer(http.HandlerFunc(p.serveHTTP))
+	t.Cleanup(p.Close)
+	p.rotateKey(t, "key-1")
+	return p
+}
+
+// rotateKey publishes a new key identified by kid, which signs the ID tokens issued from then on.
+func (p *fakeProvider) rotateKey(t *testing.T, kid string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys[kid] = key
+	p.signingKeyID = kid
+}
+
+func (p *fakeProvider) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		_ = json.NewEncoder(w).Encode(metadata{
+			Issuer:                p.URL,
+			AuthorizationEndpoint: p.URL + "/authorize",
+			TokenEndpoint:         p.URL + "/token",
+			JWKSURI:               p.URL + "/jwks",
+		})
+	case "/jwks":
+		p.jwksFetches++
+		var set struct {
+			Keys []jwk `json:"keys"`
+		}
+		for kid, key := range p.keys {
+			set.Keys = append(set.Keys, jwk{
+				ID:   kid,
+				Type: "RSA",
+				Use:  "sig",
+				N:    base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:    base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		_ = json.NewEncoder(w).Encode(set)
+	case "/token":
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p.tokenForm = r.PostForm
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, p.claims)
+		token.Header["kid"] = p.signingKeyID
+		idToken, err := token.SignedString(p.keys[p.signingKeyID])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": idToken})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// issue sets the claims of the next ID token to valid claims for clientID and nonce, changed by override.
+func (p *fakeProvider) issue(clientID, nonce string, override jwt.MapClaims) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.claims = jwt.MapClaims{
+		"iss":            p.URL,
+		"aud":            clientID,
+		"sub":            "subject",
+		"nonce":          nonce,
+		"email":          "user@example.com",
+		"email_verified": true,
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range override {
+		p.claims[k] = v
+	}
+}
+
+func discoverFake(t *testing.T, fake *fakeProvider) *Provider {
+	t.Helper()
+	p, err := Discover(context.Background(), Config{
+		Name:        "fake",
+		Issuer:      fake.URL,
+		ClientID:    "client",
+		RedirectURL: "https://shop.example.com/callback",
+	}, fake.Client())
+	if err != nil {
+		t.Fatalf("discovering provider: %v", err)
+	}
+	return p
+}
+
+func TestExchangeForwardsTheCodeVerifier(t *testing.T) {
+	fake := newFakeProvider(t)
+	p := discoverFake(t, fake)
+	verifier, err := GenerateCodeVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authURL, err := url.Parse(p.AuthCodeURL("state", "nonce", CodeChallenge(verifier)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := authURL.Query(); q.Get("code_challenge") != CodeChallenge(verifier) || q.Get("code_challenge_method") != "S256" {
+		t.Errorf("authorization URL %s does not carry the S256 challenge of the verifier", authURL)
+	}
+
+	fake.issue("client", "nonce", nil)
+	identity, err := p.Exchange(context.Background(), "code", verifier, "nonce")
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if identity != (Identity{Subject: "subject", Email: "user@example.com", EmailVerified: true}) {
+		t.Errorf("identity = %+v", identity)
+	}
+	if got := fake.tokenForm.Get("code_verifier"); got != verifier {
+		t.Errorf("token request code_verifier = %q, want %q", got, verifier)
+	}
+	if got := fake.tokenForm.Get("code"); got != "code" {
+		t.Errorf("token request code = %q, want %q", got, "code")
+	}
+}
+
+func TestExchangeRejectsMismatchedClaims(t *testing.T) {
+	fake := newFakeProvider(t)
+	p := discoverFake(t, fake)
+
+	for name, override := range map[string]jwt.MapClaims{
+		"nonce":   {"nonce": "other-nonce"},
+		"aud":     {"aud": "other-client"},
+		"iss":     {"iss": "https://attacker.example.com"},
+		"expired": {"exp": time.Now().Add(-time.Minute).Unix()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			fake.issue("client", "nonce", override)
+			if _, err := p.Exchange(context.Background(), "code", "verifier", "nonce"); !errors.Is(err, ErrInvalidIDToken) {
+				t.Errorf("Exchange: err = %v, want ErrInvalidIDToken", err)
+			}
+		})
+	}
+}
+
+func TestUnknownKeyRefreshesTheJWKS(t *testing.T) {
+	fake := newFakeProvider(t)
+	p := discoverFake(t, fake)
+
+	fake.issue("client", "nonce", nil)
+	if _, err := p.Exchange(context.Background(), "code", "verifier", "nonce"); err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if fake.jwksFetches != 1 {
+		t.Fatalf("JWKS fetched %d times, want 1", fake.jwksFetches)
+	}
+
+	// tokens signed with a rotated key are accepted once the JWKS is refetched
+	fake.rotateKey(t, "key-2")
+	p.keys.fetchedAt = time.Now().Add(-keyRefreshInterval)
+	if _, err := p.Exchange(context.Background(), "code", "verifier", "nonce"); err != nil {
+		t.Fatalf("Exchange with a rotated key: %v", err)
+	}
+	if fake.jwksFetches != 2 {
+		t.Fatalf("JWKS fetched %d times, want 2", fake.jwksFetches)
+	}
+
+	// but the JWKS is not refetched again within keyRefreshInterval
+	fake.rotateKey(t, "key-3")
+	if _, err := p.Exchange(context.Background(), "code", "verifier", "nonce"); !errors.Is(err, ErrInvalidIDToken) {
+		t.Fatalf("Exchange with a key rotated within the refresh interval: err = %v, want ErrInvalidIDToken", err)
+	}
+	if fake.jwksFetches != 2 {
+		t.Errorf("JWKS fetched %d times, want 2", fake.jwksFetches)
+	}
+}
@@ -0,0 +1,58 @@
+// Package thumbnail scales images down to thumbnails with the standard library only.
+package thumbnail
+
+import (
+	"image"
+)
+
+// Fit scales src down, preserving its aspect ratio, so that its longest side is size pixels.
+// Images that already fit are returned unchanged.
+//
+// Each pixel of the thumbnail is the average of the source pixels it covers (a box filter),
+// which is cheap and free of the aliasing of nearest-neighbour sampling when shrinking.
+func Fit(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	if size <= 0 || (sw <= size && sh <= size) {
+		return src
+	}
+
+	dw, dh := size, size
+	if sw >= sh {
+		dh = max(sh*size/sw, 1)
+	} else {
+		dw = max(sw*size/sh, 1)
+	}
+	return scale(src, dw, dh)
+}
+
+// scale resizes src down to dw x dh pixels.
+func scale(src image.Image, dw, dh int) *image.RGBA {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < dh; y++ {
+		y0, y1 := b.Min.Y+y*sh/dh, b.Min.Y+(y+1)*sh/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := b.Min.X+x*sw/dw, b.Min.X+(x+1)*sw/dw
+
+			// RGBA returns alpha-premultiplied 16-bit channels, which average correctly across transparency
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(pr), g+uint64(pg), bl+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(bl / n >> 8)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,61 @@
+package thumbnail
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestFitScalesTheLongestSide(t *testing.T) {
+	for _, tc := range []struct {
+		width, height, size int
+		wantW, wantH        int
+	}{
+		{1600, 1200, 480, 480, 360},
+		{1200, 1600, 480, 360, 480},
+		{1000, 1000, 160, 160, 160},
+		{4000, 10, 160, 160, 1}, // never scaled to nothing
+		{100, 80, 160, 100, 80}, // already fits
+		{160, 20, 160, 160, 20},
+		{300, 200, 0, 300, 200},
+	} {
+		src := image.NewRGBA(image.Rect(0, 0, tc.width, tc.height))
+		dst := Fit(src, tc.size)
+		if b := dst.Bounds(); b.Dx() != tc.wantW || b.Dy() != tc.wantH {
+			t.Errorf("Fit(%dx%d, %d) = %dx%d, want %dx%d", tc.width, tc.height, tc.size, b.Dx(), b.Dy(), tc.wantW, tc.wantH)
+		}
+	}
+}
+
+func TestFitHandlesOffsetBounds(t *testing.T) {
+	src := image.NewRGBA(image.Rect(50, 50, 250, 150))
+	dst := Fit(src, 100)
+	if b := dst.Bounds(); b.Dx() != 100 || b.Dy() != 50 {
+		t.Errorf("Fit of a 200x100 image at (50,50) = %dx%d, want 100x50", b.Dx(), b.Dy())
+	}
+}
+
+func TestFitAveragesSourcePixels(t *testing.T) {
+	// vertical black and white stripes one pixel wide average to grey
+	src := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 64; y++ {
+			if x%2 == 0 {
+				src.Set(x, y, color.White)
+			} else {
+				src.Set(x, y, color.Black)
+			}
+		}
+	}
+	dst := Fit(src, 16)
+	b := dst.Bounds()
+	r, g, bl, a := dst.At(b.Min.X+8, b.Min.Y+8).RGBA()
+	for _, c := range []uint32{r, g, bl} {
+		if c < 0x7000 || c > 0x9000 {
+			t.Fatalf("pixel = (%#x, %#x, %#x), want grey", r, g, bl)
+		}
+	}
+	if a != 0xffff {
+		t.Errorf("alpha = %#x, want opaque", a)
+	}
+}
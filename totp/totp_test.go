@@ -0,0 +1,96 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 secret of the test vectors of RFC 6238, Appendix B, base32 encoded.
+var rfc6238Secret = encoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestValidateAcceptsRFC6238Vectors(t *testing.T) {
+	// the vectors have 8 digits; 6 digit codes are their last 6 digits
+	for _, tc := range []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	} {
+		step, ok := Validate(rfc6238Secret, tc.code, time.Unix(tc.unix, 0))
+		if !ok {
+			t.Errorf("code %s at %d rejected", tc.code, tc.unix)
+			continue
+		}
+		if want := tc.unix / 30; step != want {
+			t.Errorf("code %s at %d: step = %d, want %d", tc.code, tc.unix, step, want)
+		}
+	}
+}
+
+func TestValidateToleratesOneStepOfDrift(t *testing.T) {
+	// "005924" is the code of step 41152263, which starts at 1234567890
+	const code = "005924"
+	start := time.Unix(41152263*30, 0)
+
+	for _, tc := range []struct {
+		name string
+		at   time.Time
+		ok   bool
+	}{
+		{"two steps early", start.Add(-31 * time.Second), false},
+		{"one step early", start.Add(-time.Second), true},
+		{"current step", start, true},
+		{"one step late", start.Add(59 * time.Second), true},
+		{"two steps late", start.Add(60 * time.Second), false},
+	} {
+		step, ok := Validate(rfc6238Secret, code, tc.at)
+		if ok != tc.ok {
+			t.Errorf("%s: ok = %v, want %v", tc.name, ok, tc.ok)
+		}
+		// the step is that of the code, not of the time of validation, so that replays within the window are detected
+		if ok && step != 41152263 {
+			t.Errorf("%s: step = %d, want 41152263", tc.name, step)
+		}
+	}
+}
+
+func TestValidateReturnsStepsThatRejectReplays(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	last, ok := Validate(rfc6238Secret, "050471", now)
+	if !ok {
+		t.Fatal("code rejected")
+	}
+
+	// callers persist the last accepted step and only accept later ones
+	replayed, ok := Validate(rfc6238Secret, "050471", now.Add(30*time.Second))
+	if !ok || replayed != last {
+		t.Errorf("replayed code: step = %d (ok %v), want step %d, which callers reject", replayed, ok, last)
+	}
+	code, err := Generate(rfc6238Secret, now.Add(30*time.Second))
+	if err != nil {
+		t.Fatalf("generating code: %v", err)
+	}
+	next, ok := Validate(rfc6238Secret, code, now.Add(30*time.Second))
+	if !ok || next <= last {
+		t.Errorf("next code: step = %d (ok %v), want a step after %d", next, ok, last)
+	}
+}
+
+func TestValidateRejectsMalformedInput(t *testing.T) {
+	now := time.Unix(59, 0)
+	for _, tc := range []struct{ secret, code string }{
+		{rfc6238Secret, "28708"},
+		{rfc6238Secret, "94287082"},
+		{rfc6238Secret, "287083"},
+		{"not base32!", "287082"},
+	} {
+		if _, ok := Validate(tc.secret, tc.code, now); ok {
+			t.Errorf("Validate(%q, %q) accepted", tc.secret, tc.code)
+		}
+	}
+}